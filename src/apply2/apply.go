@@ -1,24 +1,53 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/json"
+	"export"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"mailer"
 	"model"
-	/* "os" */
+	"os"
 	"server"
+	"strings"
+	"time"
 	"umass"
 )
 
 type DBConn struct {
   Host string
   Port string
+  Dept string
+  Cycle string
 }
 
 var dbconn DBConn
 
+// namespace returns the namespace named by the -dept and -cycle flags.
+func namespace() model.Namespace {
+	ns, err := model.NewNamespace(dbconn.Dept, dbconn.Cycle)
+	if err != nil {
+		panic(err)
+	}
+	return ns
+}
+
+// servedNamespaces returns the namespace named by the -dept and -cycle flags
+// or, if no department is named, every namespace in the database.
+func servedNamespaces() []model.Namespace {
+	if dbconn.Dept != "" {
+		return []model.Namespace{namespace()}
+	}
+	namespaces, err := model.ListNamespaces(dbconn.Host, dbconn.Port)
+	if err != nil {
+		panic(err)
+	}
+	return namespaces
+}
+
 func rand16() []byte {
 	key := [16]byte{}
 	num, err := rand.Read(key[:])
@@ -38,14 +67,49 @@ func keygen(file string) {
 	}
 }
 
-func deleteDept() {
-	dept, err := model.LoadDept(dbconn.Host, dbconn.Port)
+// confirm asks the user to type name and reports whether they did.
+func confirm(prompt string, name string) bool {
+	fmt.Printf("%v\nType %q to confirm: ", prompt, name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(line) == name
+}
+
+// deptLabel names the department in prompts and listings.
+func deptLabel(ns model.Namespace) string {
+	if ns == "" {
+		return "default"
+	}
+	return string(ns)
+}
+
+func deleteDept(force bool, retainDays int, now bool) {
+	dept, err := model.OpenDept(dbconn.Host, dbconn.Port, namespace())
 	if err != nil {
 		panic(fmt.Sprintf("department does not exist %v", err))
 	}
 
-	dept.Delete()
-	return
+	label := deptLabel(dept.Namespace())
+	if now {
+		if !force && !confirm("This permanently deletes every database of "+
+			"the department.", label) {
+			fmt.Printf("not deleted\n")
+			return
+		}
+		err = dept.Delete()
+	} else {
+		if !force && !confirm(fmt.Sprintf("This archives the department for %v "+
+			"days; 'apply2 undeletedept' restores it.", retainDays), label) {
+			fmt.Printf("not deleted\n")
+			return
+		}
+		err = dept.SoftDelete(time.Duration(retainDays) * 24 * time.Hour)
+	}
+	if err != nil {
+		panic(err)
+	}
 }
 
 type Command struct {
@@ -61,7 +125,7 @@ var cmdUMassImport = &Command {
 			return
 		}
 		file := args[0]
-		umass.ImportCSV(dbconn.Host, dbconn.Port, file)
+		umass.ImportCSV(dbconn.Host, dbconn.Port, namespace(), file)
 	},
 	Short: "import CSV data from UMass",
 	Usage: "FILENAME.CSV",
@@ -80,6 +144,18 @@ var cmdUMassPDFs = &Command {
 	Usage: "DIRECTORY NAME",
 }
 
+var cmdUMassZip = &Command {
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help umasszip' for information")
+			return
+		}
+		umass.ImportZip(dbconn.Host, dbconn.Port, namespace(), args[0])
+	},
+	Short: "import PDF data from a UMass ZIP archive",
+	Usage: "FILENAME.ZIP",
+}
+
 var cmdKeygen = &Command {
 	Run: func (args [] string) {
 		if len(args) != 1 {
@@ -92,19 +168,88 @@ var cmdKeygen = &Command {
 }
 
 var cmdDeleteDept = &Command {
+	Run: func (args []string) {
+		flags := flag.NewFlagSet("deletedept", flag.ContinueOnError)
+		force := flags.Bool("force", false, "do not ask for confirmation")
+		retain := flags.Int("retain",
+			int(model.DefaultRetention / (24 * time.Hour)),
+			"days to keep the archived department")
+		now := flags.Bool("now", false, "delete permanently, without archiving")
+		if flags.Parse(args) != nil || flags.NArg() != 0 || *retain < 0 {
+			fmt.Printf("invalid arguments; 'apply2 help deletedept' for information")
+			return
+		}
+		deleteDept(*force, *retain, *now)
+	},
+	Short: "delete a department, archiving it first",
+	Usage: `[-force] [-retain DAYS] [-now]
+
+Archives the department: it is no longer served, and 'apply2 purgedepts'
+deletes it permanently after DAYS days (default 30). With -now, deletes it
+permanently at once. Asks you to type the department's name unless -force.`,
+}
+
+var cmdUndeleteDept = &Command {
+	Run: func (args []string) {
+		if len(args) != 0 {
+			fmt.Printf("too many arguments; 'apply2 help undeletedept' for information")
+			return
+		}
+		dept, err := model.OpenDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.Undelete()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+	Short: "restore an archived department",
+}
+
+var cmdPurgeDepts = &Command {
 	Run: func (args []string) {
 		if len(args) != 0 {
-			fmt.Printf("too many arguments; 'apply2 help deletedept' for information")
+			fmt.Printf("too many arguments; 'apply2 help purgedepts' for information")
 			return
 		}
-		deleteDept()
+		purged, err := model.PurgeDeleted(dbconn.Host, dbconn.Port, time.Now())
+		for _, ns := range purged {
+			fmt.Printf("purged %v\n", deptLabel(ns))
+		}
+		if err != nil {
+			panic(err)
+		}
+	},
+	Short: "permanently delete archived departments past their retention",
+}
+
+var cmdListDepts = &Command {
+	Run: func(args []string) {
+		namespaces, err := model.ListNamespaces(dbconn.Host, dbconn.Port)
+		if err != nil {
+			panic(err)
+		}
+		for _, ns := range namespaces {
+			dept, err := model.OpenDept(dbconn.Host, dbconn.Port, ns)
+			if err != nil {
+				fmt.Printf("%v (cannot load: %v)\n", deptLabel(ns), err)
+				continue
+			}
+			if deletion := dept.Deletion(); deletion != nil {
+				fmt.Printf("%v (deleted; purged after %v)\n", deptLabel(ns),
+					time.Unix(int64(deletion.PurgeAfter), 0).Format("2006-01-02"))
+			} else {
+				fmt.Printf("%v\n", deptLabel(ns))
+			}
+		}
 	},
-	Short: "permanently delete a department from the database",
+	Short: "list the departments in the database",
 }
 
 var cmdNewDept = &Command {
 	Run: func(args []string) {
-		_, err := model.NewDept(dbconn.Host, dbconn.Port)
+		_, err := model.NewDept(dbconn.Host, dbconn.Port, namespace())
 		if err != nil {
 			panic(err)
 		}
@@ -112,77 +257,1038 @@ var cmdNewDept = &Command {
 	Short: "create a new, empty department",
 }
 
+var cmdMigrate = &Command {
+	Short: "migrate a department to the current version",
+	Usage: `[-n]
+
+With -n, lists the migrations that would be applied.`,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+		dryRun := flags.Bool("n", false, "list pending migrations only")
+		if flags.Parse(args) != nil || flags.NArg() != 0 {
+			fmt.Printf("invalid arguments; 'apply2 help migrate' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("department is at version %v of %v\n", dept.Version(),
+			model.CurrentVersion())
+		if *dryRun {
+			for _, name := range dept.PendingMigrations() {
+				fmt.Printf("pending: %v\n", name)
+			}
+			return
+		}
+		applied, err := dept.Migrate()
+		for _, name := range applied {
+			fmt.Printf("applied: %v\n", name)
+		}
+		if err != nil {
+			fmt.Printf("migration failed: %v\n", err)
+		}
+	},
+}
+
+var cmdFsck = &Command {
+	Short: "check a department for inconsistent data",
+	Usage: `[-repair]
+
+With -repair, installs missing views and deletes records that refer to
+missing applications or reviewers. Comments and letters are only reported.`,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+		repair := flags.Bool("repair", false, "repair what can be repaired")
+		if flags.Parse(args) != nil || flags.NArg() != 0 {
+			fmt.Printf("invalid arguments; 'apply2 help fsck' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		problems, err := dept.Fsck(*repair)
+		if err != nil {
+			panic(err)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("no problems found\n")
+			return
+		}
+		for _, p := range problems {
+			fmt.Printf("%v: %v\n", p.Description, p.Count)
+			for _, sample := range p.Samples {
+				fmt.Printf("    %v\n", sample)
+			}
+			if p.Count > len(p.Samples) {
+				fmt.Printf("    ...\n")
+			}
+			if *repair && p.Repairable {
+				fmt.Printf("  repaired %v\n", p.Repaired)
+			}
+			for _, e := range p.Errors {
+				fmt.Printf("  error: %v\n", e)
+			}
+		}
+	},
+}
+
 var cmdNewReviewer = &Command {
 	Short: "create a new reviewer account",
 	Usage: `USERNAME PASSWORD "Full Name"`,
 	Run: func(args []string) {
-		dept, err := model.LoadDept(dbconn.Host, dbconn.Port)
+		if len(args) != 3 {
+			fmt.Printf("wrong number of arguments; 'apply2 help newreviewer' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		_, err = dept.NewReviewer(model.ReviewerId(args[0]), args[2], args[1])
+		if err != nil {
+			fmt.Printf("could not create reviewer: %v\n", err)
+		}
+	},
+}
+
+// reviewerCommand returns a command that runs fn on the department and the
+// reviewer named by its only argument.
+func reviewerCommand(name string, short string,
+	fn func(dept *model.Dept, id model.ReviewerId) error) *Command {
+	return &Command {
+		Short: short,
+		Usage: "USERNAME",
+		Run: func(args []string) {
+			if len(args) != 1 {
+				fmt.Printf("missing argument; 'apply2 help %v' for information", name)
+				return
+			}
+			dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+			if err != nil {
+				panic(err)
+			}
+			err = fn(dept, model.ReviewerId(args[0]))
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			}
+		},
+	}
+}
+
+func printReviewer(rev *model.Reviewer) {
+	var flags []string
+	if rev.Chair {
+		flags = append(flags, "chair")
+	}
+	if rev.Disabled {
+		flags = append(flags, "disabled")
+	}
+	if rev.Invitation != nil {
+		flags = append(flags, "invitation "+rev.Invitation.State(time.Now()))
+	}
+	fmt.Printf("%-16v %-30v %-30v %v\n", rev.Id, rev.Name, rev.Email,
+		strings.Join(flags, ", "))
+}
+
+var cmdReviewers = &Command {
+	Short: "list reviewers",
+	Run: func(args []string) {
+		if len(args) != 0 {
+			fmt.Printf("too many arguments; 'apply2 help reviewers' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
 		if err != nil {
 			panic(err)
 		}
-		dept.NewReviewer(model.ReviewerId(args[0]), args[2], args[1])
+		revs, err := dept.Reviewers()
 		if err != nil {
 			panic(err)
 		}
+		for i := range revs {
+			printReviewer(&revs[i])
+		}
 	},
 }
 
-var cmdLoadApps = &Command {
-	Short: "load applicant information",
-	Usage: `DEPT_PATH`,
+var cmdShowReviewer = reviewerCommand("showreviewer", "show a reviewer",
+	func(dept *model.Dept, id model.ReviewerId) error {
+		rev, err := dept.GetReviewerById(id)
+		if err != nil {
+			return fmt.Errorf("no reviewer %v", id)
+		}
+		printReviewer(rev)
+		return nil
+	})
+
+var cmdDisableReviewer = reviewerCommand("disablereviewer",
+	"stop a reviewer from logging in, keeping their reviews",
+	func(dept *model.Dept, id model.ReviewerId) error {
+		return dept.SetReviewerDisabled(id, true)
+	})
+
+var cmdEnableReviewer = reviewerCommand("enablereviewer",
+	"let a disabled reviewer log in again",
+	func(dept *model.Dept, id model.ReviewerId) error {
+		return dept.SetReviewerDisabled(id, false)
+	})
+
+var cmdDeleteReviewer = &Command {
+	Short: "delete a reviewer account",
+	Usage: `[-force] USERNAME
+
+Their comments are kept; 'apply2 fsck -repair' deletes their scores and
+highlights. To keep their scores, use 'apply2 disablereviewer' instead.`,
 	Run: func(args []string) {
-		src, err := ioutil.ReadFile(args[0])
+		flags := flag.NewFlagSet("deletereviewer", flag.ContinueOnError)
+		force := flags.Bool("force", false, "do not ask for confirmation")
+		if flags.Parse(args) != nil || flags.NArg() != 1 {
+			fmt.Printf("invalid arguments; 'apply2 help deletereviewer' for information")
+			return
+		}
+		id := flags.Arg(0)
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		if !*force && !confirm("This deletes the reviewer's account.", id) {
+			fmt.Printf("not deleted\n")
+			return
+		}
+		err = dept.DeleteReviewer(model.ReviewerId(id))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdRenameReviewer = &Command {
+	Short: "change a reviewer's full name",
+	Usage: `USERNAME "Full Name"`,
+	Run: func(args []string) {
+		if len(args) != 2 {
+			fmt.Printf("wrong number of arguments; 'apply2 help renamereviewer' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetReviewerName(model.ReviewerId(args[0]), args[1])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdImportReviewers = &Command {
+	Short: "create reviewers from a CSV file",
+	Usage: `FILENAME.csv
+
+Each row is "Full Name,email". The username is the part of the email address
+before the "@".`,
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help importreviewers' for information")
+			return
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		added, errs := dept.ImportReviewers(f)
+		for _, err := range errs {
+			fmt.Printf("%v\n", err)
+		}
+		fmt.Printf("created %v reviewers\n", len(added))
+	},
+}
+
+const invitationText = `Hello %v,
+
+You have been invited to review applicants with Apply2. Your username is %v.
+To choose a password, visit this link before %v:
+
+%v
+
+The link works once. If it has expired, ask the chair for a new invitation.
+`
+
+var cmdInvite = &Command {
+	Short: "email reviewers a link to set a password",
+	Usage: `-key KEYFILE -url BASEURL -mail TRANSPORT -from ADDRESS [-days N]
+       (FILENAME.csv | USERNAME ...)
+
+Invites the reviewers created from FILENAME.csv, as in 'apply2 importreviewers',
+or the existing reviewers USERNAME. Sending again replaces an earlier link.
+KEYFILE must be the key the server runs with. ` + mailUsage,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("invite", flag.ContinueOnError)
+		keyFile := flags.String("key", "", "the server's key")
+		baseURL := flags.String("url", "", "address of the site")
+		mail := flags.String("mail", "", "mail transport")
+		from := flags.String("from", "", "sender address")
+		days := flags.Int("days", 7, "days until the link expires")
+		if flags.Parse(args) != nil || flags.NArg() == 0 || *keyFile == "" ||
+			*baseURL == "" || *mail == "" || *from == "" {
+			fmt.Printf("invalid arguments; 'apply2 help invite' for information\n")
+			return
+		}
+		key, err := ioutil.ReadFile(*keyFile)
 		if err != nil {
 			panic(err)
 		}
-		var applications []model.Application
-		err = json.Unmarshal(src, &applications)
+		transport, err := mailer.Parse(*mail)
 		if err != nil {
 			panic(err)
 		}
-		dept, err := model.LoadDept(dbconn.Host, dbconn.Port)
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
 		if err != nil {
 			panic(err)
 		}
-		for _, app := range applications {
-			err = dept.NewApplication(app)
+
+		var ids []model.ReviewerId
+		if flags.NArg() == 1 && strings.HasSuffix(flags.Arg(0), ".csv") {
+			f, err := os.Open(flags.Arg(0))
 			if err != nil {
 				panic(err)
 			}
+			added, errs := dept.ImportReviewers(f)
+			f.Close()
+			for _, err := range errs {
+				fmt.Printf("%v\n", err)
+			}
+			for _, rev := range added {
+				ids = append(ids, rev.Id)
+			}
+		} else {
+			for _, id := range flags.Args() {
+				ids = append(ids, model.ReviewerId(id))
+			}
+		}
+
+		ns := dept.Namespace()
+		send := func(rev *model.Reviewer, inv *model.Invitation) error {
+			link := server.SetupLink(key, *baseURL, ns, rev.Id, inv.Nonce)
+			return transport.Send(&mailer.Message{
+				From:    *from,
+				To:      rev.Email,
+				Subject: "Your Apply2 account",
+				Body: fmt.Sprintf(invitationText, rev.Name, rev.Id,
+					inv.Expires.Format("January 2, 2006 at 15:04 MST"), link),
+			})
+		}
+		sent := 0
+		for _, id := range ids {
+			err := dept.Invite(id, time.Duration(*days)*24*time.Hour, send)
+			if err != nil {
+				fmt.Printf("inviting %v: %v\n", id, err)
+				continue
+			}
+			sent++
 		}
+		fmt.Printf("invited %v of %v reviewers\n", sent, len(ids))
 	},
 }
 
-var cmdFastCGI = &Command {
-	Short: "run apply2 FastCGI server",
-	Usage: "[KEY]",
+var cmdNewLetter = &Command {
+	Short: "record a recommendation letter",
+	Usage: `APPLICANT_ID "Writer Name" [UPLOAD]`,
 	Run: func(args []string) {
-		if len(args) == 0 {
-			fmt.Printf("Generated random key. Any running sessions will fail.\n")
-			server.Serve(dbconn.Host, dbconn.Port, rand16(), false)
-		} else if len(args) == 1 {
-			key, err := ioutil.ReadFile(args[0])
-			if err != nil { panic (err) }
-			server.Serve(dbconn.Host, dbconn.Port, key , false)
-		}	else {
-			fmt.Print("Invalid arguments. Run 'apply2 help'.\n")
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Printf("wrong number of arguments; 'apply2 help newletter' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		letter := &model.Letter{
+			ApplicantId: args[0],
+			Writer:      args[1],
+			Received:    float64(time.Now().Unix()),
+		}
+		if len(args) == 3 {
+			letter.Upload = args[2]
+		}
+		err = dept.SetLetter(letter)
+		if err != nil {
+			panic(err)
 		}
 	},
 }
 
-var cmdTestServer = &Command {
-	Short: "run a test server",
-	Usage: `[KEY]`,
+var cmdLoadApps = &Command {
+	Short: "load applicant information from JSON or NDJSON",
+	Usage: `FILENAME.json`,
 	Run: func(args []string) {
-		if len(args) == 0 {
-			fmt.Printf("Generated random key. Any running sessions will fail.\n")
-			server.Serve(dbconn.Host, dbconn.Port, rand16(), true)
-		} else if len(args) == 1 {
-			key, err := ioutil.ReadFile(args[0])
-			if err != nil { panic (err) }
-			server.Serve(dbconn.Host, dbconn.Port, key , true)
-		}	else {
-			fmt.Print("Invalid arguments. Run 'apply2 help'.\n")
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help loadapps' for information")
+			return
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		loaded := 0
+		errs, err := model.ReadApplications(f, dept.Schema(),
+			func(id string, app map[string]interface{}) error {
+				err := dept.PutApplication(id, app)
+				if err == nil {
+					loaded++
+				}
+				return err
+			})
+		for _, recErr := range errs {
+			fmt.Printf("%v\n", recErr)
+		}
+		if err != nil {
+			fmt.Printf("stopped reading %v: %v\n", args[0], err)
+		}
+		fmt.Printf("loaded %v records, rejected %v\n", loaded, len(errs))
+	},
+}
+
+var cmdSetSchema = &Command {
+	Short: "set the schema that loadapps validates applicants against",
+	Usage: `SCHEMA.json`,
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help setschema' for information")
+			return
+		}
+		src, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+		var schema model.Schema
+		err = json.Unmarshal(src, &schema)
+		if err != nil {
+			panic(err)
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetSchema(&schema)
+		if err != nil {
+			fmt.Printf("invalid schema: %v\n", err)
+		}
+	},
+}
+
+var cmdSetForm = &Command {
+	Short: "set the evaluation form that reviewers fill in for each applicant",
+	Usage: `FORM.json`,
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help setform' for information")
+			return
+		}
+		src, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+		var form model.EvaluationForm
+		err = json.Unmarshal(src, &form)
+		if err != nil {
+			panic(err)
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetEvaluationForm(&form)
+		if err != nil {
+			fmt.Printf("invalid form: %v\n", err)
+			return
+		}
+		fmt.Printf("set version %v of the evaluation form\n", form.Version)
+	},
+}
+
+var cmdApplicantChoices = &Command {
+	Short: "show or set what applicants choose areas, faculty and programs from",
+	Usage: `[CHOICES.json]
+
+CHOICES.json looks like
+
+  { "programs": [ "MS", "PhD" ],
+    "areas": [ "Programming Languages", "Systems" ],
+    "faculty": [ "Grace Hopper", "Alan Turing" ] }
+
+Applicants choose from these at the links that 'apply2 applicantlink' prints.
+An empty or missing list lets applicants write their own. Without arguments,
+prints the current choices.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		if len(args) == 0 {
+			out, err := json.MarshalIndent(dept.ApplicantChoices(), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s\n", out)
+			return
+		}
+		src, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+		var choices model.ApplicantChoices
+		err = json.Unmarshal(src, &choices)
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetApplicantChoices(&choices)
+		if err != nil {
+			fmt.Printf("invalid choices: %v\n", err)
+		}
+	},
+}
+
+var cmdApplicantLink = &Command {
+	Short: "print links at which applicants choose areas, faculty and a program",
+	Usage: `-key KEYFILE -url BASEURL [-days N] APPLICANT_ID ...
+
+Prints a link for each applicant, replacing any earlier link. Applicants may
+submit again until the link expires; the department keeps every submission.
+KEYFILE must be the key the server runs with. Chairs can also make links from
+an applicant's info pane.`,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("applicantlink", flag.ContinueOnError)
+		keyFile := flags.String("key", "", "the server's key")
+		baseURL := flags.String("url", "", "address of the site")
+		days := flags.Int("days", 30, "days until the link expires")
+		if flags.Parse(args) != nil || flags.NArg() == 0 || *keyFile == "" ||
+			*baseURL == "" {
+			fmt.Printf("invalid arguments; 'apply2 help applicantlink' for information\n")
+			return
+		}
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			panic(err)
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		for _, appId := range flags.Args() {
+			link, err := dept.MintApplicantLink(appId, "",
+				time.Duration(*days)*24*time.Hour)
+			if err != nil {
+				fmt.Printf("%v: %v\n", appId, err)
+				continue
+			}
+			fmt.Printf("%v %v\n", appId, server.ApplicantLink(key, *baseURL,
+				dept.Namespace(), appId, link.Nonce))
+		}
+	},
+}
+
+var cmdPacketOrder = &Command {
+	Short: "show or set the order of materials in applicant packets",
+	Usage: `[LABEL_PREFIX ...]
+
+Packets include materials whose labels start with the first prefix, then the
+second, and so on, ignoring case; other materials come last. Without
+arguments, prints the current order.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		if len(args) == 0 {
+			for _, prefix := range dept.PacketOrder() {
+				fmt.Printf("%v\n", prefix)
+			}
+			return
+		}
+		err = dept.SetPacketOrder(args)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdBlobStore = &Command {
+	Short: "show or set where uploads are stored",
+	Usage: `[SPEC]
+
+SPEC is one of
+
+  couchdb                                  in the uploads database (the default)
+  file:DIRECTORY                           in DIRECTORY, which must be absolute
+  s3:http[s]://HOST[:PORT]/BUCKET[/PREFIX] in an S3-compatible service
+
+Departments may share a DIRECTORY; each keeps its uploads in a subdirectory
+named like its uploads database, e.g., DIRECTORY/cs_2014_uploads. S3
+credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and the
+region from AWS_REGION, wherever apply2 runs. The store can only be changed
+while the department has no uploads. Without arguments, prints the current
+store.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		if len(args) == 0 {
+			fmt.Printf("%v\n", dept.BlobStoreSpec())
+			return
+		}
+		if len(args) != 1 {
+			fmt.Printf("wrong number of arguments; 'apply2 help blobstore' for information")
+			return
+		}
+		err = dept.SetBlobStore(args[0])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdScanner = &Command {
+	Short: "show or set the malware scanner for uploads",
+	Usage: `[SPEC | none]
+
+SPEC is clamd:unix:SOCKET or clamd:tcp:HOST:PORT, to send every upload to a
+ClamAV daemon. Uploads are rejected if it finds malware, or cannot be stored
+if it is down. Without arguments, prints the current scanner.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		if len(args) == 0 {
+			spec := dept.ScannerSpec()
+			if spec == "" {
+				spec = "none"
+			}
+			fmt.Printf("%v\n", spec)
+			return
+		}
+		if len(args) != 1 {
+			fmt.Printf("wrong number of arguments; 'apply2 help scanner' for information")
+			return
+		}
+		spec := args[0]
+		if spec == "none" {
+			spec = ""
+		}
+		err = dept.SetScanner(spec)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdValidate = &Command {
+	Short: "check every material again and record the results",
+	Usage: `
+
+New uploads are checked when they are stored. Run validate after adding a
+scanner, or after restoring a backup, to check the materials already stored.
+Prints the materials that fail.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		problems, err := dept.ValidateMaterials()
+		if err != nil {
+			panic(err)
+		}
+		for _, problem := range problems {
+			fmt.Printf("%v\n", problem)
+		}
+	},
+}
+
+var cmdPreviews = &Command {
+	Short: "make previews of the materials that have none",
+	Usage: `
+
+Previews hold each material's page count, the start of its first page's text
+and a thumbnail of that page. The server makes them every few minutes; run
+previews to make them at once. Thumbnails of pages that are not scans need
+pdftoppm, from Poppler.`,
+	Run: func(args []string) {
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		made, err := dept.MakePreviews()
+		fmt.Printf("made %v previews\n", made)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdPacket = &Command {
+	Short: "write an applicant's materials as one PDF",
+	Usage: `APPLICANT_ID FILENAME.pdf`,
+	Run: func(args []string) {
+		if len(args) != 2 {
+			fmt.Printf("wrong number of arguments; 'apply2 help packet' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		data, err := dept.Packet(args[0])
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(args[1], data, 0644)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+var cmdSetChair = &Command {
+	Short: "grant or revoke a reviewer's chair privileges",
+	Usage: `USERNAME yes|no`,
+	Run: func(args []string) {
+		if len(args) != 2 || (args[1] != "yes" && args[1] != "no") {
+			fmt.Printf("invalid arguments; 'apply2 help setchair' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetChair(model.ReviewerId(args[0]), args[1] == "yes")
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+var cmdFindMatches = &Command {
+	Short: "match applicants to applicants from prior cycles",
+	Usage: `
+
+Matches on the applicant id are confirmed. Matches on email address or name
+are suggested; confirm or reject them with 'apply2 setmatch'.`,
+	Run: func(args []string) {
+		if len(args) != 0 {
+			fmt.Printf("too many arguments; 'apply2 help findmatches' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		found, err := dept.FindMatches()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("found %v new matches\n", found)
+	},
+}
+
+var cmdMatches = &Command {
+	Short: "list matches to applicants from prior cycles",
+	Usage: `[suggested|confirmed|rejected]`,
+	Run: func(args []string) {
+		if len(args) > 1 {
+			fmt.Printf("too many arguments; 'apply2 help matches' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		status := ""
+		if len(args) == 1 {
+			status = args[0]
+		}
+		matches, err := dept.Matches(status)
+		if err != nil {
+			panic(err)
+		}
+		for _, m := range matches {
+			fmt.Printf("%-24v %v -> %v %v (%v, %v)\n", m.Id, m.AppId,
+				m.PriorCycle, m.PriorAppId, m.Reason, m.Status)
+		}
+	},
+}
+
+var cmdSetMatch = &Command {
+	Short: "confirm or reject a match to a prior applicant",
+	Usage: `MATCH_ID confirmed|rejected|suggested`,
+	Run: func(args []string) {
+		if len(args) != 2 {
+			fmt.Printf("invalid arguments; 'apply2 help setmatch' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetMatchStatus(args[0], args[1])
+		if err != nil {
+			fmt.Printf("could not set match: %v\n", err)
+		}
+	},
+}
+
+var cmdExport = &Command {
+	Short: "export applicants as CSV, JSON or XLSX",
+	Usage: `[-format csv|json|xlsx] [-columns KEY,...] [-filter FILTER.json] ` +
+		`[-o FILE] [REVIEWER]
+
+Highlights are those set for REVIEWER. FILTER.json holds a filter copied from
+the client (the URL fragment of a "copy filters" link).`,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("export", flag.ContinueOnError)
+		format := flags.String("format", "csv", "csv, json or xlsx")
+		columns := flags.String("columns", "", "comma-separated column keys")
+		filterFile := flags.String("filter", "", "file holding a client filter")
+		outFile := flags.String("o", "", "output file (default stdout)")
+		if flags.Parse(args) != nil || flags.NArg() > 1 {
+			fmt.Printf("invalid arguments; 'apply2 help export' for information")
+			return
+		}
+
+		opts := &export.Options{Format: *format}
+		if *columns != "" {
+			opts.Columns = strings.Split(*columns, ",")
+		}
+		if *filterFile != "" {
+			src, err := ioutil.ReadFile(*filterFile)
+			if err != nil {
+				panic(err)
+			}
+			opts.Filter, err = export.ParseFilter(src)
+			if err != nil {
+				fmt.Printf("invalid filter: %v\n", err)
+				return
+			}
+		}
+
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		apps, err := dept.Applications(flags.Arg(0))
+		if err != nil {
+			panic(err)
+		}
+		reviewers, err := dept.GetReviewerIdMap()
+		if err != nil {
+			panic(err)
+		}
+
+		out := os.Stdout
+		if *outFile != "" {
+			out, err = os.Create(*outFile)
+			if err != nil {
+				panic(err)
+			}
+			defer out.Close()
+		}
+		err = export.Write(out, apps, reviewers, opts)
+		if err != nil {
+			fmt.Printf("export failed: %v\n", err)
+		}
+	},
+}
+
+var cmdBackup = &Command {
+	Short: "back up the department to a file",
+	Usage: `FILENAME.tar.gz`,
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help backup' for information")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			panic(err)
+		}
+		err = dept.Backup(f)
+		if err != nil {
+			f.Close()
+			os.Remove(args[0])
+			fmt.Printf("backup failed: %v\n", err)
+			return
+		}
+		err = f.Close()
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+var cmdRestore = &Command {
+	Short: "restore a backup into a new, empty department",
+	Usage: `FILENAME.tar.gz
+
+Create the department with 'apply2 newdept' first. The backup is verified
+before anything is written.`,
+	Run: func(args []string) {
+		if len(args) != 1 {
+			fmt.Printf("missing argument; 'apply2 help restore' for information")
+			return
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.Restore(f)
+		if err != nil {
+			fmt.Printf("restore failed: %v\n", err)
+		}
+	},
+}
+
+// mailFlags adds the flags that configure email to flags and returns a
+// function that, after parsing, returns the mailer they describe, or nil if
+// -mail is not given.
+func mailFlags(flags *flag.FlagSet) func() *model.Mailer {
+	mail := flags.String("mail", "", "mail transport")
+	from := flags.String("from", "", "sender address")
+	baseURL := flags.String("url", "", "address of the site")
+	return func() *model.Mailer {
+		if *mail == "" {
+			return nil
+		}
+		if *from == "" || *baseURL == "" {
+			panic("-mail needs -from and -url")
+		}
+		transport, err := mailer.Parse(*mail)
+		if err != nil {
+			panic(err)
+		}
+		return &model.Mailer{Transport: transport, From: *from, URL: *baseURL}
+	}
+}
+
+const mailUsage = `TRANSPORT is smtp://[USER:PASSWORD@]HOST:PORT, or maildir:DIRECTORY or
+file:FILENAME to keep the mail locally for testing. BASEURL is the address of
+the site, e.g., https://apply.cs.umass.edu.`
+
+// serve runs the server, emailing notifications as they happen if -mail is
+// given. Reviewers who want a daily digest get it from 'apply2 digest'.
+func serve(name string, args []string, isTesting bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	getMailer := mailFlags(flags)
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		fmt.Print("Invalid arguments. Run 'apply2 help'.\n")
+		return
+	}
+	server.SetMailer(getMailer())
+	if flags.NArg() == 0 {
+		fmt.Printf("Generated random key. Any running sessions will fail.\n")
+		server.Serve(dbconn.Host, dbconn.Port, servedNamespaces(), rand16(), isTesting)
+	} else {
+		key, err := ioutil.ReadFile(flags.Arg(0))
+		if err != nil { panic (err) }
+		server.Serve(dbconn.Host, dbconn.Port, servedNamespaces(), key, isTesting)
+	}
+}
+
+var cmdFastCGI = &Command {
+	Short: "run apply2 FastCGI server",
+	Usage: `[-mail TRANSPORT -from ADDRESS -url BASEURL] [KEY]
+
+Serves the department named by -dept and -cycle or, without -dept, every
+department in the database. With -mail, emails reviewers who want to hear
+of highlights and mentions right away. ` + mailUsage,
+	Run: func(args []string) {
+		serve("fastcgi", args, false)
+	},
+}
+
+var cmdTestServer = &Command {
+	Short: "run a test server",
+	Usage: `[-mail TRANSPORT -from ADDRESS -url BASEURL] [KEY]
+
+Serves the department named by -dept and -cycle or, without -dept, every
+department in the database. With -mail, emails reviewers who want to hear
+of highlights and mentions right away. ` + mailUsage,
+	Run: func(args []string) {
+		serve("testserver", args, true)
+	},
+}
+
+var cmdDigest = &Command {
+	Short: "email reviewers the notifications they have not been emailed",
+	Usage: `-mail TRANSPORT -from ADDRESS -url BASEURL
+
+Run daily, e.g., from cron, for each department. Also sends notifications
+that the server could not email when they happened. ` + mailUsage,
+	Run: func(args []string) {
+		flags := flag.NewFlagSet("digest", flag.ContinueOnError)
+		getMailer := mailFlags(flags)
+		if flags.Parse(args) != nil || flags.NArg() != 0 {
+			fmt.Printf("invalid arguments; 'apply2 help digest' for information\n")
+			return
+		}
+		m := getMailer()
+		if m == nil {
+			fmt.Printf("missing -mail; 'apply2 help digest' for information\n")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		sent, err := dept.SendDigests(m)
+		fmt.Printf("sent %v digests\n", sent)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	},
+}
+
+var cmdNotifyPrefs = &Command {
+	Short: "set how often a reviewer is emailed about notifications",
+	Usage: `USERNAME (immediate | daily | never) [KIND ...]
+
+Reviewers are emailed about highlights and mentions. Naming KINDs (highlight,
+mention) stops the emails about those. Reviewers can also choose in the
+client.`,
+	Run: func(args []string) {
+		if len(args) < 2 {
+			fmt.Printf("missing arguments; 'apply2 help notifyprefs' for information\n")
+			return
+		}
+		dept, err := model.LoadDept(dbconn.Host, dbconn.Port, namespace())
+		if err != nil {
+			panic(err)
+		}
+		err = dept.SetNotifyPrefs(model.ReviewerId(args[0]),
+			model.NotifyPrefs{Email: args[1], Mute: args[2:]})
+		if err != nil {
+			fmt.Printf("%v\n", err)
 		}
 	},
 }
@@ -218,19 +1324,55 @@ func runCmdHelp(args []string) {
 var commands = map[string]*Command{
 	"keygen": cmdKeygen,
 	"deletedept": cmdDeleteDept,
+	"undeletedept": cmdUndeleteDept,
+	"purgedepts": cmdPurgeDepts,
 	"newdept": cmdNewDept,
+	"listdepts": cmdListDepts,
+	"migrate": cmdMigrate,
+	"fsck": cmdFsck,
 	"newreviewer": cmdNewReviewer,
+	"reviewers": cmdReviewers,
+	"showreviewer": cmdShowReviewer,
+	"renamereviewer": cmdRenameReviewer,
+	"disablereviewer": cmdDisableReviewer,
+	"enablereviewer": cmdEnableReviewer,
+	"deletereviewer": cmdDeleteReviewer,
+	"importreviewers": cmdImportReviewers,
+	"invite": cmdInvite,
+	"notifyprefs": cmdNotifyPrefs,
+	"digest": cmdDigest,
+	"newletter": cmdNewLetter,
 	"loadapps": cmdLoadApps,
+	"setschema": cmdSetSchema,
+	"setform": cmdSetForm,
+	"packetorder": cmdPacketOrder,
+	"packet": cmdPacket,
+	"blobstore": cmdBlobStore,
+	"scanner": cmdScanner,
+	"validate": cmdValidate,
+	"previews": cmdPreviews,
+	"applicantchoices": cmdApplicantChoices,
+	"applicantlink": cmdApplicantLink,
+	"setchair": cmdSetChair,
+	"findmatches": cmdFindMatches,
+	"matches": cmdMatches,
+	"setmatch": cmdSetMatch,
+	"export": cmdExport,
+	"backup": cmdBackup,
+	"restore": cmdRestore,
 	"fastcgi": cmdFastCGI,
 	"testserver": cmdTestServer,
 	"umassimport": cmdUMassImport,
 	"umasspdfs": cmdUMassPDFs,
+	"umasszip": cmdUMassZip,
 }
 
 func main() {
 
 	flag.StringVar(&dbconn.Host, "dbhost", "localhost", "dbhost <ip/name>")
 	flag.StringVar(&dbconn.Port, "dbport", "5984", "dbport <port>")
+	flag.StringVar(&dbconn.Dept, "dept", "", "dept <name>")
+	flag.StringVar(&dbconn.Cycle, "cycle", "", "cycle <admissions cycle, e.g. 2014>")
 
 	flag.Parse ()
 
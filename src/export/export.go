@@ -0,0 +1,332 @@
+// Package export writes the joined applicant view (the records that
+// model.Dept.Applications returns) as CSV, JSON or XLSX.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Column kinds, named after the column classes in www/cols.ts.
+const (
+	textCol  = "text"
+	enumCol  = "enum"
+	setCol   = "set"
+	numCol   = "num"
+	starCol  = "star"
+	matsCol  = "mats"
+	scoreCol = "score"
+)
+
+type clientCol struct {
+	label    string
+	friendly string
+	kind     string
+}
+
+// clientCols mirrors the fields array in loadData (www/disembark.ts), in the
+// same order. Serialized filters refer to columns by their position in this
+// list, so keep the two in sync.
+var clientCols = []clientCol{
+	{"personId", "Id", textCol},
+	{"highlight", "Starred", starCol},
+	{"firstName", "First Name", textCol},
+	{"lastName", "Last Name", textCol},
+	{"gender", "Gender", textCol},
+	{"admitTerm", "Admit Term", textCol},
+	{"country", "Country", textCol},
+	{"phone", "Phone", textCol},
+	{"email", "Email", textCol},
+	{"program", "Program", textCol},
+	{"areas", "Areas", setCol},
+	{"faculty", "Faculty", setCol},
+	{"academicPlanCode", "Academic Plan Code", setCol},
+	{"greAnalytic", "GRE Analytic", numCol},
+	{"oldGREMath", "GRE Math (Old)", numCol},
+	{"oldGREVerbal", "GRE Verbal (Old)", numCol},
+	{"newGREMath", "GRE Math (New)", numCol},
+	{"newGREVerbal", "GRE Verbal (New)", numCol},
+	{"undergradGPA", "GPA", numCol},
+	{"gradGPA", "GPA (Graduate)", numCol},
+	{"externalOrgs", "Institutions", setCol},
+	{"materials", "Materials", matsCol},
+	{"recs", "Recommendations", matsCol},
+	{"score_rating", "Ratings", scoreCol},
+	{"avgscore_rating", "Average Rating", numCol},
+	{"lettersReceived", "Letters Received", numCol},
+	{"lettersStatus", "Letters", enumCol},
+	{"letterWriters", "Letter Writers", setCol},
+	{"evaluations", "Evaluations", numCol},
+}
+
+// Exported in addition to the client's columns. The decision is the
+// application's "decision" field, which umass.ImportCSV fills in from the
+// graduate school's records, as can 'apply2 loadapps' with a schema.
+var extraCols = []clientCol{
+	{"decision", "Decision", textCol},
+}
+
+// A Column is one column of an export. Key identifies the column in Options
+// and in JSON output; Header is its title in CSV and XLSX output.
+type Column struct {
+	Key    string
+	Header string
+	value  func(app map[string]interface{}) interface{}
+}
+
+// Columns returns every exportable column. Score columns have one column per
+// reviewer, keyed "label.reviewerId".
+func Columns(reviewers map[string]string) []Column {
+	revIds := make([]string, 0, len(reviewers))
+	for id := range reviewers {
+		revIds = append(revIds, id)
+	}
+	sort.Strings(revIds)
+
+	var cols []Column
+	for _, col := range append(clientCols, extraCols...) {
+		label := col.label
+		switch col.kind {
+		case scoreCol:
+			for _, revId := range revIds {
+				revId := revId
+				cols = append(cols, Column{
+					Key:    label + "." + revId,
+					Header: fmt.Sprintf("%s (%s)", col.friendly, reviewers[revId]),
+					value: func(app map[string]interface{}) interface{} {
+						score, found := scoreOf(app[label], revId)
+						if !found {
+							return nil
+						}
+						return score
+					},
+				})
+			}
+		case starCol:
+			cols = append(cols, Column{label, col.friendly,
+				func(app map[string]interface{}) interface{} {
+					var names []string
+					for _, id := range stringsOf(app[label]) {
+						if name, found := reviewers[id]; found {
+							names = append(names, name)
+						} else {
+							names = append(names, id)
+						}
+					}
+					return names
+				}})
+		case matsCol:
+			cols = append(cols, Column{label, col.friendly,
+				func(app map[string]interface{}) interface{} {
+					var texts []string
+					mats, _ := app[label].([]interface{})
+					for _, mat := range mats {
+						m, _ := mat.(map[string]interface{})
+						if text, ok := m["text"].(string); ok {
+							texts = append(texts, text)
+						}
+					}
+					return texts
+				}})
+		default:
+			cols = append(cols, Column{label, col.friendly,
+				func(app map[string]interface{}) interface{} {
+					return app[label]
+				}})
+		}
+	}
+	return cols
+}
+
+// scoreOf looks up the score set by revId in a score_ field, which is a
+// map[string]float64 when it comes straight from the model and a map of
+// interface{} once it has been through JSON.
+func scoreOf(val interface{}, revId string) (float64, bool) {
+	switch scores := val.(type) {
+	case map[string]float64:
+		score, found := scores[revId]
+		return score, found
+	case map[string]interface{}:
+		return numberOf(scores[revId])
+	}
+	return 0, false
+}
+
+func numberOf(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func stringsOf(val interface{}) []string {
+	switch v := val.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, elt := range v {
+			strs = append(strs, fmt.Sprint(elt))
+		}
+		return strs
+	}
+	return nil
+}
+
+// selectColumns picks the columns named by keys, in that order. A key that
+// names a score column ("score_rating") selects it for every reviewer.
+func selectColumns(all []Column, keys []string) ([]Column, error) {
+	if len(keys) == 0 {
+		return all, nil
+	}
+	var cols []Column
+	for _, key := range keys {
+		found := false
+		for _, col := range all {
+			if col.Key == key || strings.HasPrefix(col.Key, key+".") {
+				cols = append(cols, col)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", key)
+		}
+	}
+	return cols, nil
+}
+
+type Options struct {
+	Format  string   // "csv", "json" or "xlsx"
+	Columns []string // column keys; all columns if empty
+	Filter  Filter   // all applicants if nil
+}
+
+var contentTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"json": "application/json",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// ContentType returns the MIME type of format, or "" if format is unknown.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Write exports the applications that pass opts.Filter, sorted by name.
+// reviewers maps reviewer ids to names.
+func Write(w io.Writer, apps []map[string]interface{},
+	reviewers map[string]string, opts *Options) error {
+	if ContentType(opts.Format) == "" {
+		return fmt.Errorf("unknown format %q", opts.Format)
+	}
+	cols, err := selectColumns(Columns(reviewers), opts.Columns)
+	if err != nil {
+		return err
+	}
+
+	var rows []map[string]interface{}
+	for _, app := range apps {
+		if opts.Filter == nil || opts.Filter(app) {
+			rows = append(rows, app)
+		}
+	}
+	sort.Sort(byName(rows))
+
+	switch opts.Format {
+	case "csv":
+		return writeCSV(w, cols, rows)
+	case "json":
+		return writeJSON(w, cols, rows)
+	}
+	return writeXLSX(w, cols, rows)
+}
+
+type byName []map[string]interface{}
+
+func (self byName) Len() int      { return len(self) }
+func (self byName) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self byName) Less(i, j int) bool {
+	for _, key := range []string{"lastName", "firstName", "personId"} {
+		a, b := fmt.Sprint(self[i][key]), fmt.Sprint(self[j][key])
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+// cellText formats a value for CSV and XLSX.
+func cellText(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, "; ")
+	case []interface{}:
+		return strings.Join(stringsOf(v), "; ")
+	}
+	return fmt.Sprint(val)
+}
+
+// csvText formats a value for CSV. Spreadsheets run text that starts like a
+// formula, and applicants write much of the text, so such text is prefixed
+// with a quote, which spreadsheets show as text.
+func csvText(val interface{}) string {
+	text := cellText(val)
+	if _, ok := numberOf(val); ok || text == "" {
+		return text
+	}
+	if strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+func writeCSV(w io.Writer, cols []Column, rows []map[string]interface{}) error {
+	out := csv.NewWriter(w)
+	record := make([]string, len(cols))
+	for i, col := range cols {
+		record[i] = csvText(col.Header)
+	}
+	err := out.Write(record)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		for i, col := range cols {
+			record[i] = csvText(col.value(row))
+		}
+		err = out.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeJSON(w io.Writer, cols []Column, rows []map[string]interface{}) error {
+	objs := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		obj := make(map[string]interface{}, len(cols))
+		for _, col := range cols {
+			obj[col.Key] = col.value(row)
+		}
+		objs[i] = obj
+	}
+	return json.NewEncoder(w).Encode(objs)
+}
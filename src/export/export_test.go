@@ -0,0 +1,234 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testApps() []map[string]interface{} {
+	return []map[string]interface{}{
+		{
+			"personId":        "1",
+			"firstName":       "Ada",
+			"lastName":        "Lovelace",
+			"country":         "UK",
+			"areas":           []interface{}{"PL", "Theory"},
+			"highlight":       []string{"arjun"},
+			"score_rating":    map[string]float64{"arjun": 9, "emery": 7},
+			"avgscore_rating": 8.0,
+			"lettersStatus":   "complete",
+		},
+		{
+			"personId":        "2",
+			"firstName":       "Alan",
+			"lastName":        "Turing",
+			"country":         "UK",
+			"areas":           []interface{}{"Theory"},
+			"highlight":       []string{},
+			"score_rating":    map[string]float64{"emery": 4},
+			"avgscore_rating": 4.0,
+			"lettersStatus":   "incomplete",
+		},
+		{
+			"personId":      "3",
+			"firstName":     "Grace",
+			"lastName":      "Hopper",
+			"country":       "USA",
+			"highlight":     []string{},
+			"lettersStatus": "incomplete",
+		},
+	}
+}
+
+var testReviewers = map[string]string{"arjun": "Arjun", "emery": "Emery"}
+
+// colIndex returns the position of label in clientCols, as the client's
+// Picker would serialize it.
+func colIndex(t *testing.T, label string) string {
+	for i, col := range clientCols {
+		if col.label == label {
+			return strconv.Itoa(i)
+		}
+	}
+	t.Fatalf("no column %v", label)
+	return ""
+}
+
+func ids(t *testing.T, filter string) string {
+	fn, err := ParseFilter([]byte(filter))
+	if err != nil {
+		t.Fatalf("ParseFilter(%v) = %v", filter, err)
+	}
+	var ids []string
+	for _, app := range testApps() {
+		if fn(app) {
+			ids = append(ids, app["personId"].(string))
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestFilters(t *testing.T) {
+	country := colIndex(t, "country")
+	areas := colIndex(t, "areas")
+	avg := colIndex(t, "avgscore_rating")
+	rating := colIndex(t, "score_rating")
+	star := colIndex(t, "highlight")
+	letters := colIndex(t, "lettersStatus")
+	mats := colIndex(t, "materials")
+
+	tests := []struct{ filter, expected string }{
+		{`{"t":"And","a":[{"t":"Picker","i":"-1","a":{"t":"neg"}}]}`, "1,2,3"},
+		{`{"filter":{"t":"And","a":[{"t":"Picker","i":"` + country +
+			`","a":{"t":"Text","v":"uk"}}]}}`, "1,2"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + areas +
+			`","a":{"t":"Enum","v":"PL"}}]}`, "1"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + avg +
+			`","a":{"t":"Num","v":{"min":"5","max":""}}}]}`, "1"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + rating +
+			`","a":{"t":"Num","v":{"min":"","max":"","rev":"emery"}}}]}`, "1,2"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + star +
+			`","a":{"t":"Star","v":true}}]}`, "1"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + letters +
+			`","a":{"t":"Enum","v":"incomplete"}},` +
+			`{"t":"Picker","i":"` + country + `","a":{"t":"Text","v":"UK"}}]}`, "2"},
+		{`{"t":"Or","a":[{"t":"Picker","i":"` + areas +
+			`","a":{"t":"Enum","v":"PL"}},` +
+			`{"t":"Picker","i":"` + country + `","a":{"t":"Text","v":"USA"}},` +
+			`{"t":"Picker","i":"-1","a":{"t":"neg"}}]}`, "1,3"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + country +
+			`","a":{"t":"not","v":{"t":"Text","v":"UK"}}}]}`, "3"},
+		{`{"t":"And","a":[{"t":"Picker","i":"` + mats +
+			`","a":{"t":"Mats"}}]}`, "1,2,3"},
+	}
+	for _, test := range tests {
+		if actual := ids(t, test.filter); actual != test.expected {
+			t.Errorf("filter %v selected %v, expected %v", test.filter, actual,
+				test.expected)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, testApps(), testReviewers, &Options{
+		Format:  "csv",
+		Columns: []string{"lastName", "areas", "score_rating", "highlight"},
+	})
+	if err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	expected := [][]string{
+		{"Last Name", "Areas", "Ratings (Arjun)", "Ratings (Emery)", "Starred"},
+		{"Hopper", "", "", "", ""},
+		{"Lovelace", "PL; Theory", "9", "7", "Arjun"},
+		{"Turing", "Theory", "", "4", ""},
+	}
+	for i := range expected {
+		if strings.Join(records[i], "|") != strings.Join(expected[i], "|") {
+			t.Fatalf("row %v is %v, expected %v", i, records[i], expected[i])
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if Write(&buf, testApps(), testReviewers, &Options{Format: "pdf"}) == nil {
+		t.Fatalf("accepted an unknown format")
+	}
+	err := Write(&buf, testApps(), testReviewers,
+		&Options{Format: "csv", Columns: []string{"shoeSize"}})
+	if err == nil {
+		t.Fatalf("accepted an unknown column")
+	}
+}
+
+func TestWriteXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, testApps(), testReviewers, &Options{
+		Format:  "xlsx",
+		Columns: []string{"lastName", "avgscore_rating"},
+	})
+	if err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	var sheet []byte
+	for _, f := range archive.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			sheet, _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	for _, cell := range []string{`<c r="A3" t="inlineStr"><is><t xml:space="preserve">Lovelace`,
+		`<c r="B3"><v>8</v></c>`} {
+		if !bytes.Contains(sheet, []byte(cell)) {
+			t.Fatalf("sheet lacks %v:\n%s", cell, sheet)
+		}
+	}
+	if cellRef(27, 0) != "AB1" {
+		t.Fatalf("cellRef(27, 0) = %v", cellRef(27, 0))
+	}
+}
+
+func TestFormulas(t *testing.T) {
+	apps := testApps()
+	apps[0]["lastName"] = "=HYPERLINK(\"http://evil\")"
+	apps[0]["areas"] = []interface{}{"@SUM(A1)", "PL"}
+	apps[1]["lastName"] = "-Turing"
+	apps[1]["avgscore_rating"] = -4.0
+	opts := &Options{Format: "csv",
+		Columns: []string{"lastName", "areas", "avgscore_rating"}}
+	var buf bytes.Buffer
+	err := Write(&buf, apps, testReviewers, opts)
+	if err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	expected := [][]string{
+		{"Last Name", "Areas", "Average Rating"},
+		{"'-Turing", "Theory", "-4"},
+		{"'=HYPERLINK(\"http://evil\")", "'@SUM(A1); PL", "8"},
+		{"Hopper", "", ""},
+	}
+	for i := range expected {
+		if strings.Join(records[i], "|") != strings.Join(expected[i], "|") {
+			t.Errorf("row %v is %v, expected %v", i, records[i], expected[i])
+		}
+	}
+
+	buf.Reset()
+	opts.Format = "xlsx"
+	err = Write(&buf, apps, testReviewers, opts)
+	if err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	for _, f := range archive.File {
+		rc, _ := f.Open()
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if bytes.Contains(data, []byte("<f>")) {
+			t.Errorf("%v has a formula:\n%s", f.Name, data)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A Filter selects applications.
+type Filter func(app map[string]interface{}) bool
+
+// serFilter is a filter as serialized by www/filter.ts. Which fields are set
+// depends on T.
+type serFilter struct {
+	T string          `json:"t"`
+	A json.RawMessage `json:"a"`
+	I json.RawMessage `json:"i"`
+	V json.RawMessage `json:"v"`
+}
+
+func always(app map[string]interface{}) bool { return true }
+
+// ParseFilter reads a filter serialized by the client, as found in the URL
+// fragment of a "copy filters" link: either the serialized filter itself or
+// an object with the filter in its "filter" member.
+func ParseFilter(src []byte) (Filter, error) {
+	var wrapper struct {
+		Filter json.RawMessage `json:"filter"`
+	}
+	err := json.Unmarshal(src, &wrapper)
+	if err != nil {
+		return nil, err
+	}
+	if wrapper.Filter != nil {
+		src = wrapper.Filter
+	}
+	// Mirrors filter.deserialize(filt, -1, ser) in loadData.
+	fn, _, err := parseFilter(-1, src)
+	return fn, err
+}
+
+// parseFilter follows deserialize in www/filter.ts. col is the index of the
+// column that the most recent Picker selected. Also returns whether the filter
+// is disabled, i.e., should be ignored by an enclosing And or Or.
+func parseFilter(col int, src []byte) (Filter, bool, error) {
+	var ser serFilter
+	err := json.Unmarshal(src, &ser)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch ser.T {
+	case "And", "Or":
+		return parseJunction(col, ser.T == "And", ser.A)
+	case "Picker":
+		col, err := parsePickerIndex(ser.I)
+		if err != nil {
+			return nil, false, err
+		}
+		return parseFilter(col, ser.A)
+	case "not":
+		sub, disabled, err := parseFilter(col, ser.V)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(app map[string]interface{}) bool { return !sub(app) },
+			disabled, nil
+	case "neg", "nil":
+		return always, true, nil
+	}
+
+	if col < 0 || col >= len(clientCols) {
+		return nil, false, fmt.Errorf("filter %q on unknown column %v", ser.T, col)
+	}
+	return parseColumnFilter(clientCols[col], ser.V)
+}
+
+func parseJunction(col int, isAnd bool, src []byte) (Filter, bool, error) {
+	var subSrcs []json.RawMessage
+	err := json.Unmarshal(src, &subSrcs)
+	if err != nil {
+		return nil, false, err
+	}
+	var subs []Filter
+	for _, subSrc := range subSrcs {
+		sub, disabled, err := parseFilter(col, subSrc)
+		if err != nil {
+			return nil, false, err
+		}
+		if !disabled {
+			subs = append(subs, sub)
+		}
+	}
+	fn := func(app map[string]interface{}) bool {
+		for _, sub := range subs {
+			if sub(app) != isAnd {
+				return !isAnd
+			}
+		}
+		return isAnd
+	}
+	return fn, len(subs) == 0, nil
+}
+
+// The client serializes the index as the value of a <select>, so it is
+// usually a string.
+func parsePickerIndex(src []byte) (int, error) {
+	var n int
+	if json.Unmarshal(src, &n) == nil {
+		return n, nil
+	}
+	var s string
+	err := json.Unmarshal(src, &s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+// parseBound mimics parseFloat on the text of a min or max box: NaN (no
+// bound) unless the text starts with a number.
+func parseBound(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case string:
+		v = strings.TrimSpace(v)
+		for end := len(v); end > 0; end-- {
+			f, err := strconv.ParseFloat(v[:end], 64)
+			if err == nil {
+				return f
+			}
+		}
+	}
+	return math.NaN()
+}
+
+func inBounds(val float64, found bool, min float64, max float64) bool {
+	passesMin := math.IsNaN(min) || (found && val >= min)
+	passesMax := math.IsNaN(max) || (found && val <= max)
+	return passesMin && passesMax
+}
+
+func parseColumnFilter(col clientCol, src []byte) (Filter, bool, error) {
+	label := col.label
+	switch col.kind {
+	case textCol:
+		var search string
+		err := json.Unmarshal(src, &search)
+		if err != nil {
+			return nil, false, err
+		}
+		search = strings.ToLower(search)
+		return func(app map[string]interface{}) bool {
+			if search == "" {
+				return true
+			}
+			val, ok := app[label].(string)
+			return ok && strings.Contains(strings.ToLower(val), search)
+		}, false, nil
+	case enumCol:
+		var sel string
+		err := json.Unmarshal(src, &sel)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(app map[string]interface{}) bool {
+			return app[label] == sel
+		}, false, nil
+	case setCol:
+		var sel string
+		err := json.Unmarshal(src, &sel)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(app map[string]interface{}) bool {
+			for _, elt := range stringsOf(app[label]) {
+				if elt == sel {
+					return true
+				}
+			}
+			return false
+		}, false, nil
+	case numCol, scoreCol:
+		var bounds struct {
+			Min interface{} `json:"min"`
+			Max interface{} `json:"max"`
+			Rev string      `json:"rev"`
+		}
+		err := json.Unmarshal(src, &bounds)
+		if err != nil {
+			return nil, false, err
+		}
+		min, max := parseBound(bounds.Min), parseBound(bounds.Max)
+		if col.kind == numCol {
+			return func(app map[string]interface{}) bool {
+				val, found := numberOf(app[label])
+				return inBounds(val, found, min, max)
+			}, false, nil
+		}
+		return func(app map[string]interface{}) bool {
+			score, found := scoreOf(app[label], bounds.Rev)
+			return found && inBounds(score, found, min, max)
+		}, false, nil
+	case starCol:
+		var starred bool
+		err := json.Unmarshal(src, &starred)
+		if err != nil {
+			return nil, false, err
+		}
+		return func(app map[string]interface{}) bool {
+			return (len(stringsOf(app[label])) > 0) == starred
+		}, false, nil
+	}
+	// The client cannot filter on materials.
+	return always, true, nil
+}
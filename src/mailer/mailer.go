@@ -0,0 +1,262 @@
+// Package mailer sends plain-text email through a pluggable transport: an
+// SMTP server, or, for testing, a maildir or a file on the local disk.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// Parse returns the transport described by spec, which is one of
+//
+//	smtp://[USER:PASSWORD@]HOST:PORT
+//	maildir:DIRECTORY
+//	file:FILENAME
+//
+// A maildir transport delivers each message to DIRECTORY/new. A file
+// transport appends each message to FILENAME in mbox format.
+func Parse(spec string) (Transport, error) {
+	switch {
+	case strings.HasPrefix(spec, "smtp://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(u.Host, ":") {
+			return nil, fmt.Errorf("%v: missing port", spec)
+		}
+		t := &SMTP{Addr: u.Host}
+		if u.User != nil {
+			t.Username = u.User.Username()
+			t.Password, _ = u.User.Password()
+		}
+		return t, nil
+	case strings.HasPrefix(spec, "maildir:"):
+		return &Maildir{Dir: strings.TrimPrefix(spec, "maildir:")}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &File{Name: strings.TrimPrefix(spec, "file:")}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %q", spec)
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeHeader encodes a header value that is not plain ASCII (RFC 2047).
+func encodeHeader(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	return "=?utf-8?b?" + base64.StdEncoding.EncodeToString([]byte(s)) + "?="
+}
+
+// Bytes formats the message for delivery, with CRLF line endings.
+func (self *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	id := make([]byte, 12)
+	rand.Read(id)
+	host := "localhost"
+	if at := strings.LastIndex(self.From, "@"); at >= 0 {
+		host = strings.Trim(self.From[at+1:], ">")
+	}
+	headers := [][2]string{
+		{"From", self.From},
+		{"To", self.To},
+		{"Subject", encodeHeader(self.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + host + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	body := strings.Replace(self.Body, "\r\n", "\n", -1)
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+func (self *Message) check() error {
+	if self.From == "" || self.To == "" {
+		return errors.New("message needs a sender and a recipient")
+	}
+	if strings.ContainsAny(self.From+self.To+self.Subject, "\r\n") {
+		return errors.New("header contains a line break")
+	}
+	return nil
+}
+
+// SMTPTimeout bounds each SMTP conversation, so that a server that does not
+// answer cannot hold up the sender.
+const SMTPTimeout = 30 * time.Second
+
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// Send sends the message as smtp.SendMail does, but gives up after
+// SMTPTimeout.
+func (self *SMTP) Send(msg *Message) error {
+	err := msg.check()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", self.Addr, SMTPTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTPTimeout))
+	host := self.Addr[:strings.LastIndex(self.Addr, ":")]
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if self.Username != "" {
+		auth := smtp.PlainAuth("", self.Username, self.Password, host)
+		err = c.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(msg.From)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(msg.To)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg.Bytes())
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+type Maildir struct {
+	Dir string
+}
+
+// Send writes the message to tmp/ and then moves it to new/, as maildir
+// readers expect.
+func (self *Maildir) Send(msg *Message) error {
+	err := msg.check()
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err = os.MkdirAll(filepath.Join(self.Dir, sub), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	unique := make([]byte, 8)
+	rand.Read(unique)
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%x.%s", time.Now().Unix(), unique,
+		strings.Replace(host, "/", "_", -1))
+	tmp := filepath.Join(self.Dir, "tmp", name)
+	err = writeFile(tmp, bytes.Replace(msg.Bytes(), []byte("\r\n"),
+		[]byte("\n"), -1))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(self.Dir, "new", name))
+}
+
+func writeFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type File struct {
+	Name string
+}
+
+// Send appends the message to the file in mbox format.
+func (self *File) Send(msg *Message) error {
+	err := msg.check()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(self.Name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", msg.From,
+		time.Now().Format("Mon Jan _2 15:04:05 2006"))
+	lines := strings.Split(string(bytes.Replace(msg.Bytes(), []byte("\r\n"),
+		[]byte("\n"), -1)), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,181 @@
+// Package markdown renders the Markdown that reviewers write in comments to
+// HTML that is safe to insert into the client.
+//
+// It supports a subset of Markdown: paragraphs, headings, block quotes,
+// bulleted and numbered lists, code blocks fenced with ```, and inline
+// emphasis, strong emphasis, code and links. HTML in the source is shown as
+// text. Render sanitizes its output with Sanitize, so a bug in the renderer
+// cannot produce HTML outside the allowlist.
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Render converts Markdown source to sanitized HTML.
+func Render(src string) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	var out bytes.Buffer
+	renderBlocks(&out, strings.Split(src, "\n"))
+	return Sanitize(out.String())
+}
+
+var headingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+var bulletPattern = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+var numberPattern = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+var quotePattern = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+var fencePattern = regexp.MustCompile("^\\s{0,3}```")
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// startsBlock reports whether line begins a block other than a paragraph.
+func startsBlock(line string) bool {
+	return headingPattern.MatchString(line) || bulletPattern.MatchString(line) ||
+		numberPattern.MatchString(line) || quotePattern.MatchString(line) ||
+		fencePattern.MatchString(line)
+}
+
+func renderBlocks(out *bytes.Buffer, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case fencePattern.MatchString(line):
+			i++
+			var code []string
+			for i < len(lines) && !fencePattern.MatchString(lines[i]) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // the closing fence, if any
+			out.WriteString("<pre><code>")
+			out.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			out.WriteString("</code></pre>\n")
+		case headingPattern.MatchString(line):
+			m := headingPattern.FindStringSubmatch(line)
+			// Comments are small; headings start at h3.
+			level := strconv.Itoa(min(len(m[1])+2, 6))
+			out.WriteString("<h" + level + ">")
+			out.WriteString(renderInline(m[2]))
+			out.WriteString("</h" + level + ">\n")
+			i++
+		case quotePattern.MatchString(line):
+			var quoted []string
+			for i < len(lines) && quotePattern.MatchString(lines[i]) {
+				quoted = append(quoted, quotePattern.FindStringSubmatch(lines[i])[1])
+				i++
+			}
+			out.WriteString("<blockquote>\n")
+			renderBlocks(out, quoted)
+			out.WriteString("</blockquote>\n")
+		case bulletPattern.MatchString(line):
+			i = renderList(out, lines, i, "ul", bulletPattern)
+		case numberPattern.MatchString(line):
+			i = renderList(out, lines, i, "ol", numberPattern)
+		default:
+			var para []string
+			for i < len(lines) && !isBlank(lines[i]) &&
+				(len(para) == 0 || !startsBlock(lines[i])) {
+				para = append(para, strings.TrimSpace(lines[i]))
+				i++
+			}
+			out.WriteString("<p>")
+			out.WriteString(strings.Join(renderLines(para), "<br>\n"))
+			out.WriteString("</p>\n")
+		}
+	}
+}
+
+func renderLines(lines []string) []string {
+	rendered := make([]string, len(lines))
+	for i, line := range lines {
+		rendered[i] = renderInline(line)
+	}
+	return rendered
+}
+
+// renderList renders the list items that begin at lines[i] and returns the
+// index of the line after the list. Indented lines continue an item.
+func renderList(out *bytes.Buffer, lines []string, i int, tag string,
+	item *regexp.Regexp) int {
+	out.WriteString("<" + tag + ">\n")
+	for i < len(lines) && item.MatchString(lines[i]) {
+		text := []string{item.FindStringSubmatch(lines[i])[1]}
+		i++
+		for i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]) &&
+			(lines[i][0] == ' ' || lines[i][0] == '\t') {
+			text = append(text, strings.TrimSpace(lines[i]))
+			i++
+		}
+		out.WriteString("<li>")
+		out.WriteString(strings.Join(renderLines(text), "<br>\n"))
+		out.WriteString("</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+var codeSpanPattern = regexp.MustCompile("`([^`]+)`")
+var linkPattern = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+var autolinkPattern = regexp.MustCompile(`\bhttps?://[^\s<>"]+[^\s<>".,;:!?)\]]`)
+var strongPattern = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+var emPattern = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+
+// renderInline renders the inline markup in text, escaping everything else.
+// Code spans and links are replaced by placeholders first, so that emphasis
+// does not apply inside them.
+func renderInline(text string) string {
+	var held []string
+	hold := func(rendered string) string {
+		held = append(held, rendered)
+		return placeholder(len(held) - 1)
+	}
+	text = strings.Replace(text, "\x00", "", -1)
+	text = codeSpanPattern.ReplaceAllStringFunc(text, func(m string) string {
+		code := codeSpanPattern.FindStringSubmatch(m)[1]
+		return hold("<code>" + html.EscapeString(code) + "</code>")
+	})
+	text = linkPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := linkPattern.FindStringSubmatch(m)
+		if !safeURL(parts[2]) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(parts[2]) + `">` +
+			renderEmphasis(html.EscapeString(parts[1])) + "</a>")
+	})
+	text = autolinkPattern.ReplaceAllStringFunc(text, func(m string) string {
+		return hold(`<a href="` + html.EscapeString(m) + `">` +
+			html.EscapeString(m) + "</a>")
+	})
+	text = renderEmphasis(html.EscapeString(text))
+	// Held code spans may be inside held links, so restore the links first.
+	for i := len(held) - 1; i >= 0; i-- {
+		text = strings.Replace(text, placeholder(i), held[i], 1)
+	}
+	return text
+}
+
+// Placeholders survive escaping and emphasis, since the source cannot
+// contain NUL.
+func placeholder(i int) string {
+	return "\x00" + strconv.Itoa(i) + "\x00"
+}
+
+func renderEmphasis(text string) string {
+	text = strongPattern.ReplaceAllString(text, "<strong>$1$2</strong>")
+	return emPattern.ReplaceAllString(text, "<em>$1$2</em>")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"Strong *yes*, **really**", "<p>Strong <em>yes</em>, <strong>really</strong></p>"},
+		{"line one\nline two\n\nnext", "<p>line one<br>\nline two</p>\n<p>next</p>"},
+		{"# Summary", "<h3>Summary</h3>"},
+		{"- a\n- b *c*\n  more", "<ul>\n<li>a</li>\n<li>b <em>c</em><br>\nmore</li>\n</ul>"},
+		{"1. first\n2. second", "<ol>\n<li>first</li>\n<li>second</li>\n</ol>"},
+		{"> quoted\n> text", "<blockquote>\n<p>quoted<br>\ntext</p>\n</blockquote>"},
+		{"```\n<b>*not* markdown</b>\n```", "<pre><code>&lt;b&gt;*not* markdown&lt;/b&gt;</code></pre>"},
+		{"use `a*b*c`", "<p>use <code>a*b*c</code></p>"},
+		{"[the `site`](https://cs.umass.edu)", `<p><a href="https://cs.umass.edu" rel="nofollow noopener noreferrer">the <code>site</code></a></p>`},
+		{"see http://example.com/x.", `<p>see <a href="http://example.com/x" rel="nofollow noopener noreferrer">http://example.com/x</a>.</p>`},
+		{"snake_case_name", "<p>snake_case_name</p>"},
+	}
+	for _, test := range tests {
+		got := strings.TrimSpace(Render(test.src))
+		if got != test.expected {
+			t.Errorf("Render(%q) =\n%q, expected\n%q", test.src, got, test.expected)
+		}
+	}
+}
+
+func TestRenderEscapes(t *testing.T) {
+	for _, src := range []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[click](javascript:alert(1))`,
+		`[click](JaVaScRiPt:alert(1))`,
+		"`</code><script>`",
+		"[a](http://x\"onmouseover=\"alert(1))",
+		"\x00<script>",
+	} {
+		got := Render(src)
+		// Unsafe links are shown as text.
+		for _, bad := range []string{"<script", "<img", "href=\"javascript:",
+			"href=\"JaVaScRiPt:", "\"onmouseover"} {
+			if strings.Contains(got, bad) {
+				t.Errorf("Render(%q) = %q contains %q", src, got, bad)
+			}
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{`<p onclick="x()">hi <b>there</b></p>`, "<p>hi there</p>"},
+		{`<a href="javascript:x()" title='t'>link</a>`, `<a title="t" rel="nofollow noopener noreferrer">link</a>`},
+		{`<a href="mailto:a@b.edu">mail</a>`, `<a href="mailto:a@b.edu" rel="nofollow noopener noreferrer">mail</a>`},
+		{"<ul><li>open", "<ul><li>open</li></ul>"},
+		{"<em><strong>x</em>", "<em><strong>x</strong></em>"},
+		{"</p>stray & 1 < 2", "stray &amp; 1 &lt; 2"},
+		{"<scr<script>ipt>", "&lt;script&gt;"},
+	}
+	for _, test := range tests {
+		if got := Sanitize(test.src); got != test.expected {
+			t.Errorf("Sanitize(%q) = %q, expected %q", test.src, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The elements Sanitize keeps, and the attributes it keeps on each.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title"},
+	"blockquote": nil,
+	"br":         nil,
+	"code":       nil,
+	"em":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"li":         nil,
+	"ol":         nil,
+	"p":          nil,
+	"pre":        nil,
+	"strong":     nil,
+	"ul":         nil,
+}
+
+var voidTags = map[string]bool{"br": true}
+
+var tagPattern = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z-]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+))?)*)\s*/?>`)
+var attrPattern = regexp.MustCompile(`([a-zA-Z-]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+
+// safeURL reports whether a link may point to u: only http, https and mailto
+// links, and relative links, are allowed.
+func safeURL(u string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	case "":
+		return !strings.Contains(u, ":")
+	}
+	return false
+}
+
+// Sanitize returns html with only the allowed elements and attributes. Other
+// tags are dropped, keeping their text; all text is escaped. Elements left
+// open are closed, and links get rel="nofollow noopener noreferrer".
+func Sanitize(src string) string {
+	var out bytes.Buffer
+	var open []string
+	text := func(s string) {
+		out.WriteString(html.EscapeString(html.UnescapeString(s)))
+	}
+	for {
+		loc := tagPattern.FindStringSubmatchIndex(src)
+		if loc == nil {
+			text(src)
+			break
+		}
+		text(src[:loc[0]])
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(src[loc[4]:loc[5]])
+		attrs := src[loc[6]:loc[7]]
+		src = src[loc[1]:]
+		allowed, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+		if closing {
+			// Close the element and any left open inside it.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+			continue
+		}
+		out.WriteString("<" + name)
+		for _, m := range attrPattern.FindAllStringSubmatch(attrs, -1) {
+			attr := strings.ToLower(m[1])
+			value := html.UnescapeString(m[2] + m[3] + m[4])
+			if !contains(allowed, attr) || (attr == "href" && !safeURL(value)) {
+				continue
+			}
+			out.WriteString(" " + attr + `="` + html.EscapeString(value) + `"`)
+		}
+		if name == "a" {
+			out.WriteString(` rel="nofollow noopener noreferrer"`)
+		}
+		out.WriteString(">")
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+func contains(strs []string, s string) bool {
+	for _, t := range strs {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
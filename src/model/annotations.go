@@ -0,0 +1,165 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A Region is a rectangle on a page of a PDF. Coordinates are fractions of
+// the page's width and height, measured from its top left corner, so that
+// they do not depend on how large the page is shown.
+type Region struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func (self *Region) valid() bool {
+	return self.X >= 0 && self.Y >= 0 && self.Width > 0 && self.Height > 0 &&
+		self.X+self.Width <= 1 && self.Y+self.Height <= 1
+}
+
+// An Annotation is a note that a reviewer attaches to a region of a page of
+// one of an applicant's materials. Material is the name of the upload, as in
+// the application's materials and recs; pages count from 1.
+type Annotation struct {
+	Id           string     `json:"_id,omitempty"`
+	AppId        string     `json:"appId"`
+	Material     string     `json:"material"`
+	Page         int        `json:"page"`
+	Region       Region     `json:"region"`
+	Text         string     `json:"text"`
+	RevId        ReviewerId `json:"revId"`
+	ReviewerName string     `json:"reviewerName"`
+	Timestamp    float64    `json:"timestamp"`
+}
+
+// hasMaterial reports whether the upload called name is one of the
+// application's materials or recommendations.
+func hasMaterial(app map[string]interface{}, name string) bool {
+	for _, field := range []string{"materials", "recs"} {
+		mats, _ := app[field].([]interface{})
+		for _, mat := range mats {
+			m, ok := mat.(map[string]interface{})
+			if ok && m["url"] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewAnnotation stores the annotation and sets its Id and Timestamp.
+func (self *Dept) NewAnnotation(a *Annotation) error {
+	if a.Text == "" {
+		return errors.New("empty annotation")
+	}
+	if len(a.Text) > MaxCommentLength {
+		return ErrCommentTooLong
+	}
+	if a.Page < 1 {
+		return fmt.Errorf("invalid page %v", a.Page)
+	}
+	if !a.Region.valid() {
+		return fmt.Errorf("invalid region %+v", a.Region)
+	}
+	var app map[string]interface{}
+	_, err := self.appDB.Retrieve(a.AppId, &app)
+	if err != nil {
+		return fmt.Errorf("no application %v", a.AppId)
+	}
+	if !hasMaterial(app, a.Material) {
+		return fmt.Errorf("application %v has no material %v", a.AppId,
+			a.Material)
+	}
+	a.Id = ""
+	a.Timestamp = nowTimestamp()
+	id, _, err := self.annotationsDB.Insert(a)
+	if err != nil {
+		return err
+	}
+	a.Id = id
+	return nil
+}
+
+// DeleteAnnotation deletes the annotation id, which revId must have written.
+func (self *Dept) DeleteAnnotation(id string, revId ReviewerId) error {
+	var a Annotation
+	rev, err := self.annotationsDB.Retrieve(id, &a)
+	if err != nil {
+		return fmt.Errorf("no annotation %v", id)
+	}
+	if a.RevId != revId {
+		return ErrNotAuthor
+	}
+	return self.annotationsDB.Delete(id, rev)
+}
+
+type annotationsByPage []Annotation
+
+func (self annotationsByPage) Len() int { return len(self) }
+func (self annotationsByPage) Less(i, j int) bool {
+	if self[i].Page != self[j].Page {
+		return self[i].Page < self[j].Page
+	}
+	return self[i].Timestamp < self[j].Timestamp
+}
+func (self annotationsByPage) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// Annotations returns the annotations of one of the applicant's materials, or
+// of all of them if material is empty, in page order.
+func (self *Dept) Annotations(appId string,
+	material string) ([]Annotation, error) {
+	params := map[string]interface{}{"reduce": false, "include_docs": true}
+	if material == "" {
+		params["startkey"] = []interface{}{appId}
+		params["endkey"] = []interface{}{appId, map[string]interface{}{}}
+	} else {
+		params["key"] = []interface{}{appId, material}
+	}
+	var r struct {
+		Rows []struct {
+			Doc Annotation `json:"doc"`
+		} `json:"rows"`
+	}
+	err := self.annotationsDB.Query("_design/myviews/_view/byMaterial", params,
+		&r)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make([]Annotation, len(r.Rows))
+	for i, row := range r.Rows {
+		annotations[i] = row.Doc
+	}
+	sort.Sort(annotationsByPage(annotations))
+	return annotations, nil
+}
+
+// addAnnotationCounts sets "annotations" on every application to the number
+// of annotations on each of its materials, by upload name.
+func (self *Dept) addAnnotationCounts(
+	appMap map[string]map[string]interface{}) error {
+	var r struct {
+		Rows []struct {
+			Key   []string `json:"key"`
+			Value int      `json:"value"`
+		} `json:"rows"`
+	}
+	err := self.annotationsDB.Query("_design/myviews/_view/byMaterial",
+		map[string]interface{}{"group": true}, &r)
+	if err != nil {
+		return err
+	}
+	for _, app := range appMap {
+		app["annotations"] = make(map[string]int)
+	}
+	for _, row := range r.Rows {
+		if len(row.Key) != 2 || appMap[row.Key[0]] == nil {
+			continue
+		}
+		appMap[row.Key[0]]["annotations"].(map[string]int)[row.Key[1]] = row.Value
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRegionValid(t *testing.T) {
+	good := []Region{{0, 0, 1, 1}, {0.25, 0.5, 0.5, 0.5}}
+	for _, r := range good {
+		if !r.valid() {
+			t.Errorf("rejected %+v", r)
+		}
+	}
+	bad := []Region{{-0.1, 0, 0.5, 0.5}, {0, 0, 0, 0.5}, {0.6, 0, 0.5, 0.5},
+		{0, 0.9, 0.5, 0.2}}
+	for _, r := range bad {
+		if r.valid() {
+			t.Errorf("accepted %+v", r)
+		}
+	}
+}
+
+func TestHasMaterial(t *testing.T) {
+	var app map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+	  "materials": [ { "text": "Resume", "url": "1-resume.pdf" } ],
+	  "recs": [ { "text": "Letter", "url": "1-letter.pdf" } ] }`), &app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1-resume.pdf", "1-letter.pdf"} {
+		if !hasMaterial(app, name) {
+			t.Errorf("hasMaterial(%q) = false", name)
+		}
+	}
+	if hasMaterial(app, "2-resume.pdf") {
+		t.Errorf("hasMaterial of another applicant's material")
+	}
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An Assignment asks a reviewer to review an application. Chairs assign and
+// unassign reviewers; the reviewer is notified of either.
+type Assignment struct {
+	AppId        string     `json:"appId"`
+	RevId        ReviewerId `json:"revId"`
+	AssignerId   ReviewerId `json:"assignerId"`
+	AssignerName string     `json:"assignerName"`
+	Timestamp    float64    `json:"timestamp"`
+}
+
+// Reviewer ids never contain a colon, so the id of an assignment names it
+// unambiguously.
+func assignmentId(appId string, revId ReviewerId) string {
+	return appId + ":" + string(revId)
+}
+
+// SetAssignment assigns the reviewer to the application, and reports whether
+// they were not assigned already. It sets the Timestamp.
+func (self *Dept) SetAssignment(a *Assignment) (bool, error) {
+	if strings.Contains(string(a.RevId), ":") {
+		return false, fmt.Errorf("invalid reviewer id %q", a.RevId)
+	}
+	rev, err := self.GetReviewerById(a.RevId)
+	if err != nil || rev.Disabled {
+		return false, fmt.Errorf("no reviewer %v", a.RevId)
+	}
+	var app map[string]interface{}
+	_, err = self.appDB.Retrieve(a.AppId, &app)
+	if err != nil {
+		return false, fmt.Errorf("no application %v", a.AppId)
+	}
+	id := assignmentId(a.AppId, a.RevId)
+	var old Assignment
+	if _, err := self.assignmentsDB.Retrieve(id, &old); err == nil {
+		return false, nil
+	}
+	a.Timestamp = nowTimestamp()
+	_, _, err = self.assignmentsDB.InsertWith(a, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DelAssignment unassigns the reviewer from the application, and returns the
+// assignment, or nil if they were not assigned.
+func (self *Dept) DelAssignment(appId string,
+	revId ReviewerId) (*Assignment, error) {
+	var a Assignment
+	rev, err := self.assignmentsDB.Retrieve(assignmentId(appId, revId), &a)
+	if err != nil {
+		return nil, nil
+	}
+	err = self.assignmentsDB.Delete(assignmentId(appId, revId), rev)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AssignmentsByApp returns the ids of the reviewers assigned to the
+// application, in order.
+func (self *Dept) AssignmentsByApp(appId string) ([]string, error) {
+	var r struct {
+		Rows []struct {
+			Value string `json:"value"`
+		} `json:"rows"`
+	}
+	err := self.assignmentsDB.Query("_design/myviews/_view/byApp",
+		map[string]interface{}{"key": appId}, &r)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(r.Rows))
+	for i, row := range r.Rows {
+		ids[i] = row.Value
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
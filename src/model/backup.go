@@ -0,0 +1,377 @@
+package model
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+import db "code.google.com/p/couch-go"
+
+// A backup is a gzipped tar archive. It holds one db/SUFFIX.ndjson entry per
+// database, with one document per line, and one uploads/NAME entry per
+// uploaded file. The last entry, manifest.json, records the size and SHA-256
+// of every other entry.
+
+const backupFormat = "apply2-backup"
+const backupVersion = 1
+const backupManifest = "manifest.json"
+
+type BackupEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type BackupManifest struct {
+	Format  string        `json:"format"`
+	Version int           `json:"version"`
+	Created float64       `json:"created"`
+	Entries []BackupEntry `json:"entries"`
+}
+
+type namedDB struct {
+	suffix string
+	db     *db.Database
+}
+
+// docDatabases are the databases whose documents are backed up. Design
+// documents are not: NewDept creates them.
+func (self *Dept) docDatabases() []namedDB {
+	return []namedDB{
+		{applicationsSuffix, self.appDB},
+		{reviewersSuffix, self.reviewerDB},
+		{commentsSuffix, self.commentsDB},
+		{highlightsSuffix, self.highlightsDB},
+		{scoresSuffix, self.scoresDB},
+		{fromApplicantsSuffix, self.fromApplicantsDB},
+		{lettersSuffix, self.lettersDB},
+		{settingsSuffix, self.settingsDB},
+		{matchesSuffix, self.matchesDB},
+		{notificationsSuffix, self.notificationsDB},
+		{evaluationsSuffix, self.evaluationsDB},
+		{annotationsSuffix, self.annotationsDB},
+		{assignmentsSuffix, self.assignmentsDB},
+	}
+}
+
+// allDocs returns every document in d other than design documents.
+func allDocs(d *db.Database) ([]map[string]interface{}, error) {
+	var r struct {
+		Rows []struct {
+			Id  string                 `json:"id"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	err := d.Query("_all_docs", includeDocs, &r)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]map[string]interface{}, 0, len(r.Rows))
+	for _, row := range r.Rows {
+		if !strings.HasPrefix(row.Id, "_design/") {
+			docs = append(docs, row.Doc)
+		}
+	}
+	return docs, nil
+}
+
+type backupWriter struct {
+	tw       *tar.Writer
+	manifest BackupManifest
+}
+
+func (self *backupWriter) add(name string, size int64, r io.Reader) error {
+	err := self.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(self.tw, hash), r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%v: expected %v bytes, read %v", name, size, n)
+	}
+	self.manifest.Entries = append(self.manifest.Entries,
+		BackupEntry{name, size, hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
+
+// Backup writes every document and upload in the department to w.
+func (self *Dept) Backup(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	out := &backupWriter{tw: tar.NewWriter(gz)}
+	out.manifest = BackupManifest{
+		Format:  backupFormat,
+		Version: backupVersion,
+		Created: float64(time.Now().Unix()),
+	}
+
+	for _, d := range self.docDatabases() {
+		docs, err := allDocs(d.db)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, doc := range docs {
+			delete(doc, "_rev")
+			err = enc.Encode(doc)
+			if err != nil {
+				return err
+			}
+		}
+		err = out.add("db/"+d.suffix+".ndjson", int64(buf.Len()), &buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	uploads, err := self.blobs.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range uploads {
+		err = self.backupUpload(out, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(out.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = out.tw.WriteHeader(&tar.Header{
+		Name:    backupManifest,
+		Mode:    0600,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = out.tw.Write(manifest)
+	if err != nil {
+		return err
+	}
+	err = out.tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (self *Dept) backupUpload(out *backupWriter, name string) error {
+	upload, err := self.OpenUpload(name)
+	if err != nil {
+		return fmt.Errorf("downloading %v: %v", name, err)
+	}
+	defer upload.Close()
+	return out.add("uploads/"+name, upload.Size, upload)
+}
+
+// VerifyBackup reads a backup in full and checks every entry against the
+// manifest.
+func VerifyBackup(r io.Reader) (*BackupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	sums := make(map[string]BackupEntry)
+	var manifest *BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("unexpected entry %v after the manifest",
+				hdr.Name)
+		}
+		if hdr.Name == backupManifest {
+			manifest = &BackupManifest{}
+			err = json.NewDecoder(tr).Decode(manifest)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		hash := sha256.New()
+		n, err := io.Copy(hash, tr)
+		if err != nil {
+			return nil, err
+		}
+		sums[hdr.Name] = BackupEntry{hdr.Name, n,
+			hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, errors.New("backup has no manifest")
+	}
+	if manifest.Format != backupFormat {
+		return nil, fmt.Errorf("not a backup (format %q)", manifest.Format)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("backup version %v is not supported (expected %v)",
+			manifest.Version, backupVersion)
+	}
+	if len(manifest.Entries) != len(sums) {
+		return nil, fmt.Errorf("manifest lists %v entries, backup has %v",
+			len(manifest.Entries), len(sums))
+	}
+	for _, entry := range manifest.Entries {
+		if sums[entry.Name] != entry {
+			return nil, fmt.Errorf("%v is corrupt", entry.Name)
+		}
+	}
+	return manifest, nil
+}
+
+// IsEmpty reports whether the department holds no documents or uploads,
+// other than the settings that Restore keeps; see deptSetting.
+func (self *Dept) IsEmpty() (bool, error) {
+	uploads, err := self.blobs.Names()
+	if err != nil || len(uploads) > 0 {
+		return false, err
+	}
+	for _, d := range self.docDatabases() {
+		docs, err := allDocs(d.db)
+		if err != nil {
+			return false, err
+		}
+		for _, doc := range docs {
+			id, _ := doc["_id"].(string)
+			if d.db != self.settingsDB || !deptSetting(id) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// Restore verifies the backup in r and then loads it into the department,
+// which must have been made by NewDept and be empty. The department takes the
+// version of the backup, so it may need to be migrated afterwards, but keeps
+// its own blob store, into which the uploads are restored.
+func (self *Dept) Restore(r io.ReadSeeker) error {
+	_, err := VerifyBackup(r)
+	if err != nil {
+		return err
+	}
+	// NewDept records the version once it has installed the views, which
+	// migrating from the backup's version would not.
+	if self.Version() == 0 {
+		return errors.New("can only restore into a department made with " +
+			"'apply2 newdept'")
+	}
+	empty, err := self.IsEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("can only restore into an empty department")
+	}
+
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	return self.restoreEntries(tar.NewReader(gz))
+}
+
+// restoreEntries loads the documents and uploads of a verified backup.
+func (self *Dept) restoreEntries(tr *tar.Reader) error {
+	dbs := make(map[string]*db.Database)
+	for _, d := range self.docDatabases() {
+		dbs["db/"+d.suffix+".ndjson"] = d.db
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(hdr.Name, "uploads/") {
+			name := strings.TrimPrefix(hdr.Name, "uploads/")
+			// Validation may have changed since the upload was stored; run
+			// 'apply2 validate' to check again.
+			err = self.store(name, tr, hdr.Size, false)
+		} else if d, found := dbs[hdr.Name]; found {
+			err = restoreDocs(d, tr, d == self.settingsDB)
+		} else if hdr.Name != backupManifest {
+			err = fmt.Errorf("unexpected entry %v", hdr.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring %v: %v", hdr.Name, err)
+		}
+	}
+}
+
+// deptSetting reports whether the setting id belongs to the department
+// rather than to its contents: where it stores uploads, which SetBlobStore
+// chose, and its version, which the backup replaces.
+func deptSetting(id string) bool {
+	return id == versionSetting || id == blobStoreSetting
+}
+
+// restoreDocs inserts the documents in r into d. The settings of a backup
+// keep the department's blob store, since its uploads are restored into
+// that store, whatever store they came from.
+func restoreDocs(d *db.Database, r io.Reader, settings bool) error {
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var doc map[string]interface{}
+		err = json.Unmarshal(line, &doc)
+		if err != nil {
+			return err
+		}
+		id, _ := doc["_id"].(string)
+		if id == "" {
+			return errors.New("document without an _id")
+		}
+		if settings && id == blobStoreSetting {
+			continue
+		} else if id == versionSetting {
+			// Replaces the version NewDept recorded.
+			err = putDoc(d, id, doc)
+		} else {
+			_, _, err = d.InsertWith(doc, id)
+		}
+		if err != nil {
+			return fmt.Errorf("inserting %v: %v", id, err)
+		}
+	}
+}
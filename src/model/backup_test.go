@@ -0,0 +1,113 @@
+package model
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+import db "code.google.com/p/couch-go"
+
+// testBackup builds a backup of the given entries, then lets tamper change
+// the manifest before it is written.
+func testBackup(t *testing.T, entries map[string]string,
+	tamper func(*BackupManifest)) *bytes.Reader {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	out := &backupWriter{tw: tar.NewWriter(gz)}
+	out.manifest = BackupManifest{Format: backupFormat, Version: backupVersion}
+	for name, body := range entries {
+		err := out.add(name, int64(len(body)), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("add(%v) = %v", name, err)
+		}
+	}
+	tamper(&out.manifest)
+	manifest, _ := json.Marshal(out.manifest)
+	out.tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0600,
+		Size: int64(len(manifest))})
+	out.tw.Write(manifest)
+	out.tw.Close()
+	gz.Close()
+	return bytes.NewReader(buf.Bytes())
+}
+
+var backupEntries = map[string]string{
+	"db/applications.ndjson": `{"_id":"1","firstName":"Ada"}` + "\n",
+	"uploads/resume.pdf":     "%PDF-1.4",
+}
+
+func TestVerifyBackup(t *testing.T) {
+	manifest, err := VerifyBackup(testBackup(t, backupEntries,
+		func(*BackupManifest) {}))
+	if err != nil {
+		t.Fatalf("VerifyBackup = %v", err)
+	}
+	if len(manifest.Entries) != 2 {
+		t.Fatalf("manifest has %v entries", len(manifest.Entries))
+	}
+}
+
+func TestVerifyBackupRejects(t *testing.T) {
+	tampers := map[string]func(*BackupManifest){
+		"checksum": func(m *BackupManifest) { m.Entries[0].SHA256 = "00" },
+		"version":  func(m *BackupManifest) { m.Version = backupVersion + 1 },
+		"missing":  func(m *BackupManifest) { m.Entries = m.Entries[1:] },
+		"format":   func(m *BackupManifest) { m.Format = "tarball" },
+	}
+	for name, tamper := range tampers {
+		_, err := VerifyBackup(testBackup(t, backupEntries, tamper))
+		if err == nil {
+			t.Errorf("accepted a backup with a bad %v", name)
+		}
+	}
+}
+
+// A backup of a department that stored its uploads in CouchDB restores into
+// a department that uses a FileStore, which keeps using it. The department
+// cannot be loaded without CouchDB, so this loads its store as LoadDept
+// would, from its blob store setting, which the restore must not replace.
+func TestRestoreKeepsBlobStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	spec := "file:" + root
+	store, err := ParseBlobStore(spec, "cs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dept := &Dept{ns: "cs", settingsDB: &db.Database{}, blobs: store}
+
+	backup := testBackup(t, map[string]string{
+		"db/settings.ndjson": `{"_id":"blobStore","spec":"couchdb"}` + "\n",
+		"uploads/resume.pdf": "%PDF-1.4",
+	}, func(*BackupManifest) {})
+	gz, err := gzip.NewReader(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dept.restoreEntries(tar.NewReader(gz))
+	if err != nil {
+		t.Fatalf("restoreEntries = %v", err)
+	}
+
+	loaded, err := ParseBlobStore(spec, "cs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := loaded.Open("resume.pdf")
+	if err != nil {
+		t.Fatalf("Open(resume.pdf) after restoring = %v", err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil || string(data) != "%PDF-1.4" {
+		t.Errorf("restored upload %q, %v", data, err)
+	}
+}
@@ -0,0 +1,247 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+import db "code.google.com/p/couch-go"
+
+const blobStoreSetting = "blobStore"
+
+// A BlobStore holds the files of a department's uploads ("blobs"), e.g.,
+// transcripts and letters, each under a unique name.
+type BlobStore interface {
+	// Put stores info.Size bytes from r as the blob info.Name, whose SHA-256
+	// is info.Checksum. Returns ErrUploadExists if the name is taken.
+	Put(info *BlobInfo, r io.Reader) error
+	// Open returns ErrNoUpload if there is no blob called name.
+	Open(name string) (*Blob, error)
+	// Delete returns ErrNoUpload if there is no blob called name.
+	Delete(name string) error
+	Names() ([]string, error)
+}
+
+// BlobInfo describes a blob. Stores keep ContentType, Size and Checksum with
+// each blob.
+type BlobInfo struct {
+	Name        string `json:"-"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	// The SHA-256 of the blob in hex. Empty for uploads that were stored in
+	// CouchDB before checksums were recorded.
+	Checksum string `json:"sha256"`
+	// Nil for uploads that were stored without validation, e.g., restored
+	// from a backup.
+	Validation *Validation `json:"validation,omitempty"`
+	// Set by Open. ModTime is zero if the store does not record it.
+	ETag    string    `json:"-"`
+	ModTime time.Time `json:"-"`
+}
+
+// A Blob reads a blob. Close it when done.
+type Blob struct {
+	BlobInfo
+	readSeekCloser
+}
+
+type readSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// ParseBlobStore returns the store described by spec, which is one of
+//
+//	couchdb
+//	file:DIRECTORY
+//	s3:http[s]://HOST[:PORT]/BUCKET[/PREFIX]
+//
+// couchdb (or an empty spec) stores blobs as attachments in the uploads
+// database. file stores them in DIRECTORY, which must be absolute, by
+// checksum, so that identical uploads are stored once. Each department has
+// its own subdirectory, named like its uploads database, so departments may
+// share DIRECTORY. s3 stores them in an
+// S3-compatible service, as objects named PREFIX/NAME, with the credentials
+// in the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// and the region in AWS_REGION (by default, us-east-1).
+func ParseBlobStore(spec string, ns Namespace,
+	uploadsDB *db.Database) (BlobStore, error) {
+	switch {
+	case spec == "" || spec == "couchdb":
+		return &CouchStore{uploadsDB}, nil
+	case strings.HasPrefix(spec, "file:"):
+		dir := strings.TrimPrefix(spec, "file:")
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("%v: the directory must be absolute", spec)
+		}
+		return &FileStore{filepath.Join(dir, ns.dbName(uploadsSuffix))}, nil
+	case strings.HasPrefix(spec, "s3:"):
+		u, err := url.Parse(strings.TrimPrefix(spec, "s3:"))
+		if err != nil {
+			return nil, err
+		}
+		path := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+		if (u.Scheme != "http" && u.Scheme != "https") || path[0] == "" {
+			return nil, fmt.Errorf("%v: expected s3:http[s]://HOST/BUCKET", spec)
+		}
+		store := &S3Store{
+			Endpoint:  u.Scheme + "://" + u.Host,
+			Bucket:    path[0],
+			Region:    os.Getenv("AWS_REGION"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if len(path) == 2 {
+			store.Prefix = path[1] + "/"
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		if store.AccessKey == "" || store.SecretKey == "" {
+			return nil, fmt.Errorf("%v: set AWS_ACCESS_KEY_ID and "+
+				"AWS_SECRET_ACCESS_KEY", spec)
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown blob store %q", spec)
+}
+
+// BlobStoreSpec returns the spec of the department's blob store; see
+// ParseBlobStore.
+func (self *Dept) BlobStoreSpec() string {
+	var setting struct {
+		Spec string `json:"spec"`
+	}
+	_, err := self.getSetting(blobStoreSetting, &setting)
+	if err != nil || setting.Spec == "" {
+		return "couchdb"
+	}
+	return setting.Spec
+}
+
+// SetBlobStore sets where the department stores new uploads. Existing
+// uploads would not move, so it fails if the department has any; to move
+// them, back up the department and restore it into a new one that uses the
+// new store.
+func (self *Dept) SetBlobStore(spec string) error {
+	store, err := ParseBlobStore(spec, self.ns, self.uploadsDB)
+	if err != nil {
+		return err
+	}
+	names, err := self.blobs.Names()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("the department has %v uploads in its current store",
+			len(names))
+	}
+	err = self.putSetting(blobStoreSetting, map[string]interface{}{"spec": spec})
+	if err != nil {
+		return err
+	}
+	self.blobs = store
+	return nil
+}
+
+// UploadFile stores the file at path as the upload called name.
+func (self *Dept) UploadFile(name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return self.Upload(name, file, info.Size())
+}
+
+// Upload stores the bytes in r as the upload called name. size is the number
+// expected, or negative if unknown. Returns ErrUploadExists if name is
+// already taken, and an *InvalidUploadError if the upload is not a readable
+// PDF or the department's scanner finds malware in it.
+func (self *Dept) Upload(name string, r io.Reader, size int64) error {
+	return self.store(name, r, size, true)
+}
+
+// store stores an upload, validating it first if validate is set. Uploads
+// are copied to a temporary file first, to find their checksum and content
+// type before the store sees them.
+func (self *Dept) store(name string, r io.Reader, size int64,
+	validate bool) error {
+	tmp, err := ioutil.TempFile("", "apply2-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("%v: expected %v bytes, read %v", name, size, n)
+	}
+	head := make([]byte, 512)
+	k, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	info := &BlobInfo{
+		Name:        name,
+		ContentType: http.DetectContentType(head[:k]),
+		Size:        n,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+	}
+	if validate {
+		data, err := ioutil.ReadFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		info.Validation, err = self.validate(data)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		if info.Validation.Problem != "" {
+			return &InvalidUploadError{name, info.Validation}
+		}
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return self.blobs.Put(info, tmp)
+}
+
+// deleteBlobs deletes every upload, unless they are in the uploads database,
+// which Delete deletes anyway.
+func (self *Dept) deleteBlobs() error {
+	if _, inCouch := self.blobs.(*CouchStore); inCouch {
+		return nil
+	}
+	names, err := self.blobs.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = self.blobs.Delete(name)
+		if err != nil && err != ErrNoUpload {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+import db "code.google.com/p/couch-go"
+
+var blobData = []byte(strings.Repeat("%PDF-1.4 0123456789", 1000))
+
+type fakeBlob struct {
+	fields      map[string]interface{}
+	contentType string
+	data        []byte
+}
+
+// fakeServer stands in for CouchDB or S3, holding blobs in memory. It
+// ignores Range headers unless ranges is set.
+type fakeServer struct {
+	sync.Mutex
+	*httptest.Server
+	blobs  map[string]*fakeBlob
+	ranges bool
+}
+
+func newFakeServer(handler func(*fakeServer, http.ResponseWriter,
+	*http.Request)) *fakeServer {
+	s := &fakeServer{blobs: make(map[string]*fakeBlob), ranges: true}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.Lock()
+			defer s.Unlock()
+			handler(s, w, r)
+		}))
+	return s
+}
+
+func (self *fakeServer) hostPort(t *testing.T) (string, string) {
+	u, _ := url.Parse(self.URL)
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func (self *fakeServer) serve(w http.ResponseWriter, r *http.Request,
+	blob *fakeBlob) {
+	w.Header().Set("Content-Type", blob.contentType)
+	if self.ranges {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob.data))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+	if r.Method != "HEAD" {
+		w.Write(blob.data)
+	}
+}
+
+// A CouchDB database of uploads, at /x-uploads.
+func fakeCouchDB(s *fakeServer, w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/x-uploads/"), "/")
+	blob := s.blobs[path[0]]
+	switch {
+	case path[0] == "_all_docs":
+		var all struct {
+			Rows []map[string]string `json:"rows"`
+		}
+		for name := range s.blobs {
+			all.Rows = append(all.Rows, map[string]string{"id": name})
+		}
+		json.NewEncoder(w).Encode(all)
+	case len(path) == 1 && r.Method == "PUT":
+		if blob != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		blob = &fakeBlob{}
+		json.NewDecoder(r.Body).Decode(&blob.fields)
+		s.blobs[path[0]] = blob
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true,"rev":"1-a"}`))
+	case blob == nil:
+		http.NotFound(w, r)
+	case len(path) == 1 && r.Method == "DELETE":
+		delete(s.blobs, path[0])
+	case len(path) == 1:
+		w.Header().Set("ETag", `"1-a"`)
+		fields := make(map[string]interface{})
+		for k, v := range blob.fields {
+			fields[k] = v
+		}
+		if blob.data != nil {
+			fields["_attachments"] = map[string]interface{}{
+				"file": map[string]interface{}{"content_type": blob.contentType,
+					"length": len(blob.data), "digest": "md5-x"},
+			}
+		}
+		json.NewEncoder(w).Encode(fields)
+	case r.Method == "PUT":
+		blob.contentType = r.Header.Get("Content-Type")
+		blob.data, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case blob.data == nil:
+		http.NotFound(w, r)
+	default:
+		s.serve(w, r, blob)
+	}
+}
+
+// An S3 bucket at /bucket.
+func fakeS3(s *fakeServer, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/bucket" {
+		var list struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct{ Key string }
+		}
+		for name := range s.blobs {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				list.Contents = append(list.Contents, struct{ Key string }{name})
+			}
+		}
+		xml.NewEncoder(w).Encode(list)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	blob := s.blobs[key]
+	switch {
+	case r.Method == "PUT":
+		if blob != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if hexSHA256(string(data)) != r.Header.Get("x-amz-content-sha256") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.blobs[key] = &fakeBlob{contentType: r.Header.Get("Content-Type"),
+			data: data, fields: map[string]interface{}{
+				"sha256": r.Header.Get("x-amz-meta-sha256")}}
+	case blob == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "DELETE":
+		delete(s.blobs, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("x-amz-meta-sha256", blob.fields["sha256"].(string))
+		s.serve(w, r, blob)
+	}
+}
+
+func testBlobStore(t *testing.T, kind string, dept *Dept) {
+	if _, err := dept.OpenUpload("2.pdf"); err != ErrNoUpload {
+		t.Errorf("%v: OpenUpload of a missing upload: %v", kind, err)
+	}
+	err := dept.store("1.pdf", bytes.NewReader(blobData), -1, false)
+	if err != nil {
+		t.Fatalf("%v: Upload: %v", kind, err)
+	}
+	err = dept.store("1.pdf", bytes.NewReader(blobData), -1, false)
+	if err != ErrUploadExists {
+		t.Errorf("%v: Upload of an existing name: %v", kind, err)
+	}
+	err = dept.store("copy.pdf", bytes.NewReader(blobData),
+		int64(len(blobData)), false)
+	if err != nil {
+		t.Fatalf("%v: Upload of a copy: %v", kind, err)
+	}
+
+	upload, err := dept.OpenUpload("1.pdf")
+	if err != nil {
+		t.Fatalf("%v: OpenUpload: %v", kind, err)
+	}
+	if upload.Size != int64(len(blobData)) ||
+		upload.ContentType != "application/pdf" ||
+		upload.Checksum != hexSHA256(string(blobData)) ||
+		upload.ETag != `"`+upload.Checksum+`"` {
+		t.Errorf("%v: upload = %+v", kind, upload.BlobInfo)
+	}
+	data, err := ioutil.ReadAll(upload)
+	if err != nil || !bytes.Equal(data, blobData) {
+		t.Errorf("%v: read %v bytes: %v", kind, len(data), err)
+	}
+	upload.Seek(-10, io.SeekEnd)
+	buf := make([]byte, 5)
+	io.ReadFull(upload, buf)
+	upload.Seek(2, io.SeekCurrent)
+	data, err = ioutil.ReadAll(upload)
+	if string(buf) != "01234" || string(data) != "789" || err != nil {
+		t.Errorf("%v: read %q and %q after seeking: %v", kind, buf, data, err)
+	}
+	upload.Close()
+
+	names, err := dept.blobs.Names()
+	sort.Strings(names)
+	if err != nil || len(names) != 2 || names[0] != "1.pdf" {
+		t.Errorf("%v: Names() = %v, %v", kind, names, err)
+	}
+	if err = dept.blobs.Delete("1.pdf"); err != nil {
+		t.Errorf("%v: Delete: %v", kind, err)
+	}
+	if err = dept.blobs.Delete("1.pdf"); err != ErrNoUpload {
+		t.Errorf("%v: Delete of a missing upload: %v", kind, err)
+	}
+	if upload, err = dept.OpenUpload("copy.pdf"); err != nil {
+		t.Errorf("%v: deleting one name lost the other: %v", kind, err)
+	} else {
+		upload.Close()
+	}
+}
+
+func TestBlobStores(t *testing.T) {
+	for _, ranges := range []bool{true, false} {
+		couch := newFakeServer(fakeCouchDB)
+		couch.ranges = ranges
+		host, port := couch.hostPort(t)
+		uploads := &db.Database{Host: host, Port: port, Name: "x-uploads"}
+		testBlobStore(t, "couchdb", &Dept{blobs: &CouchStore{uploads}})
+		couch.Close()
+	}
+
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testBlobStore(t, "file", &Dept{blobs: &FileStore{dir}})
+
+	s3 := newFakeServer(fakeS3)
+	defer s3.Close()
+	testBlobStore(t, "s3", &Dept{blobs: &S3Store{Endpoint: s3.URL,
+		Bucket: "bucket", Prefix: "dept/", Region: "us-east-1",
+		AccessKey: "key", SecretKey: "secret"}})
+}
+
+func TestParseBlobStore(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	store, err := ParseBlobStore("s3:http://localhost:9000/bucket/a/b", "",
+		nil)
+	s3, _ := store.(*S3Store)
+	if err != nil || s3.Endpoint != "http://localhost:9000" ||
+		s3.Bucket != "bucket" || s3.Prefix != "a/b/" {
+		t.Errorf("ParseBlobStore(s3:...) = %+v, %v", store, err)
+	}
+	for _, spec := range []string{"file:relative", "s3:localhost/bucket",
+		"s3:http://localhost", "ftp://x"} {
+		if _, err := ParseBlobStore(spec, "", nil); err == nil {
+			t.Errorf("ParseBlobStore(%q) succeeded", spec)
+		}
+	}
+	// Departments that share a directory keep their uploads apart.
+	for ns, dir := range map[Namespace]string{"": "/srv/uploads",
+		"cs": "/srv/cs_uploads", "cs/2014": "/srv/cs_2014_uploads"} {
+		store, err := ParseBlobStore("file:/srv", ns, nil)
+		if file, _ := store.(*FileStore); err != nil || file.Dir != dir {
+			t.Errorf("ParseBlobStore(file:/srv) in %q = %+v, %v", ns, store, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"markdown"
+	"sort"
+	"time"
+)
+
+// A CommentEdit is an earlier version of a comment's text, written at
+// Timestamp.
+type CommentEdit struct {
+	Timestamp float64 `json:"timestamp"`
+	Text      string  `json:"text"`
+}
+
+var ErrNotAuthor = errors.New("only the author may change a comment")
+
+// The longest comment, in bytes of Markdown source.
+const MaxCommentLength = 20000
+
+var ErrCommentTooLong = fmt.Errorf("comments may be at most %v bytes long",
+	MaxCommentLength)
+
+// Comment visibility. Comments are visible to the committee, every reviewer,
+// unless their author makes them private notes or visible only to chairs.
+// Authors can always read their own comments.
+const VisibleToCommittee = ""
+const VisibleToChairs = "chairs"
+const VisibleToAuthor = "private"
+
+func validVisibility(visibility string) bool {
+	return visibility == VisibleToCommittee || visibility == VisibleToChairs ||
+		visibility == VisibleToAuthor
+}
+
+// VisibleTo reports whether the reviewer may read the comment. A nil reviewer
+// may read only comments visible to the committee.
+func (self *Comment) VisibleTo(rev *Reviewer) bool {
+	if self.Visibility == VisibleToCommittee {
+		return true
+	}
+	if rev == nil || rev.Disabled {
+		return false
+	}
+	if rev.Id == self.ReviewerId {
+		return true
+	}
+	for _, id := range self.Audience {
+		if rev.Id == id {
+			return true
+		}
+	}
+	return self.Visibility == VisibleToChairs && rev.Chair
+}
+
+// replyTo restricts a reply to a comment that not every reviewer may read to
+// the readers of that comment, including its author, who may not otherwise
+// read it, e.g., when a chair replies to another reviewer's comment to chairs.
+func (self *Comment) replyTo(parent *Comment) {
+	if parent.Visibility == VisibleToCommittee {
+		return
+	}
+	self.Visibility = parent.Visibility
+	self.Audience = nil
+	for _, id := range append(parent.Audience, parent.ReviewerId) {
+		if id != self.ReviewerId {
+			self.Audience = append(self.Audience, id)
+		}
+	}
+}
+
+func (self *Dept) getComment(id string) (*Comment, string, error) {
+	var comment Comment
+	rev, err := self.commentsDB.Retrieve(id, &comment)
+	if err != nil {
+		return nil, "", err
+	}
+	return &comment, rev, nil
+}
+
+// updateComment applies update to the comment id, which revId must have
+// written.
+func (self *Dept) updateComment(id string, revId ReviewerId,
+	update func(comment *Comment)) error {
+	comment, rev, err := self.getComment(id)
+	if err != nil || comment.Deleted {
+		return fmt.Errorf("no comment %v", id)
+	}
+	if comment.ReviewerId != revId {
+		return ErrNotAuthor
+	}
+	update(comment)
+	comment.Replies = nil
+	_, err = self.commentsDB.EditWith(comment, id, rev)
+	return err
+}
+
+// EditComment replaces the text of a comment, keeping the old text in its
+// edit history, and returns the new text rendered as HTML.
+func (self *Dept) EditComment(id string, revId ReviewerId,
+	text string) (string, error) {
+	if len(text) > MaxCommentLength {
+		return "", ErrCommentTooLong
+	}
+	rendered := markdown.Render(text)
+	err := self.updateComment(id, revId, func(comment *Comment) {
+		comment.Edits = append(comment.Edits,
+			CommentEdit{comment.editedAt(), comment.Text})
+		comment.Text = text
+		comment.HTML = rendered
+		comment.Edited = nowTimestamp()
+	})
+	return rendered, err
+}
+
+// editedAt returns when the current text of the comment was written.
+func (self *Comment) editedAt() float64 {
+	if self.Edited != 0 {
+		return self.Edited
+	}
+	return self.Timestamp
+}
+
+// DeleteComment deletes the text and history of a comment. The comment keeps
+// its place in the thread, so that its replies do too.
+func (self *Dept) DeleteComment(id string, revId ReviewerId) error {
+	return self.updateComment(id, revId, func(comment *Comment) {
+		comment.Deleted = true
+		comment.Text = ""
+		comment.HTML = ""
+		comment.Edits = nil
+	})
+}
+
+type commentsByTime []Comment
+
+func (self commentsByTime) Len() int { return len(self) }
+func (self commentsByTime) Less(i, j int) bool {
+	return self[i].Timestamp < self[j].Timestamp
+}
+func (self commentsByTime) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// commentThreads arranges comments into threads, oldest first. Replies to
+// missing comments start threads of their own. Deleted comments without
+// replies are dropped.
+func commentThreads(comments []Comment) []Comment {
+	ids := make(map[string]bool, len(comments))
+	for _, c := range comments {
+		ids[c.Id] = true
+	}
+	children := make(map[string][]Comment)
+	for _, c := range comments {
+		parent := c.ParentId
+		if !ids[parent] {
+			parent = ""
+		}
+		children[parent] = append(children[parent], c)
+	}
+	var thread func(parent string) []Comment
+	thread = func(parent string) []Comment {
+		var replies []Comment
+		for _, c := range children[parent] {
+			c.Replies = thread(c.Id)
+			if !c.Deleted || len(c.Replies) > 0 {
+				replies = append(replies, c)
+			}
+		}
+		sort.Sort(commentsByTime(replies))
+		return replies
+	}
+	return thread("")
+}
+
+// WalkComments calls fn on every comment in threads.
+func WalkComments(threads []Comment, fn func(comment *Comment)) {
+	for i := range threads {
+		fn(&threads[i])
+		WalkComments(threads[i].Replies, fn)
+	}
+}
+
+func nowTimestamp() float64 {
+	return float64(time.Now().Unix())
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommentThreads(t *testing.T) {
+	comments := []Comment{
+		{Id: "c", ParentId: "a", Timestamp: 3, Text: "reply to a"},
+		{Id: "a", Timestamp: 1, Text: "first"},
+		{Id: "b", Timestamp: 2, Deleted: true},
+		{Id: "d", ParentId: "b", Timestamp: 5, Text: "reply to deleted b"},
+		{Id: "e", ParentId: "c", Timestamp: 4, Text: "reply to c"},
+		{Id: "f", ParentId: "gone", Timestamp: 6, Text: "orphan"},
+		{Id: "g", Timestamp: 7, Deleted: true},
+	}
+	threads := commentThreads(comments)
+	var order []string
+	WalkComments(threads, func(c *Comment) {
+		order = append(order, c.Id)
+	})
+	expected := "a c e b d f"
+	if got := strings.Join(order, " "); got != expected {
+		t.Errorf("walked %v, expected %v", got, expected)
+	}
+	if len(threads) != 3 || len(threads[0].Replies) != 1 ||
+		threads[0].Replies[0].Replies[0].Id != "e" {
+		t.Errorf("wrong shape: %+v", threads)
+	}
+}
+
+func TestEditedAt(t *testing.T) {
+	c := &Comment{Timestamp: 10}
+	if c.editedAt() != 10 {
+		t.Errorf("unedited comment written at %v", c.editedAt())
+	}
+	c.Edited = 20
+	if c.editedAt() != 20 {
+		t.Errorf("edited comment written at %v", c.editedAt())
+	}
+}
+
+func TestVisibleTo(t *testing.T) {
+	author := &Reviewer{Id: "velma"}
+	other := &Reviewer{Id: "shaggy"}
+	chair := &Reviewer{Id: "fred", Chair: true}
+	tests := []struct {
+		visibility string
+		rev        *Reviewer
+		expected   bool
+	}{
+		{VisibleToCommittee, nil, true},
+		{VisibleToCommittee, other, true},
+		{VisibleToChairs, author, true},
+		{VisibleToChairs, chair, true},
+		{VisibleToChairs, other, false},
+		{VisibleToChairs, nil, false},
+		{VisibleToAuthor, author, true},
+		{VisibleToAuthor, chair, false},
+	}
+	for _, test := range tests {
+		c := &Comment{ReviewerId: "velma", Visibility: test.visibility}
+		if got := c.VisibleTo(test.rev); got != test.expected {
+			t.Errorf("%q comment visible to %+v = %v", test.visibility, test.rev,
+				got)
+		}
+	}
+}
+
+func TestReplyTo(t *testing.T) {
+	author := &Reviewer{Id: "velma"}
+	other := &Reviewer{Id: "shaggy"}
+	chair := &Reviewer{Id: "fred", Chair: true}
+	parent := &Comment{ReviewerId: "velma", Visibility: VisibleToChairs}
+	reply := &Comment{ReviewerId: "fred"}
+	reply.replyTo(parent)
+	if reply.Visibility != VisibleToChairs {
+		t.Errorf("reply to chairs is visible to %q", reply.Visibility)
+	}
+	if !reply.VisibleTo(author) || !reply.VisibleTo(chair) ||
+		reply.VisibleTo(other) {
+		t.Errorf("reply has the wrong readers: %+v", reply)
+	}
+	// The parent's author keeps reading replies to replies, and reviewers
+	// are not listed as readers of their own replies.
+	second := &Comment{ReviewerId: "velma"}
+	second.replyTo(reply)
+	if len(second.Audience) != 1 || second.Audience[0] != "fred" {
+		t.Errorf("reply to the reply is also visible to %v", second.Audience)
+	}
+	third := &Comment{ReviewerId: "fred"}
+	third.replyTo(second)
+	if !third.VisibleTo(author) || third.VisibleTo(other) {
+		t.Errorf("third reply has the wrong readers: %+v", third)
+	}
+	public := &Comment{ReviewerId: "fred"}
+	public.replyTo(&Comment{ReviewerId: "velma"})
+	if public.Visibility != VisibleToCommittee || public.Audience != nil {
+		t.Errorf("reply to the committee is restricted: %+v", public)
+	}
+}
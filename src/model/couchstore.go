@@ -0,0 +1,187 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+import db "code.google.com/p/couch-go"
+
+// A CouchStore stores each blob as the attachment "file" of a document in a
+// CouchDB database, whose fields describe the blob. It talks to CouchDB
+// directly, since couch-go cannot stream attachments.
+type CouchStore struct {
+	DB *db.Database
+}
+
+func (self *CouchStore) dbURL() string {
+	return fmt.Sprintf("http://%s:%s/%s", self.DB.Host, self.DB.Port,
+		self.DB.Name)
+}
+
+func (self *CouchStore) docURL(name string) string {
+	return self.dbURL() + "/" + url.PathEscape(name)
+}
+
+func couchRequest(method string, url string, contentType string,
+	body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (self *CouchStore) Put(info *BlobInfo, r io.Reader) error {
+	doc, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	resp, err := couchRequest("PUT", self.docURL(info.Name),
+		"application/json", bytes.NewReader(doc))
+	if err != nil {
+		return err
+	}
+	var created struct {
+		Rev string `json:"rev"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return ErrUploadExists
+	}
+	if resp.StatusCode != http.StatusCreated || err != nil {
+		return fmt.Errorf("got status %d from CouchDB creating %v",
+			resp.StatusCode, info.Name)
+	}
+
+	req, err := http.NewRequest("PUT",
+		self.docURL(info.Name)+"/file?rev="+url.QueryEscape(created.Rev), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", info.ContentType)
+	resp, err = http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			err = fmt.Errorf("got status %d from CouchDB storing %v",
+				resp.StatusCode, info.Name)
+		}
+	}
+	if err != nil {
+		// Do not leave a document without its file.
+		self.deleteRev(info.Name, created.Rev)
+		return err
+	}
+	return nil
+}
+
+func (self *CouchStore) Open(name string) (*Blob, error) {
+	resp, err := http.Get(self.docURL(name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoUpload
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d from CouchDB reading %v",
+			resp.StatusCode, name)
+	}
+	var doc struct {
+		BlobInfo
+		Attachments map[string]struct {
+			ContentType string `json:"content_type"`
+			Length      int64  `json:"length"`
+			Digest      string `json:"digest"`
+		} `json:"_attachments"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	file, found := doc.Attachments["file"]
+	if !found {
+		return nil, ErrNoUpload
+	}
+	// The attachment is authoritative; older uploads have no other fields.
+	info := doc.BlobInfo
+	info.Name = name
+	info.ContentType = file.ContentType
+	info.Size = file.Length
+	if info.Checksum != "" {
+		info.ETag = `"` + info.Checksum + `"`
+	} else {
+		info.ETag = `"` + file.Digest + `"`
+	}
+	return &Blob{info, &httpReader{
+		url:  self.docURL(name) + "/file",
+		name: name,
+		size: info.Size,
+		do:   http.DefaultClient.Do,
+	}}, nil
+}
+
+func (self *CouchStore) Delete(name string) error {
+	resp, err := http.Head(self.docURL(name))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoUpload
+	}
+	return self.deleteRev(name, strings.Trim(resp.Header.Get("ETag"), `"`))
+}
+
+func (self *CouchStore) deleteRev(name string, rev string) error {
+	resp, err := couchRequest("DELETE",
+		self.docURL(name)+"?rev="+url.QueryEscape(rev), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d from CouchDB deleting %v",
+			resp.StatusCode, name)
+	}
+	return nil
+}
+
+func (self *CouchStore) Names() ([]string, error) {
+	resp, err := http.Get(self.dbURL() + "/_all_docs")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d from CouchDB listing %v",
+			resp.StatusCode, self.DB.Name)
+	}
+	var all struct {
+		Rows []struct {
+			Id string `json:"id"`
+		} `json:"rows"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&all)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(all.Rows))
+	for _, row := range all.Rows {
+		if !strings.HasPrefix(row.Id, "_design/") {
+			names = append(names, row.Id)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// A soft-deleted department is archived: its data is kept, but it is not
+// served, until it is undeleted or its retention period ends and
+// PurgeDeleted deletes it for good.
+
+const deletedSetting = "deleted"
+
+const DefaultRetention = 30 * 24 * time.Hour
+
+type Deletion struct {
+	Deleted    float64 `json:"deleted"`
+	PurgeAfter float64 `json:"purgeAfter"`
+}
+
+// Deletion returns when the department was soft-deleted, or nil if it was
+// not.
+func (self *Dept) Deletion() *Deletion {
+	var deletion Deletion
+	_, err := self.getSetting(deletedSetting, &deletion)
+	if err != nil {
+		return nil
+	}
+	return &deletion
+}
+
+// SoftDelete archives the department for retention.
+func (self *Dept) SoftDelete(retention time.Duration) error {
+	if self.Deletion() != nil {
+		return fmt.Errorf("department %q is already deleted", self.ns)
+	}
+	now := time.Now()
+	return self.putSetting(deletedSetting, &Deletion{
+		Deleted:    float64(now.Unix()),
+		PurgeAfter: float64(now.Add(retention).Unix()),
+	})
+}
+
+// Undelete restores a soft-deleted department.
+func (self *Dept) Undelete() error {
+	if self.Deletion() == nil {
+		return fmt.Errorf("department %q is not deleted", self.ns)
+	}
+	return self.deleteSetting(deletedSetting)
+}
+
+// PurgeDeleted permanently deletes the soft-deleted departments whose
+// retention period ended before now, and returns their namespaces.
+func PurgeDeleted(host, port string, now time.Time) ([]Namespace, error) {
+	namespaces, err := ListNamespaces(host, port)
+	if err != nil {
+		return nil, err
+	}
+	var purged []Namespace
+	for _, ns := range namespaces {
+		dept, err := OpenDept(host, port, ns)
+		if err != nil {
+			return purged, err
+		}
+		deletion := dept.Deletion()
+		if deletion == nil || float64(now.Unix()) < deletion.PurgeAfter {
+			continue
+		}
+		err = dept.Delete()
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, ns)
+	}
+	return purged, nil
+}
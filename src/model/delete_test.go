@@ -0,0 +1,33 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+import db "code.google.com/p/couch-go"
+
+// Delete must delete every database that NewDept creates.
+func TestDatabasesComplete(t *testing.T) {
+	listed := map[string]bool{uploadsSuffix: true, packetsSuffix: true,
+		previewsSuffix: true}
+	for _, d := range (&Dept{}).docDatabases() {
+		listed[d.suffix] = true
+	}
+	for _, suffix := range dbSuffixes {
+		if !listed[suffix] {
+			t.Errorf("databases() omits %v", suffix)
+		}
+	}
+
+	deptType := reflect.TypeOf(Dept{})
+	fields := 0
+	for i := 0; i < deptType.NumField(); i++ {
+		if deptType.Field(i).Type == reflect.TypeOf(&db.Database{}) {
+			fields++
+		}
+	}
+	if fields != len(dbSuffixes) || len(listed) != len(dbSuffixes) {
+		t.Errorf("Dept has %v databases, databases() lists %v and NewDept "+
+			"creates %v", fields, len(listed), len(dbSuffixes))
+	}
+}
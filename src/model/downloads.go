@@ -0,0 +1,105 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+var ErrNoUpload = errors.New("no such upload")
+
+// OpenUpload returns a reader for the upload called name. Returns
+// ErrNoUpload if there is no such upload.
+func (self *Dept) OpenUpload(name string) (*Blob, error) {
+	return self.blobs.Open(name)
+}
+
+// An httpReader reads a blob over HTTP, from CouchDB or S3. It fetches only
+// the bytes it is asked for, using range requests, so that
+// http.ServeContent can serve ranges of large uploads without downloading
+// them in full.
+type httpReader struct {
+	url    string
+	name   string
+	size   int64
+	do     func(req *http.Request) (*http.Response, error)
+	offset int64
+	body   io.ReadCloser
+}
+
+func (self *httpReader) Read(p []byte) (int, error) {
+	if self.offset >= self.size {
+		return 0, io.EOF
+	}
+	if self.body == nil {
+		err := self.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := self.body.Read(p)
+	self.offset += int64(n)
+	if err == io.EOF && self.offset < self.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open requests the blob from the current offset on.
+func (self *httpReader) open() error {
+	req, err := http.NewRequest("GET", self.url, nil)
+	if err != nil {
+		return err
+	}
+	if self.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", self.offset))
+	}
+	resp, err := self.do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The store ignored the range; skip to the offset.
+		_, err = io.CopyN(ioutil.Discard, resp.Body, self.offset)
+	case http.StatusNotFound:
+		err = ErrNoUpload
+	default:
+		err = fmt.Errorf("got status %d reading %v", resp.StatusCode, self.name)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	self.body = resp.Body
+	return nil
+}
+
+func (self *httpReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += self.offset
+	case io.SeekEnd:
+		offset += self.size
+	}
+	if offset < 0 {
+		return self.offset, errors.New("seek before the start of an upload")
+	}
+	if offset != self.offset {
+		self.Close()
+		self.offset = offset
+	}
+	return offset, nil
+}
+
+func (self *httpReader) Close() error {
+	if self.body == nil {
+		return nil
+	}
+	err := self.body.Close()
+	self.body = nil
+	return err
+}
@@ -0,0 +1,320 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const evaluationFormSetting = "evaluationForm"
+
+// Kinds of question on an evaluation form.
+const QuestionChoice = "choice"
+const QuestionNumber = "number"
+const QuestionText = "text"
+
+// A FormQuestion is one question of an evaluation form. Id identifies the
+// answer in submissions; keep it when rewording the question. Choice
+// questions are answered with one of Choices; number questions with a number,
+// between Min and Max if they are set; text questions with free text.
+type FormQuestion struct {
+	Id       string   `json:"id"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+type FormSection struct {
+	Title     string         `json:"title"`
+	Questions []FormQuestion `json:"questions"`
+}
+
+// An EvaluationForm is the form that a department's reviewers fill in for
+// each applicant. SetEvaluationForm numbers each version of the form, and
+// evaluations record the version they answered.
+type EvaluationForm struct {
+	Version  int           `json:"version"`
+	Sections []FormSection `json:"sections"`
+}
+
+// An Evaluation is one reviewer's answers to the evaluation form for one
+// applicant, by question id. Earlier answers are kept in Versions, oldest
+// first.
+type Evaluation struct {
+	Id           string                 `json:"_id,omitempty"`
+	AppId        string                 `json:"appId"`
+	RevId        ReviewerId             `json:"revId"`
+	ReviewerName string                 `json:"reviewerName"`
+	FormVersion  int                    `json:"formVersion"`
+	Answers      map[string]interface{} `json:"answers"`
+	Timestamp    float64                `json:"timestamp"`
+	Versions     []EvaluationVersion    `json:"versions,omitempty"`
+}
+
+type EvaluationVersion struct {
+	FormVersion int                    `json:"formVersion"`
+	Answers     map[string]interface{} `json:"answers"`
+	Timestamp   float64                `json:"timestamp"`
+}
+
+var ErrNoEvaluationForm = errors.New("the department has no evaluation form")
+
+// questions returns the questions of the form, in order.
+func (self *EvaluationForm) questions() []FormQuestion {
+	var qs []FormQuestion
+	for _, section := range self.Sections {
+		qs = append(qs, section.Questions...)
+	}
+	return qs
+}
+
+// Check returns an error if the form itself is malformed.
+func (self *EvaluationForm) Check() error {
+	ids := make(map[string]bool)
+	for _, q := range self.questions() {
+		if q.Id == "" {
+			return fmt.Errorf("question %q has no id", q.Label)
+		}
+		if ids[q.Id] {
+			return fmt.Errorf("question id %q is used twice", q.Id)
+		}
+		ids[q.Id] = true
+		switch q.Type {
+		case QuestionChoice:
+			if len(q.Choices) < 2 {
+				return fmt.Errorf("question %q needs at least two choices", q.Id)
+			}
+			choices := make(map[string]bool)
+			for _, choice := range q.Choices {
+				if choice == "" || choices[choice] {
+					return fmt.Errorf("question %q has an empty or repeated choice",
+						q.Id)
+				}
+				choices[choice] = true
+			}
+		case QuestionNumber:
+			if q.Min != nil && q.Max != nil && *q.Min > *q.Max {
+				return fmt.Errorf("question %q has min greater than max", q.Id)
+			}
+		case QuestionText:
+		default:
+			return fmt.Errorf("question %q has unknown type %q", q.Id, q.Type)
+		}
+		if q.Type != QuestionChoice && len(q.Choices) > 0 {
+			return fmt.Errorf("question %q has choices but is a %s question",
+				q.Id, q.Type)
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("the form has no questions")
+	}
+	return nil
+}
+
+// valid reports whether answer is a valid answer to the question.
+func (self *FormQuestion) valid(answer interface{}) bool {
+	switch self.Type {
+	case QuestionChoice:
+		s, ok := answer.(string)
+		return ok && contains(self.Choices, s)
+	case QuestionNumber:
+		n, ok := answer.(float64)
+		return ok && (self.Min == nil || n >= *self.Min) &&
+			(self.Max == nil || n <= *self.Max)
+	case QuestionText:
+		s, ok := answer.(string)
+		return ok && len(s) <= MaxCommentLength
+	}
+	return false
+}
+
+// Validate checks answers against the form and drops empty answers. Every
+// problem with answers is reported in the error.
+func (self *EvaluationForm) Validate(answers map[string]interface{}) error {
+	var problems []string
+	known := make(map[string]bool)
+	for _, q := range self.questions() {
+		known[q.Id] = true
+		answer, found := answers[q.Id]
+		if !found || answer == nil || answer == "" {
+			delete(answers, q.Id)
+			if q.Required {
+				problems = append(problems,
+					fmt.Sprintf("%q is required", q.Label))
+			}
+			continue
+		}
+		if !q.valid(answer) {
+			problems = append(problems,
+				fmt.Sprintf("invalid answer to %q", q.Label))
+		}
+	}
+	for id := range answers {
+		if !known[id] {
+			problems = append(problems, fmt.Sprintf("no question %q", id))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// EvaluationForm returns the department's evaluation form, or nil if it has
+// not set one.
+func (self *Dept) EvaluationForm() *EvaluationForm {
+	var form EvaluationForm
+	_, err := self.getSetting(evaluationFormSetting, &form)
+	if err != nil {
+		return nil
+	}
+	return &form
+}
+
+// SetEvaluationForm replaces the department's evaluation form with the next
+// version. Evaluations of earlier versions are kept; answers to questions
+// that have been removed or changed no longer count in summaries.
+func (self *Dept) SetEvaluationForm(form *EvaluationForm) error {
+	err := form.Check()
+	if err != nil {
+		return err
+	}
+	form.Version = 1
+	if old := self.EvaluationForm(); old != nil {
+		form.Version = old.Version + 1
+	}
+	return self.putSetting(evaluationFormSetting, form)
+}
+
+func evaluationId(appId string, revId ReviewerId) string {
+	// XXX: relies on the component ids being non-empty, as for scores.
+	return fmt.Sprintf("%s-%s", appId, revId)
+}
+
+// SubmitEvaluation validates the evaluation against the current form and
+// stores it, keeping the reviewer's previous answers, if any, as a version.
+func (self *Dept) SubmitEvaluation(eval *Evaluation) error {
+	form := self.EvaluationForm()
+	if form == nil {
+		return ErrNoEvaluationForm
+	}
+	if eval.Answers == nil {
+		eval.Answers = make(map[string]interface{})
+	}
+	err := form.Validate(eval.Answers)
+	if err != nil {
+		return err
+	}
+	eval.Id = evaluationId(eval.AppId, eval.RevId)
+	eval.FormVersion = form.Version
+	eval.Timestamp = nowTimestamp()
+	var old Evaluation
+	rev, err := self.evaluationsDB.Retrieve(eval.Id, &old)
+	if err != nil {
+		eval.Versions = nil
+		_, _, err = self.evaluationsDB.InsertWith(eval, eval.Id)
+		return err
+	}
+	eval.Versions = append(old.Versions, EvaluationVersion{old.FormVersion,
+		old.Answers, old.Timestamp})
+	_, err = self.evaluationsDB.EditWith(eval, eval.Id, rev)
+	return err
+}
+
+type EvaluationsResult struct {
+	Rows []struct {
+		Doc Evaluation `json:"doc"`
+	} `json:"rows"`
+}
+
+// Evaluations returns the evaluations of an applicant, or of every applicant
+// if appId is empty.
+func (self *Dept) Evaluations(appId string) ([]Evaluation, error) {
+	params := map[string]interface{}{"include_docs": true}
+	if appId != "" {
+		params["key"] = appId
+	}
+	var r EvaluationsResult
+	err := self.evaluationsDB.Query("_design/myviews/_view/byApp", params, &r)
+	if err != nil {
+		return nil, err
+	}
+	evals := make([]Evaluation, len(r.Rows))
+	for i, row := range r.Rows {
+		evals[i] = row.Doc
+	}
+	return evals, nil
+}
+
+// A QuestionSummary aggregates the answers to a question: the mean of
+// numeric answers, or the number of times each choice was picked.
+type QuestionSummary struct {
+	Answers int            `json:"answers"`
+	Mean    *float64       `json:"mean,omitempty"`
+	Choices map[string]int `json:"choices,omitempty"`
+}
+
+// SummarizeEvaluations aggregates the answers to the choice and number
+// questions of form, by question id. Answers that are not valid for the
+// current form are ignored, as are text questions.
+func SummarizeEvaluations(form *EvaluationForm,
+	evals []Evaluation) map[string]*QuestionSummary {
+	summary := make(map[string]*QuestionSummary)
+	for _, q := range form.questions() {
+		if q.Type == QuestionText {
+			continue
+		}
+		s := &QuestionSummary{}
+		sum := 0.0
+		for _, eval := range evals {
+			answer, found := eval.Answers[q.Id]
+			if !found || !q.valid(answer) {
+				continue
+			}
+			s.Answers++
+			switch q.Type {
+			case QuestionNumber:
+				sum += answer.(float64)
+			case QuestionChoice:
+				if s.Choices == nil {
+					s.Choices = make(map[string]int)
+				}
+				s.Choices[answer.(string)]++
+			}
+		}
+		if q.Type == QuestionNumber && s.Answers > 0 {
+			mean := sum / float64(s.Answers)
+			s.Mean = &mean
+		}
+		summary[q.Id] = s
+	}
+	return summary
+}
+
+func contains(strs []string, s string) bool {
+	for _, t := range strs {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// addEvaluationSummaries sets the number of evaluations of each application
+// and the summary of their answers.
+func addEvaluationSummaries(appMap map[string]map[string]interface{},
+	form *EvaluationForm, evals []Evaluation) {
+	byApp := make(map[string][]Evaluation)
+	for _, eval := range evals {
+		byApp[eval.AppId] = append(byApp[eval.AppId], eval)
+	}
+	for id, app := range appMap {
+		app["evaluations"] = len(byApp[id])
+		app["evaluationSummary"] = SummarizeEvaluations(form, byApp[id])
+	}
+}
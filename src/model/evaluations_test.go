@@ -0,0 +1,103 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testForm(t *testing.T) *EvaluationForm {
+	var form EvaluationForm
+	err := json.Unmarshal([]byte(`{ "version": 2, "sections": [
+	  { "title": "Research", "questions": [
+	    { "id": "fit", "label": "Fit", "type": "choice", "required": true,
+	      "choices": [ "Strong", "Weak" ] },
+	    { "id": "potential", "label": "Potential", "type": "number",
+	      "min": 1, "max": 5 } ] },
+	  { "title": "Other", "questions": [
+	    { "id": "notes", "label": "Notes", "type": "text" } ] } ] }`), &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = form.Check(); err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	return &form
+}
+
+func TestEvaluationFormCheck(t *testing.T) {
+	testForm(t)
+	bad := []string{
+		`{ "sections": [] }`,
+		`{ "sections": [ { "questions": [ { "label": "No id", "type": "text" } ] } ] }`,
+		`{ "sections": [ { "questions": [ { "id": "a", "type": "text" } ] },
+		                 { "questions": [ { "id": "a", "type": "text" } ] } ] }`,
+		`{ "sections": [ { "questions": [ { "id": "a", "type": "date" } ] } ] }`,
+		`{ "sections": [ { "questions": [ { "id": "a", "type": "choice",
+		    "choices": [ "Yes", "Yes" ] } ] } ] }`,
+		`{ "sections": [ { "questions": [ { "id": "a", "type": "number",
+		    "min": 5, "max": 1 } ] } ] }`,
+	}
+	for _, src := range bad {
+		var form EvaluationForm
+		if err := json.Unmarshal([]byte(src), &form); err != nil {
+			t.Fatal(err)
+		}
+		if form.Check() == nil {
+			t.Errorf("accepted %v", src)
+		}
+	}
+}
+
+func TestEvaluationFormValidate(t *testing.T) {
+	form := testForm(t)
+	answers := map[string]interface{}{"fit": "Strong", "potential": 4.0,
+		"notes": ""}
+	if err := form.Validate(answers); err != nil {
+		t.Fatalf("Validate(%v) = %v", answers, err)
+	}
+	if _, found := answers["notes"]; found {
+		t.Errorf("kept the empty answer to notes")
+	}
+	answers = map[string]interface{}{"potential": 9.0, "extra": true}
+	err := form.Validate(answers)
+	if err == nil {
+		t.Fatalf("accepted %v", answers)
+	}
+	for _, problem := range []string{`"Fit" is required`,
+		`invalid answer to "Potential"`, `no question "extra"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not report %q", err, problem)
+		}
+	}
+	if form.Validate(map[string]interface{}{"fit": "Maybe"}) == nil {
+		t.Errorf("accepted an unknown choice")
+	}
+}
+
+func TestSummarizeEvaluations(t *testing.T) {
+	form := testForm(t)
+	evals := []Evaluation{
+		{Answers: map[string]interface{}{"fit": "Strong", "potential": 4.0}},
+		{Answers: map[string]interface{}{"fit": "Strong", "potential": 5.0,
+			"notes": "Good"}},
+		// From an earlier version of the form.
+		{Answers: map[string]interface{}{"fit": "Excellent", "potential": 10.0}},
+	}
+	summary := SummarizeEvaluations(form, evals)
+	if _, found := summary["notes"]; found {
+		t.Errorf("summarized a text question")
+	}
+	fit := summary["fit"]
+	if fit.Answers != 2 || fit.Choices["Strong"] != 2 || len(fit.Choices) != 1 {
+		t.Errorf("fit summary %+v", fit)
+	}
+	potential := summary["potential"]
+	if potential.Answers != 2 || potential.Mean == nil || *potential.Mean != 4.5 {
+		t.Errorf("potential summary %+v", potential)
+	}
+	if s := SummarizeEvaluations(form, nil)["potential"]; s.Answers != 0 ||
+		s.Mean != nil {
+		t.Errorf("summary of no evaluations %+v", s)
+	}
+}
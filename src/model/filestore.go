@@ -0,0 +1,183 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A FileStore stores blobs in a directory on the local disk, by content:
+// blobs/XX/CHECKSUM holds the contents of every blob whose checksum starts
+// with XX, and names/NAME describes the blob called NAME, in JSON. Uploads
+// with the same contents share a file.
+type FileStore struct {
+	Dir string
+}
+
+func (self *FileStore) blobPath(checksum string) string {
+	return filepath.Join(self.Dir, "blobs", checksum[:2], checksum)
+}
+
+func (self *FileStore) namesDir() string {
+	return filepath.Join(self.Dir, "names")
+}
+
+func (self *FileStore) namePath(name string) string {
+	escaped := url.PathEscape(name)
+	// Keep "." and ".." in the directory.
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return filepath.Join(self.namesDir(), escaped)
+}
+
+func (self *FileStore) Put(info *BlobInfo, r io.Reader) error {
+	if _, err := os.Lstat(self.namePath(info.Name)); err == nil {
+		return ErrUploadExists
+	}
+	if len(info.Checksum) != sha256.Size*2 {
+		return fmt.Errorf("%v: bad checksum %q", info.Name, info.Checksum)
+	}
+	err := os.MkdirAll(filepath.Dir(self.blobPath(info.Checksum)), 0700)
+	if err == nil {
+		err = os.MkdirAll(self.namesDir(), 0700)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(self.Dir, ".blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if n != info.Size || hex.EncodeToString(hash.Sum(nil)) != info.Checksum {
+		return fmt.Errorf("%v: contents do not match the size and checksum",
+			info.Name)
+	}
+	if _, err = os.Stat(self.blobPath(info.Checksum)); os.IsNotExist(err) {
+		err = os.Rename(tmp.Name(), self.blobPath(info.Checksum))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Linking fails if the name was taken meanwhile.
+	desc, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp, err = ioutil.TempFile(self.Dir, ".name")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(desc)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Link(tmp.Name(), self.namePath(info.Name))
+	if os.IsExist(err) {
+		return ErrUploadExists
+	}
+	return err
+}
+
+func (self *FileStore) stat(name string) (*BlobInfo, error) {
+	desc, err := ioutil.ReadFile(self.namePath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNoUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &BlobInfo{}
+	err = json.Unmarshal(desc, info)
+	if err != nil || len(info.Checksum) != sha256.Size*2 {
+		return nil, fmt.Errorf("%v: corrupt description", name)
+	}
+	info.Name = name
+	return info, nil
+}
+
+func (self *FileStore) Open(name string) (*Blob, error) {
+	info, err := self.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(self.namePath(name))
+	if err != nil {
+		return nil, err
+	}
+	info.ModTime = stat.ModTime()
+	info.ETag = `"` + info.Checksum + `"`
+	file, err := os.Open(self.blobPath(info.Checksum))
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{*info, file}, nil
+}
+
+// Delete deletes the name, and the contents if no other name shares them.
+func (self *FileStore) Delete(name string) error {
+	info, err := self.stat(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(self.namePath(name))
+	if err != nil {
+		return err
+	}
+	names, err := self.Names()
+	if err != nil {
+		return err
+	}
+	for _, other := range names {
+		if otherInfo, err := self.stat(other); err != nil ||
+			otherInfo.Checksum == info.Checksum {
+			return err
+		}
+	}
+	return os.Remove(self.blobPath(info.Checksum))
+}
+
+func (self *FileStore) Names() ([]string, error) {
+	entries, err := ioutil.ReadDir(self.namesDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
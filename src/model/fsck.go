@@ -0,0 +1,245 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+)
+import db "code.google.com/p/couch-go"
+
+const fsckSamples = 5
+
+// A Problem is one kind of inconsistency found by Fsck.
+type Problem struct {
+	Description string
+	Count       int
+	// Up to fsckSamples examples of the problem.
+	Samples []string
+	// Problems that Fsck cannot repair need a person to look at them.
+	Repairable bool
+	Repaired   int
+	// Repair errors, if any.
+	Errors []string
+}
+
+func (self *Problem) add(sample string) {
+	self.Count++
+	if len(self.Samples) < fsckSamples {
+		self.Samples = append(self.Samples, sample)
+	}
+}
+
+// A doc to delete when repairing.
+type fsckDoc struct {
+	d   *db.Database
+	id  string
+	rev string
+}
+
+type fsck struct {
+	problems []*Problem
+	// Docs to delete, by problem.
+	deletions map[*Problem][]fsckDoc
+}
+
+func (self *fsck) problem(description string, repairable bool) *Problem {
+	p := &Problem{Description: description, Repairable: repairable}
+	self.problems = append(self.problems, p)
+	return p
+}
+
+// deleteIf records a problem that documents satisfying pred have, repaired by
+// deleting those documents.
+func (self *fsck) deleteIf(description string, d *db.Database,
+	docs []map[string]interface{}, pred func(map[string]interface{}) bool) {
+	p := self.problem(description, true)
+	for _, doc := range docs {
+		if pred(doc) {
+			id, _ := doc["_id"].(string)
+			rev, _ := doc["_rev"].(string)
+			p.add(id)
+			self.deletions[p] = append(self.deletions[p], fsckDoc{d, id, rev})
+		}
+	}
+}
+
+func (self *fsck) reportIf(description string, docs []map[string]interface{},
+	pred func(map[string]interface{}) bool) {
+	p := self.problem(description, false)
+	for _, doc := range docs {
+		if pred(doc) {
+			id, _ := doc["_id"].(string)
+			p.add(id)
+		}
+	}
+}
+
+func idSet(docs []map[string]interface{}) map[string]bool {
+	ids := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		ids[id] = true
+	}
+	return ids
+}
+
+// Fsck checks the department's data for inconsistencies and returns the
+// problems it found. With repair, it also repairs those it can: it installs
+// missing views and deletes records that refer to missing applications or
+// reviewers. Comments and letters are never deleted.
+func (self *Dept) Fsck(repair bool) ([]*Problem, error) {
+	check := &fsck{deletions: make(map[*Problem][]fsckDoc)}
+
+	versionProblem := check.problem("department needs 'apply2 migrate'", false)
+	if err := self.CheckVersion(); err != nil {
+		versionProblem.add(err.Error())
+	}
+
+	views := self.currentViews()
+	viewsProblem := check.problem("missing or outdated views", true)
+	for d, expected := range views {
+		var design struct {
+			Views map[string]interface{} `json:"views"`
+		}
+		// A missing design document leaves design.Views empty.
+		d.Retrieve(designId, &design)
+		for name, view := range expected {
+			if !reflect.DeepEqual(design.Views[name], view) {
+				viewsProblem.add(d.Name + "/" + name)
+			}
+		}
+	}
+
+	dbs := make(map[*db.Database][]map[string]interface{})
+	for _, d := range self.docDatabases() {
+		docs, err := allDocs(d.db)
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", d.db.Name, err)
+		}
+		dbs[d.db] = docs
+	}
+	apps := idSet(dbs[self.appDB])
+	reviewers := idSet(dbs[self.reviewerDB])
+	str := func(doc map[string]interface{}, key string) string {
+		s, _ := doc[key].(string)
+		return s
+	}
+
+	check.deleteIf("from-applicants records without an application",
+		self.fromApplicantsDB, dbs[self.fromApplicantsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "_id")]
+		})
+	check.deleteIf("scores for unknown applications or reviewers",
+		self.scoresDB, dbs[self.scoresDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")] || !reviewers[str(doc, "revId")]
+		})
+	check.deleteIf("highlights for unknown applications or reviewers",
+		self.highlightsDB, dbs[self.highlightsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")] || !reviewers[str(doc, "readerId")] ||
+				!reviewers[str(doc, "writerId")]
+		})
+	check.deleteIf("matches for unknown applications", self.matchesDB,
+		dbs[self.matchesDB], func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")]
+		})
+	check.deleteIf("notifications for unknown reviewers", self.notificationsDB,
+		dbs[self.notificationsDB], func(doc map[string]interface{}) bool {
+			return !reviewers[str(doc, "revId")]
+		})
+	check.deleteIf("evaluations for unknown applications or reviewers",
+		self.evaluationsDB, dbs[self.evaluationsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")] || !reviewers[str(doc, "revId")]
+		})
+	check.deleteIf("annotations for unknown applications or reviewers",
+		self.annotationsDB, dbs[self.annotationsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")] || !reviewers[str(doc, "revId")]
+		})
+	check.deleteIf("assignments of unknown applications or reviewers",
+		self.assignmentsDB, dbs[self.assignmentsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")] || !reviewers[str(doc, "revId")]
+		})
+	check.reportIf("comments on unknown applications", dbs[self.commentsDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")]
+		})
+	comments := idSet(dbs[self.commentsDB])
+	check.reportIf("replies to missing comments", dbs[self.commentsDB],
+		func(doc map[string]interface{}) bool {
+			parent := str(doc, "parentId")
+			return parent != "" && !comments[parent]
+		})
+	check.reportIf("letters for unknown applications", dbs[self.lettersDB],
+		func(doc map[string]interface{}) bool {
+			return !apps[str(doc, "appId")]
+		})
+
+	appsById := make(map[string]map[string]interface{})
+	for _, app := range dbs[self.appDB] {
+		appsById[str(app, "_id")] = app
+	}
+	check.reportIf("annotations on materials the application lacks",
+		dbs[self.annotationsDB], func(doc map[string]interface{}) bool {
+			app := appsById[str(doc, "appId")]
+			return app != nil && !hasMaterial(app, str(doc, "material"))
+		})
+
+	names, err := self.blobs.Names()
+	if err != nil {
+		return nil, fmt.Errorf("listing uploads: %v", err)
+	}
+	uploads := make(map[string]bool)
+	for _, name := range names {
+		uploads[name] = true
+	}
+	missingUploads := check.problem("materials whose upload is missing", false)
+	for _, app := range dbs[self.appDB] {
+		for _, field := range []string{"materials", "recs"} {
+			mats, _ := app[field].([]interface{})
+			for _, mat := range mats {
+				m, _ := mat.(map[string]interface{})
+				if name := str(m, "url"); name != "" && !uploads[name] {
+					missingUploads.add(str(app, "_id") + ": " + name)
+				}
+			}
+		}
+	}
+
+	var problems []*Problem
+	for _, p := range check.problems {
+		if p.Count > 0 {
+			problems = append(problems, p)
+		}
+	}
+	if !repair {
+		return problems, nil
+	}
+
+	if viewsProblem.Count > 0 {
+		for d, expected := range views {
+			err := ensureViews(d, expected)
+			if err != nil {
+				viewsProblem.Errors = append(viewsProblem.Errors, err.Error())
+			}
+		}
+		if len(viewsProblem.Errors) == 0 {
+			viewsProblem.Repaired = viewsProblem.Count
+		}
+	}
+	for p, docs := range check.deletions {
+		for _, doc := range docs {
+			err := doc.d.Delete(doc.id, doc.rev)
+			if err != nil {
+				p.Errors = append(p.Errors,
+					fmt.Sprintf("deleting %v: %v", doc.id, err))
+			} else {
+				p.Repaired++
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,256 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const MatchSuggested = "suggested"
+const MatchConfirmed = "confirmed"
+const MatchRejected = "rejected"
+
+// A Match links an application to the application of the same person in a
+// prior cycle of the department. Matches on the applicant's id are confirmed
+// when they are found. Matches on email or name are only suggested until a
+// chair confirms or rejects them.
+type Match struct {
+	Id         string    `json:"_id"`
+	AppId      string    `json:"appId"`
+	PriorCycle Namespace `json:"priorCycle"`
+	PriorAppId string    `json:"priorAppId"`
+	Reason     string    `json:"reason"`
+	Status     string    `json:"status"`
+}
+
+type MatchesResult struct {
+	Rows []struct {
+		Doc Match `json:"doc"`
+	} `json:"rows"`
+}
+
+// A PriorRecord is what a prior cycle knows about a matched applicant. Only
+// confirmed matches carry comments and scores.
+type PriorRecord struct {
+	Match     Match                  `json:"match"`
+	App       map[string]interface{} `json:"app"`
+	Comments  []Comment              `json:"comments,omitempty"`
+	Scores    []Score                `json:"scores,omitempty"`
+	Reviewers map[string]string      `json:"reviewers,omitempty"`
+}
+
+// priorCycles returns the cycles of the department that sort before this
+// one, so cycles should be named to sort by date (e.g., "2014", "2015").
+func (self *Dept) priorCycles() ([]*Dept, error) {
+	if self.ns.Cycle() == "" {
+		return nil, nil
+	}
+	namespaces, err := ListNamespaces(self.appDB.Host, self.appDB.Port)
+	if err != nil {
+		return nil, err
+	}
+	var prior []*Dept
+	for _, ns := range namespaces {
+		if ns.Dept() != self.ns.Dept() || ns.Cycle() == "" ||
+			ns.Cycle() >= self.ns.Cycle() {
+			continue
+		}
+		dept, err := OpenDept(self.appDB.Host, self.appDB.Port, ns)
+		if err != nil {
+			return nil, fmt.Errorf("loading %v: %v", ns, err)
+		}
+		prior = append(prior, dept)
+	}
+	return prior, nil
+}
+
+func normalize(v interface{}) string {
+	s, _ := v.(string)
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+func fullName(app map[string]interface{}) string {
+	first, last := normalize(app["firstName"]), normalize(app["lastName"])
+	if first == "" || last == "" {
+		return ""
+	}
+	return first + " " + last
+}
+
+// matchApps pairs each application in apps with the applications in prior
+// that have its id or, failing that, its email address or, failing that, its
+// full name.
+func matchApps(apps, prior []map[string]interface{}) []Match {
+	byId := make(map[string]string)
+	byEmail := make(map[string][]string)
+	byName := make(map[string][]string)
+	for _, app := range prior {
+		id := app["_id"].(string)
+		byId[id] = id
+		if email := normalize(app["email"]); email != "" {
+			byEmail[email] = append(byEmail[email], id)
+		}
+		if name := fullName(app); name != "" {
+			byName[name] = append(byName[name], id)
+		}
+	}
+
+	var matches []Match
+	for _, app := range apps {
+		id := app["_id"].(string)
+		if _, found := byId[id]; found {
+			matches = append(matches, Match{AppId: id, PriorAppId: id,
+				Reason: "personId", Status: MatchConfirmed})
+			continue
+		}
+		reason, priorIds := "email", byEmail[normalize(app["email"])]
+		if len(priorIds) == 0 {
+			reason, priorIds = "name", byName[fullName(app)]
+		}
+		for _, priorId := range priorIds {
+			matches = append(matches, Match{AppId: id, PriorAppId: priorId,
+				Reason: reason, Status: MatchSuggested})
+		}
+	}
+	return matches
+}
+
+// FindMatches matches applications to those of prior cycles. Matches found
+// by an earlier run keep their status. Returns the number of new matches.
+func (self *Dept) FindMatches() (int, error) {
+	prior, err := self.priorCycles()
+	if err != nil {
+		return 0, err
+	}
+	apps, err := allDocs(self.appDB)
+	if err != nil {
+		return 0, err
+	}
+	found := 0
+	for _, priorDept := range prior {
+		priorApps, err := allDocs(priorDept.appDB)
+		if err != nil {
+			return found, err
+		}
+		for _, match := range matchApps(apps, priorApps) {
+			match.PriorCycle = priorDept.ns
+			match.Id = fmt.Sprintf("%s:%s:%s", match.AppId,
+				priorDept.ns.Cycle(), match.PriorAppId)
+			var old Match
+			_, err := self.matchesDB.Retrieve(match.Id, &old)
+			if err == nil {
+				continue
+			}
+			_, _, err = self.matchesDB.Insert(match)
+			if err != nil {
+				return found, err
+			}
+			found++
+		}
+	}
+	return found, nil
+}
+
+// Matches returns the matches with the given status, or all matches if status
+// is empty.
+func (self *Dept) Matches(status string) ([]Match, error) {
+	var r MatchesResult
+	err := self.matchesDB.Query("_all_docs", includeDocs, &r)
+	if err != nil {
+		return nil, err
+	}
+	var matches []Match
+	for _, row := range r.Rows {
+		if row.Doc.AppId != "" && (status == "" || row.Doc.Status == status) {
+			matches = append(matches, row.Doc)
+		}
+	}
+	return matches, nil
+}
+
+func (self *Dept) SetMatchStatus(id string, status string) error {
+	if status != MatchSuggested && status != MatchConfirmed &&
+		status != MatchRejected {
+		return fmt.Errorf("invalid match status %q", status)
+	}
+	var match Match
+	rev, err := self.matchesDB.Retrieve(id, &match)
+	if err != nil {
+		return err
+	}
+	match.Status = status
+	_, err = self.matchesDB.EditWith(match, id, rev)
+	return err
+}
+
+// History returns what prior cycles know about the application appId, from
+// its confirmed matches and, if withSuggested, its suggested matches.
+func (self *Dept) History(appId string, withSuggested bool) ([]PriorRecord,
+	error) {
+	var r MatchesResult
+	err := self.matchesDB.Query("_design/myviews/_view/byAppId",
+		map[string]interface{}{"key": appId, "include_docs": true}, &r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]PriorRecord, 0, len(r.Rows))
+	for _, row := range r.Rows {
+		match := row.Doc
+		if match.Status == MatchRejected ||
+			(match.Status == MatchSuggested && !withSuggested) {
+			continue
+		}
+		prior, err := OpenDept(self.appDB.Host, self.appDB.Port, match.PriorCycle)
+		if err != nil {
+			return nil, fmt.Errorf("loading %v: %v", match.PriorCycle, err)
+		}
+		record, err := prior.priorRecord(match)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+func (self *Dept) priorRecord(match Match) (*PriorRecord, error) {
+	record := &PriorRecord{Match: match}
+	_, err := self.appDB.Retrieve(match.PriorAppId, &record.App)
+	if err != nil {
+		return nil, errors.New("prior application " + match.PriorAppId +
+			" is missing")
+	}
+	if match.Status != MatchConfirmed {
+		return record, nil
+	}
+	// Reviewers of this cycle see only the comments the whole committee of
+	// the prior cycle could.
+	record.Comments, err = self.LoadComments(match.PriorAppId, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Score ids begin with the application id.
+	var scores struct {
+		Rows []struct {
+			Doc Score `json:"doc"`
+		} `json:"rows"`
+	}
+	err = self.scoresDB.Query("_all_docs", map[string]interface{}{
+		"startkey":     match.PriorAppId + "-",
+		"endkey":       match.PriorAppId + "-\ufff0",
+		"include_docs": true,
+	}, &scores)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range scores.Rows {
+		if row.Doc.AppId == match.PriorAppId {
+			record.Scores = append(record.Scores, row.Doc)
+		}
+	}
+	record.Reviewers, err = self.GetReviewerIdMap()
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
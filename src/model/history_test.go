@@ -0,0 +1,34 @@
+package model
+
+import "testing"
+
+func TestMatchApps(t *testing.T) {
+	prior := []map[string]interface{}{
+		{"_id": "1", "firstName": "Ada", "lastName": "Lovelace"},
+		{"_id": "2", "email": "alan@example.com"},
+		{"_id": "3", "firstName": "Grace", "lastName": "Hopper"},
+		{"_id": "4", "firstName": "grace ", "lastName": "HOPPER"},
+	}
+	apps := []map[string]interface{}{
+		{"_id": "1", "firstName": "Ada", "lastName": "King"},
+		{"_id": "10", "email": " Alan@Example.com", "firstName": "Grace",
+			"lastName": "Hopper"},
+		{"_id": "11", "firstName": "Grace", "lastName": "Hopper"},
+		{"_id": "12", "firstName": "Alan"},
+	}
+	expected := []Match{
+		{AppId: "1", PriorAppId: "1", Reason: "personId", Status: MatchConfirmed},
+		{AppId: "10", PriorAppId: "2", Reason: "email", Status: MatchSuggested},
+		{AppId: "11", PriorAppId: "3", Reason: "name", Status: MatchSuggested},
+		{AppId: "11", PriorAppId: "4", Reason: "name", Status: MatchSuggested},
+	}
+	actual := matchApps(apps, prior)
+	if len(actual) != len(expected) {
+		t.Fatalf("matchApps = %v, expected %v", actual, expected)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("match %v is %v, expected %v", i, actual[i], expected[i])
+		}
+	}
+}
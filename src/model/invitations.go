@@ -0,0 +1,110 @@
+package model
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+	"util"
+)
+
+const InvitationSent = "sent"
+const InvitationFailed = "failed"
+const InvitationAccepted = "accepted"
+const InvitationExpired = "expired"
+
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+// An Invitation asks a reviewer to set a password. Its setup link carries the
+// nonce, which is cleared when the reviewer sets a password, so the link
+// works once.
+type Invitation struct {
+	Nonce   string    `json:"nonce,omitempty"`
+	Sent    time.Time `json:"sent"`
+	Expires time.Time `json:"expires"`
+	// InvitationSent, InvitationFailed or InvitationAccepted. Use State,
+	// which also reports expired invitations.
+	Status string `json:"status"`
+	// Why sending failed.
+	Error string `json:"error,omitempty"`
+}
+
+// State returns the status of the invitation at time now.
+func (self *Invitation) State(now time.Time) string {
+	if self.Status == InvitationSent && now.After(self.Expires) {
+		return InvitationExpired
+	}
+	return self.Status
+}
+
+// Matches reports whether nonce is that of the invitation, which has one
+// until it is used. Nonces are compared in constant time.
+func (self *Invitation) Matches(nonce string) bool {
+	return self.Nonce != "" &&
+		subtle.ConstantTimeCompare([]byte(self.Nonce), []byte(nonce)) == 1
+}
+
+// Invite mints a new invitation for the reviewer, replacing any earlier one,
+// and calls send to deliver it. The invitation is recorded as sent or failed.
+func (self *Dept) Invite(revId ReviewerId, ttl time.Duration,
+	send func(rev *Reviewer, inv *Invitation) error) error {
+	rev, err := self.GetReviewerById(revId)
+	if err != nil {
+		return fmt.Errorf("no reviewer %v", revId)
+	}
+	if rev.Email == "" {
+		return fmt.Errorf("reviewer %v has no email address", revId)
+	}
+	now := time.Now()
+	inv := &Invitation{
+		Nonce:   util.NewNonce(),
+		Sent:    now,
+		Expires: now.Add(ttl),
+		Status:  InvitationSent,
+	}
+	sendErr := send(rev, inv)
+	if sendErr != nil {
+		inv.Nonce = ""
+		inv.Status = InvitationFailed
+		inv.Error = sendErr.Error()
+	}
+	err = self.updateReviewer(revId, func(rev *Reviewer) {
+		rev.Invitation = inv
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// AcceptInvitation sets the reviewer's password, if nonce is that of their
+// pending invitation and they are not disabled.
+func (self *Dept) AcceptInvitation(revId ReviewerId, nonce string,
+	password string) error {
+	if len(password) < 8 {
+		return errors.New("password must have at least 8 characters")
+	}
+	// Editing with the revision we checked makes a concurrent use of the
+	// same link fail with a conflict.
+	var rev Reviewer
+	_rev, err := self.reviewerDB.Retrieve(string(revId), &rev)
+	if err != nil {
+		return fmt.Errorf("no reviewer %v", revId)
+	}
+	if rev.Disabled {
+		return errors.New("your account is disabled")
+	}
+	inv := rev.Invitation
+	if inv == nil || !inv.Matches(nonce) {
+		return errors.New("this link has been used or replaced")
+	}
+	if inv.State(time.Now()) != InvitationSent {
+		return errors.New("this link has expired")
+	}
+	rev.PasswordSalt = util.NewSalt()
+	rev.PasswordHash = util.HashPassword(password, rev.PasswordSalt)
+	inv.Nonce = ""
+	inv.Status = InvitationAccepted
+	_, err = self.reviewerDB.EditWith(rev, string(revId), _rev)
+	return err
+}
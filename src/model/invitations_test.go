@@ -0,0 +1,34 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvitationState(t *testing.T) {
+	sent := time.Date(2014, 1, 6, 9, 0, 0, 0, time.UTC)
+	inv := &Invitation{Nonce: "n", Sent: sent, Expires: sent.Add(DefaultInvitationTTL),
+		Status: InvitationSent}
+	if s := inv.State(sent.Add(time.Hour)); s != InvitationSent {
+		t.Errorf("state after an hour = %v", s)
+	}
+	if s := inv.State(sent.Add(8 * 24 * time.Hour)); s != InvitationExpired {
+		t.Errorf("state after 8 days = %v", s)
+	}
+	inv.Status = InvitationAccepted
+	if s := inv.State(sent.Add(8 * 24 * time.Hour)); s != InvitationAccepted {
+		t.Errorf("accepted invitation became %v", s)
+	}
+}
+
+func TestInvitationMatches(t *testing.T) {
+	inv := &Invitation{Nonce: "abc"}
+	if !inv.Matches("abc") || inv.Matches("abd") || inv.Matches("ab") ||
+		inv.Matches("") {
+		t.Errorf("invitation with nonce abc matched the wrong nonces")
+	}
+	inv.Nonce = ""
+	if inv.Matches("") {
+		t.Errorf("used invitation matched the empty nonce")
+	}
+}
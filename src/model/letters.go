@@ -0,0 +1,89 @@
+package model
+
+import (
+	"strings"
+)
+
+// Unless an application says otherwise in its "lettersExpected" field, we
+// expect this many recommendation letters for each applicant.
+const DefaultLettersExpected = 3
+
+// A recommendation letter received for an applicant. Letters that arrive as
+// uploads are named after the upload; letters entered by hand have no upload.
+type Letter struct {
+	ApplicantId string  `json:"appId"`
+	Writer      string  `json:"writer"`
+	Received    float64 `json:"received"`
+	Upload      string  `json:"upload,omitempty"`
+}
+
+type LettersResult struct {
+	Rows []struct {
+		Id  string `json:"id"`
+		Doc Letter `json:"doc"`
+	} `json:"rows"`
+}
+
+// SetLetter records a letter. Recording a letter for an upload that already
+// has one replaces it, which is how writers are filled in by hand.
+func (self *Dept) SetLetter(letter *Letter) error {
+	if letter.Upload == "" {
+		_, _, err := self.lettersDB.Insert(letter)
+		return err
+	}
+
+	var old Letter
+	rev, err := self.lettersDB.Retrieve(letter.Upload, &old)
+	if err != nil {
+		_, _, err = self.lettersDB.InsertWith(letter, letter.Upload)
+		return err
+	}
+	_, err = self.lettersDB.EditWith(letter, letter.Upload, rev)
+	return err
+}
+
+func (self *Dept) LoadLetters(appId string) ([]Letter, error) {
+	var result LettersResult
+	query := map[string]interface{}{"key": appId, "include_docs": true}
+	err := self.lettersDB.Query("_design/myviews/_view/byAppId", query, &result)
+
+	ret := make([]Letter, len(result.Rows))
+	for ix, row := range result.Rows {
+		ret[ix] = row.Doc
+	}
+	return ret, err
+}
+
+// addLetterCounts sets lettersReceived, lettersExpected, letterWriters and
+// lettersStatus ("complete" or "incomplete") on every application.
+func addLetterCounts(appMap map[string]map[string]interface{},
+	letters LettersResult) {
+	writers := make(map[string][]string, len(appMap))
+	for _, row := range letters.Rows {
+		if strings.HasPrefix(row.Id, "_design/") {
+			continue
+		}
+		appId := row.Doc.ApplicantId
+		if row.Doc.Writer == "" {
+			writers[appId] = append(writers[appId], "(unknown)")
+		} else {
+			writers[appId] = append(writers[appId], row.Doc.Writer)
+		}
+	}
+
+	for id, app := range appMap {
+		expected := DefaultLettersExpected
+		if n, ok := app["lettersExpected"].(float64); ok {
+			expected = int(n)
+		}
+		received := len(writers[id])
+		app["lettersReceived"] = received
+		app["lettersExpected"] = expected
+		app["letterWriters"] = writers[id]
+		if received >= expected {
+			app["lettersStatus"] = "complete"
+		} else {
+			app["lettersStatus"] = "incomplete"
+		}
+	}
+}
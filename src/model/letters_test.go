@@ -0,0 +1,59 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddLetterCounts(t *testing.T) {
+	var letters LettersResult
+	err := json.Unmarshal([]byte(`{ "rows": [
+	  { "id": "_design/myviews", "doc": {} },
+	  { "id": "1", "doc": { "appId": "a", "writer": "Hopper" } },
+	  { "id": "2", "doc": { "appId": "a", "writer": "" } },
+	  { "id": "3", "doc": { "appId": "a", "writer": "Turing" } },
+	  { "id": "4", "doc": { "appId": "b", "writer": "Lovelace" } },
+	  { "id": "5", "doc": { "appId": "c", "writer": "Knuth" } },
+	  { "id": "6", "doc": { "appId": "unknown", "writer": "Liskov" } } ] }`),
+		&letters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appMap := map[string]map[string]interface{}{
+		"a": {},
+		"b": {},
+		"c": {"lettersExpected": float64(1)},
+		"d": {"lettersExpected": float64(0)},
+		"e": {},
+	}
+	addLetterCounts(appMap, letters)
+
+	for _, test := range []struct {
+		appId              string
+		received, expected int
+		status             string
+		writers            []string
+	}{
+		{"a", 3, 3, "complete", []string{"Hopper", "(unknown)", "Turing"}},
+		{"b", 1, 3, "incomplete", []string{"Lovelace"}},
+		{"c", 1, 1, "complete", []string{"Knuth"}},
+		{"d", 0, 0, "complete", nil},
+		{"e", 0, 3, "incomplete", nil},
+	} {
+		app := appMap[test.appId]
+		writers, _ := app["letterWriters"].([]string)
+		if app["lettersReceived"] != test.received ||
+			app["lettersExpected"] != test.expected ||
+			app["lettersStatus"] != test.status ||
+			len(writers) != len(test.writers) {
+			t.Errorf("%v: got %v", test.appId, app)
+			continue
+		}
+		for i, writer := range writers {
+			if writer != test.writers[i] {
+				t.Errorf("%v: writers %v, expected %v", test.appId, writers,
+					test.writers)
+			}
+		}
+	}
+}
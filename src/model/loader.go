@@ -0,0 +1,256 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const schemaSetting = "schema"
+
+// A SchemaField describes one field of an applicant record. Type is one of
+// "string", "number", "boolean", "array" or "object".
+type SchemaField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// A Schema describes the applicant records that a department accepts. IdField
+// names the field that identifies the applicant. Fields that the schema does
+// not mention are stored as they are.
+type Schema struct {
+	IdField string        `json:"idField"`
+	Fields  []SchemaField `json:"fields"`
+}
+
+// DefaultSchema describes the records that umassimport creates.
+var DefaultSchema = &Schema{
+	IdField: "personId",
+	Fields: []SchemaField{
+		{"personId", "string", true},
+		{"firstName", "string", true},
+		{"lastName", "string", true},
+		{"gender", "string", false},
+		{"admitTerm", "string", false},
+		{"country", "string", false},
+		{"phone", "string", false},
+		{"email", "string", false},
+		{"academicPlanCode", "array", false},
+		{"greAnalytic", "number", false},
+		{"oldGREMath", "number", false},
+		{"oldGREVerbal", "number", false},
+		{"NewGREMath", "number", false},
+		{"NewGREVerbal", "number", false},
+		{"undergradGPA", "number", false},
+		{"gradGPA", "number", false},
+		{"externalOrgs", "array", false},
+	},
+}
+
+// Check returns an error if the schema itself is malformed.
+func (self *Schema) Check() error {
+	idDeclared := false
+	for _, field := range self.Fields {
+		switch field.Type {
+		case "string", "number", "boolean", "array", "object":
+		default:
+			return fmt.Errorf("field %q has unknown type %q", field.Name, field.Type)
+		}
+		if field.Name == self.IdField {
+			if field.Type != "string" || !field.Required {
+				return fmt.Errorf("id field %q must be a required string",
+					field.Name)
+			}
+			idDeclared = true
+		}
+	}
+	if !idDeclared {
+		return fmt.Errorf("id field %q is not declared", self.IdField)
+	}
+	return nil
+}
+
+func hasType(val interface{}, typ string) bool {
+	switch typ {
+	case "string":
+		_, ok := val.(string)
+		return ok
+	case "number":
+		_, ok := val.(float64)
+		return ok
+	case "boolean":
+		_, ok := val.(bool)
+		return ok
+	case "array":
+		_, ok := val.([]interface{})
+		return ok
+	case "object":
+		_, ok := val.(map[string]interface{})
+		return ok
+	}
+	return false
+}
+
+// Validate checks app against the schema and returns the applicant's id.
+// Every problem with app is reported in the error.
+func (self *Schema) Validate(app map[string]interface{}) (string, error) {
+	var problems []string
+	for _, field := range self.Fields {
+		val, found := app[field.Name]
+		if !found || val == nil || val == "" {
+			if field.Required {
+				problems = append(problems,
+					fmt.Sprintf("missing required field %q", field.Name))
+			}
+			continue
+		}
+		if !hasType(val, field.Type) {
+			problems = append(problems,
+				fmt.Sprintf("field %q should be a %s", field.Name, field.Type))
+		}
+	}
+	id, _ := app[self.IdField].(string)
+	if id == "" && len(problems) == 0 {
+		problems = append(problems,
+			fmt.Sprintf("missing id field %q", self.IdField))
+	}
+	if len(problems) > 0 {
+		return "", errors.New(strings.Join(problems, "; "))
+	}
+	return id, nil
+}
+
+// A RecordError reports why one record of an applicant file was rejected.
+// Record counts from 1; for NDJSON it is the line number.
+type RecordError struct {
+	Record int
+	Id     string
+	Err    error
+}
+
+func (self *RecordError) Error() string {
+	if self.Id == "" {
+		return fmt.Sprintf("record %v: %v", self.Record, self.Err)
+	}
+	return fmt.Sprintf("record %v (%v): %v", self.Record, self.Id, self.Err)
+}
+
+// ReadApplications decodes applicant records from r, which holds either a JSON
+// array of objects or newline-delimited JSON objects, and calls fn on each one
+// that passes schema. Records that are malformed, fail validation or that fn
+// rejects are reported in the returned slice. The error is only set if r
+// cannot be read at all.
+func ReadApplications(r io.Reader, schema *Schema,
+	fn func(id string, app map[string]interface{}) error) ([]*RecordError, error) {
+	in := bufio.NewReader(r)
+	// Peek past leading whitespace without consuming it, so that NDJSON line
+	// numbers stay right.
+	for n := 1; ; n++ {
+		b, err := in.Peek(n)
+		if len(b) < n {
+			if err == io.EOF || err == bufio.ErrBufferFull {
+				return readNDJSON(in, schema, fn)
+			}
+			return nil, err
+		}
+		if b[n-1] == '[' {
+			return readJSONArray(in, schema, fn)
+		}
+		if !isSpace(b[n-1]) {
+			return readNDJSON(in, schema, fn)
+		}
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func loadRecord(record int, raw []byte, schema *Schema,
+	fn func(id string, app map[string]interface{}) error) *RecordError {
+	var app map[string]interface{}
+	err := json.Unmarshal(raw, &app)
+	if err != nil {
+		return &RecordError{record, "", err}
+	}
+	if app == nil {
+		return &RecordError{record, "", errors.New("expected an object")}
+	}
+	id, err := schema.Validate(app)
+	if err != nil {
+		return &RecordError{record, "", err}
+	}
+	err = fn(id, app)
+	if err != nil {
+		return &RecordError{record, id, err}
+	}
+	return nil
+}
+
+func readJSONArray(r io.Reader, schema *Schema,
+	fn func(id string, app map[string]interface{}) error) ([]*RecordError, error) {
+	dec := json.NewDecoder(r)
+	_, err := dec.Token() // [
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []*RecordError
+	for record := 1; dec.More(); record++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			// The decoder cannot recover from a syntax error.
+			return errs, fmt.Errorf("record %v: %v", record, err)
+		}
+		if recErr := loadRecord(record, raw, schema, fn); recErr != nil {
+			errs = append(errs, recErr)
+		}
+	}
+	return errs, nil
+}
+
+func readNDJSON(r io.Reader, schema *Schema,
+	fn func(id string, app map[string]interface{}) error) ([]*RecordError, error) {
+	in := bufio.NewReader(r)
+	var errs []*RecordError
+	for line := 1; ; line++ {
+		raw, err := in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return errs, err
+		}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 {
+			if recErr := loadRecord(line, raw, schema, fn); recErr != nil {
+				errs = append(errs, recErr)
+			}
+		}
+		if err == io.EOF {
+			return errs, nil
+		}
+	}
+}
+
+// Schema returns the department's applicant schema, or DefaultSchema if it
+// has not set one.
+func (self *Dept) Schema() *Schema {
+	var schema Schema
+	_, err := self.getSetting(schemaSetting, &schema)
+	if err != nil {
+		return DefaultSchema
+	}
+	return &schema
+}
+
+func (self *Dept) SetSchema(schema *Schema) error {
+	err := schema.Check()
+	if err != nil {
+		return err
+	}
+	return self.putSetting(schemaSetting, schema)
+}
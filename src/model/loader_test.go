@@ -0,0 +1,88 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+var testSchema = &Schema{
+	IdField: "id",
+	Fields: []SchemaField{
+		{"id", "string", true},
+		{"name", "string", true},
+		{"gpa", "number", false},
+	},
+}
+
+func readAll(t *testing.T, src string) (map[string]map[string]interface{},
+	[]*RecordError) {
+	apps := make(map[string]map[string]interface{})
+	errs, err := ReadApplications(strings.NewReader(src), testSchema,
+		func(id string, app map[string]interface{}) error {
+			apps[id] = app
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("ReadApplications(%q) = %v", src, err)
+	}
+	return apps, errs
+}
+
+func TestSchemaCheck(t *testing.T) {
+	if err := testSchema.Check(); err != nil {
+		t.Fatalf("testSchema.Check() = %v", err)
+	}
+	if err := DefaultSchema.Check(); err != nil {
+		t.Fatalf("DefaultSchema.Check() = %v", err)
+	}
+	bad := &Schema{"id", []SchemaField{{"id", "number", true}}}
+	if bad.Check() == nil {
+		t.Fatalf("accepted a numeric id field")
+	}
+	bad = &Schema{"id", []SchemaField{{"id", "string", true}, {"x", "date", false}}}
+	if bad.Check() == nil {
+		t.Fatalf("accepted an unknown type")
+	}
+}
+
+func TestReadJSONArray(t *testing.T) {
+	apps, errs := readAll(t, `
+	  [ { "id": "1", "name": "Ada", "gpa": 4.0, "extra": true },
+	    { "id": "2", "gpa": "high" },
+	    [ "not", "an", "object" ],
+	    { "id": "3", "name": "Grace" } ]`)
+	if len(apps) != 2 || apps["1"]["extra"] != true || apps["3"] == nil {
+		t.Fatalf("loaded %v", apps)
+	}
+	if len(errs) != 2 || errs[0].Record != 2 || errs[1].Record != 3 {
+		t.Fatalf("errors %v", errs)
+	}
+	msg := errs[0].Error()
+	if !strings.Contains(msg, `"name"`) || !strings.Contains(msg, `"gpa"`) {
+		t.Fatalf("expected both problems to be reported, got %v", msg)
+	}
+}
+
+func TestReadNDJSON(t *testing.T) {
+	apps, errs := readAll(t, "\n"+
+		`{ "id": "1", "name": "Ada" }`+"\n"+
+		`{ "id": "2", "name": `+"\n"+
+		"\n"+
+		`{ "id": "3", "name": "Grace" }`)
+	if len(apps) != 2 || apps["1"] == nil || apps["3"] == nil {
+		t.Fatalf("loaded %v", apps)
+	}
+	if len(errs) != 1 || errs[0].Record != 3 {
+		t.Fatalf("expected an error on line 3, got %v", errs)
+	}
+}
+
+func TestReadRejected(t *testing.T) {
+	errs, err := ReadApplications(strings.NewReader(`{"id": "1", "name": "A"}`),
+		testSchema, func(id string, app map[string]interface{}) error {
+			return ErrUploadExists
+		})
+	if err != nil || len(errs) != 1 || errs[0].Id != "1" {
+		t.Fatalf("got %v, %v", errs, err)
+	}
+}
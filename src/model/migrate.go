@@ -0,0 +1,333 @@
+package model
+
+import (
+	"fmt"
+	"markdown"
+	"reflect"
+)
+import db "code.google.com/p/couch-go"
+
+// A department records the number of migrations applied to it as its
+// version. NewDept applies every migration; 'apply2 migrate' applies the
+// ones an older department lacks. To change a view or the shape of stored
+// documents, append a migration. Never edit one that has been released.
+
+const versionSetting = "version"
+const designId = "_design/myviews"
+
+// Views by database, each a map from view name to definition.
+type viewSet map[*db.Database]map[string]interface{}
+
+// A migration installs views, which replace views of the same name, and then
+// runs its update, if any.
+type migration struct {
+	name  string
+	views func(dept *Dept) viewSet
+	run   func(dept *Dept) error
+}
+
+var migrations = []migration{
+	{name: "create views", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.commentsDB: {
+				"byAppId": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, doc); }`,
+				},
+			},
+			dept.highlightsDB: {
+				"byReader": map[string]interface{}{
+					"map": `function(doc) { emit(doc.readerId, { writerId: doc.writerId, appId: doc.appId }); }`,
+				},
+				"byApp": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, { _rev: doc._rev, _id: doc._id, readerId: doc.readerId }); }`,
+				},
+			},
+			dept.scoresDB: {
+				"byId": map[string]interface{}{
+					"map": `function(doc) { emit(doc._id, doc); }`,
+				},
+				"averages": map[string]interface{}{
+					"map":    averagesMap,
+					"reduce": averagesReduce,
+				},
+			},
+			dept.lettersDB: {
+				"byAppId": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, null); }`,
+				},
+			},
+			dept.matchesDB: {
+				"byAppId": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, null); }`,
+				},
+			},
+		}
+	}},
+	{name: "notifications", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.notificationsDB: {
+				"unmailed": map[string]interface{}{
+					"map": `function(doc) { if (!doc.mailed) { emit(doc.revId, null); } }`,
+				},
+			},
+		}
+	}},
+	{name: "notification inbox", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.notificationsDB: {
+				"unread": map[string]interface{}{
+					"map":    `function(doc) { if (!doc.read) { emit(doc.revId, null); } }`,
+					"reduce": "_count",
+				},
+			},
+		}
+	}},
+	{name: "render comments", run: func(dept *Dept) error {
+		_, err := updateDocs(dept.commentsDB, renderComment)
+		return err
+	}},
+	{name: "evaluations", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.evaluationsDB: {
+				"byApp": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, null); }`,
+				},
+			},
+		}
+	}},
+	{name: "annotations", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.annotationsDB: {
+				"byMaterial": map[string]interface{}{
+					"map":    `function(doc) { emit([doc.appId, doc.material], null); }`,
+					"reduce": "_count",
+				},
+			},
+		}
+	}},
+	{name: "assignments", views: func(dept *Dept) viewSet {
+		return viewSet{
+			dept.assignmentsDB: {
+				"byApp": map[string]interface{}{
+					"map": `function(doc) { emit(doc.appId, doc.revId); }`,
+				},
+			},
+		}
+	}},
+}
+
+// renderComment is an update for updateDocs that renders the HTML of comments
+// stored without it.
+func renderComment(doc map[string]interface{}) bool {
+	text, _ := doc["text"].(string)
+	if _, found := doc["html"]; found || text == "" {
+		return false
+	}
+	doc["html"] = markdown.Render(text)
+	return true
+}
+
+const averagesMap = `function(doc) {
+    var r = { };
+    r[doc.label] = { sum: doc.score, len: 1, avg: doc.score };
+    emit(doc.appId, r);
+  }`
+
+const averagesReduce = `function (key, values, rereduce) {
+    var r = { };
+    for (var i = 0; i < values.length; i++) {
+      for (var label in values[i]) {
+        if (!values[i].hasOwnProperty(label)) {
+          continue;
+        }
+        if (!r.hasOwnProperty(label)) {
+          r[label] = { sum: 0, len: 0 };
+        }
+        r[label].sum += values[i][label].sum;
+        r[label].len += values[i][label].len;
+        r[label].avg = r[label].sum / r[label].len;
+      }
+    }
+    return r;
+  }`
+
+// CurrentVersion is the version of a department with every migration
+// applied.
+func CurrentVersion() int {
+	return len(migrations)
+}
+
+// Version returns the number of migrations applied to the department. A
+// department created before versioning has version 0.
+func (self *Dept) Version() int {
+	var setting struct {
+		Version int `json:"version"`
+	}
+	_, err := self.getSetting(versionSetting, &setting)
+	if err != nil {
+		return 0
+	}
+	return setting.Version
+}
+
+func (self *Dept) setVersion(version int) error {
+	return self.putSetting(versionSetting,
+		map[string]interface{}{"version": version})
+}
+
+// CheckVersion returns an error unless the department is at the current
+// version.
+func (self *Dept) CheckVersion() error {
+	version := self.Version()
+	if version > CurrentVersion() {
+		return fmt.Errorf("department %q has version %v, but this apply2 only "+
+			"knows version %v; upgrade apply2", self.ns, version, CurrentVersion())
+	}
+	if version < CurrentVersion() {
+		return fmt.Errorf("department %q has version %v, expected %v; run "+
+			"'apply2 migrate'", self.ns, version, CurrentVersion())
+	}
+	return nil
+}
+
+// PendingMigrations returns the names of the migrations that the department
+// lacks, in the order Migrate applies them.
+func (self *Dept) PendingMigrations() []string {
+	version := self.Version()
+	var names []string
+	for i := version; i < len(migrations); i++ {
+		names = append(names, migrations[i].name)
+	}
+	return names
+}
+
+// Migrate applies the migrations the department lacks, recording the version
+// after each, and returns their names.
+func (self *Dept) Migrate() ([]string, error) {
+	version := self.Version()
+	if version > CurrentVersion() {
+		return nil, self.CheckVersion()
+	}
+	var applied []string
+	for i := version; i < len(migrations); i++ {
+		err := migrations[i].apply(self)
+		if err != nil {
+			return applied, fmt.Errorf("migration %v (%v): %v", i+1,
+				migrations[i].name, err)
+		}
+		err = self.setVersion(i + 1)
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, migrations[i].name)
+	}
+	return applied, nil
+}
+
+func (self *migration) apply(dept *Dept) error {
+	if self.views != nil {
+		for d, views := range self.views(dept) {
+			err := ensureViews(d, views)
+			if err != nil {
+				return fmt.Errorf("%v: %v", d.Name, err)
+			}
+		}
+	}
+	if self.run != nil {
+		return self.run(dept)
+	}
+	return nil
+}
+
+// currentViews returns the views that the migrations install, as of the
+// current version.
+func (self *Dept) currentViews() viewSet {
+	all := make(viewSet)
+	for _, m := range migrations {
+		if m.views == nil {
+			continue
+		}
+		for d, views := range m.views(self) {
+			if all[d] == nil {
+				all[d] = make(map[string]interface{})
+			}
+			for name, view := range views {
+				all[d][name] = view
+			}
+		}
+	}
+	return all
+}
+
+// ensureViews adds views to the design document of d, replacing views of the
+// same name and keeping the others.
+func ensureViews(d *db.Database, views map[string]interface{}) error {
+	var design map[string]interface{}
+	rev, err := d.Retrieve(designId, &design)
+	if err != nil || design == nil {
+		rev = ""
+		design = map[string]interface{}{"language": "javascript"}
+	}
+	existing, _ := design["views"].(map[string]interface{})
+	if existing == nil {
+		existing = make(map[string]interface{})
+	}
+	changed := rev == ""
+	for name, view := range views {
+		if !reflect.DeepEqual(existing[name], view) {
+			existing[name] = view
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	design["views"] = existing
+	if rev == "" {
+		_, _, err = d.InsertWith(design, designId)
+	} else {
+		_, err = d.EditWith(design, designId, rev)
+	}
+	return err
+}
+
+// updateDocs applies update to every document in d other than design
+// documents, and saves the documents that update reports it changed. Field
+// backfills and renames are written as updates.
+func updateDocs(d *db.Database,
+	update func(doc map[string]interface{}) bool) (int, error) {
+	docs, err := allDocs(d)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		rev, _ := doc["_rev"].(string)
+		if !update(doc) {
+			continue
+		}
+		_, err = d.EditWith(doc, id, rev)
+		if err != nil {
+			return updated, fmt.Errorf("updating %v: %v", id, err)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// renameField returns an update for updateDocs that renames the field from to
+// to, unless the document already has a field named to.
+func renameField(from, to string) func(map[string]interface{}) bool {
+	return func(doc map[string]interface{}) bool {
+		val, found := doc[from]
+		if !found {
+			return false
+		}
+		if _, taken := doc[to]; !taken {
+			doc[to] = val
+		}
+		delete(doc, from)
+		return true
+	}
+}
@@ -0,0 +1,41 @@
+package model
+
+import "testing"
+
+func TestRenameField(t *testing.T) {
+	rename := renameField("gpa", "undergradGPA")
+	doc := map[string]interface{}{"gpa": 3.9}
+	if !rename(doc) || doc["undergradGPA"] != 3.9 || doc["gpa"] != nil {
+		t.Errorf("renamed to %v", doc)
+	}
+	if rename(doc) {
+		t.Errorf("renamed a document without the field")
+	}
+	doc = map[string]interface{}{"gpa": 3.9, "undergradGPA": 4.0}
+	if !rename(doc) || doc["undergradGPA"] != 4.0 || len(doc) != 1 {
+		t.Errorf("renaming overwrote an existing field: %v", doc)
+	}
+}
+
+func TestMigrationsNamed(t *testing.T) {
+	seen := make(map[string]bool)
+	for i, m := range migrations {
+		if m.name == "" || seen[m.name] || (m.views == nil && m.run == nil) {
+			t.Errorf("migration %v is unnamed, duplicated or empty", i+1)
+		}
+		seen[m.name] = true
+	}
+}
+
+func TestRenderComment(t *testing.T) {
+	doc := map[string]interface{}{"text": "*new*"}
+	if !renderComment(doc) || doc["html"] != "<p><em>new</em></p>\n" {
+		t.Errorf("rendered %v", doc["html"])
+	}
+	if renderComment(doc) {
+		t.Errorf("rendered a comment twice")
+	}
+	if renderComment(map[string]interface{}{"deleted": true, "text": ""}) {
+		t.Errorf("rendered a deleted comment")
+	}
+}
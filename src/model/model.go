@@ -4,10 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"markdown"
 	"util"
-	"os"	
-	"net/http"
-	"io"
 )
 import db "code.google.com/p/couch-go"
 import ldap "github.com/tonnerre/go-ldap"
@@ -18,15 +16,30 @@ const commentsSuffix = "comments"
 const highlightsSuffix = "highlights"
 const scoresSuffix = "scores"
 const fromApplicantsSuffix = "from-applicants"
+const lettersSuffix = "letters"
+const settingsSuffix = "settings"
+const uploadsSuffix = "uploads"
+const matchesSuffix = "matches"
+const notificationsSuffix = "notifications"
+const evaluationsSuffix = "evaluations"
+const annotationsSuffix = "annotations"
+const assignmentsSuffix = "assignments"
+const packetsSuffix = "packets"
+const previewsSuffix = "previews"
 
 var dbSuffixes = [...]string{applicationsSuffix, reviewersSuffix, commentsSuffix,
-	highlightsSuffix, scoresSuffix,fromApplicantsSuffix}
+	highlightsSuffix, scoresSuffix,fromApplicantsSuffix, lettersSuffix,
+	settingsSuffix, uploadsSuffix, matchesSuffix, notificationsSuffix,
+	evaluationsSuffix, annotationsSuffix, assignmentsSuffix, packetsSuffix,
+	previewsSuffix}
 
 var includeDocs = map[string](interface{}){"include_docs": true}
 
 type URL struct {
 	Text *string `json:"text"`
 	URL  *string `json:"url"`
+	// Of the upload; see Validation.
+	Validation *Validation `json:"validation,omitempty"`
 }
 
 type ReviewerId string
@@ -39,15 +52,43 @@ type Reviewer struct {
 	Id           ReviewerId `json:"_id"`
 	Name         string     `json:"name"`
 	PasswordHash []byte     `json:"passwordHash"`
+	// Chairs run the admissions process and may export department data.
+	Chair bool `json:"chair,omitempty"`
+	Email string `json:"email,omitempty"`
+	// Disabled reviewers cannot log in. Their comments and scores are kept.
+	Disabled bool `json:"disabled,omitempty"`
+	// Reviewers who set a password from an invitation have a salt, and
+	// PasswordHash is util.HashPassword of their password. Others use LDAP.
+	PasswordSalt []byte      `json:"passwordSalt,omitempty"`
+	Invitation   *Invitation `json:"invitation,omitempty"`
+	// Email preferences for notifications; see NotifyPrefs.
+	Notify *NotifyPrefs `json:"notify,omitempty"`
 }
 
-// Reviewers can post multiple comments on applicants. 
+// Reviewers can post multiple comments on applicants, and reply to comments.
 type Comment struct {
+	Id           string     `json:"_id,omitempty"`
 	ApplicantId  string     `json:"appId"`
 	ReviewerId   ReviewerId `json:"reviewerId"`
 	ReviewerName string     `json:"reviewerName"`
 	Timestamp    float64    `json:"timestamp"`
-	Text         string     `json:"text"`
+	// The Markdown source, and the sanitized HTML rendered from it.
+	Text string `json:"text"`
+	HTML string `json:"html,omitempty"`
+	// The comment this one replies to, if any.
+	ParentId string `json:"parentId,omitempty"`
+	// When Text was last edited, and its earlier versions, oldest first.
+	Edited float64       `json:"edited,omitempty"`
+	Edits  []CommentEdit `json:"edits,omitempty"`
+	// Deleted comments keep their place in the thread, without their text.
+	Deleted bool `json:"deleted,omitempty"`
+	// Who may read the comment; see VisibleTo.
+	Visibility string `json:"visibility,omitempty"`
+	// Reviewers who may also read a restricted reply: the authors of the
+	// comments above it in its thread.
+	Audience []ReviewerId `json:"audience,omitempty"`
+	// Filled in by LoadComments; not stored.
+	Replies []Comment `json:"replies,omitempty"`
 }
 
 // A highlight on an application is a mark set by one reviewer, the writer, for
@@ -68,7 +109,10 @@ type Score struct {
 	Score *int       `json:"score"`
 }
 
+var ErrUploadExists = errors.New("upload already exists")
+
 type Dept struct {
+	ns           Namespace
 	appDB        *db.Database
 	reviewerDB   *db.Database
 	commentsDB   *db.Database
@@ -76,6 +120,19 @@ type Dept struct {
 	scoresDB     *db.Database
 	uploadsDB	   *db.Database
   fromApplicantsDB *db.Database
+	lettersDB        *db.Database
+	settingsDB       *db.Database
+	matchesDB        *db.Database
+	notificationsDB  *db.Database
+	evaluationsDB    *db.Database
+	annotationsDB    *db.Database
+	assignmentsDB    *db.Database
+	// Caches packets; see Packet.
+	packetsDB *db.Database
+	// Caches previews; see MakePreviews.
+	previewsDB *db.Database
+	// Holds the files of uploads; see BlobStore.
+	blobs BlobStore
 }
 
 type CommentRow struct {
@@ -97,158 +154,126 @@ type HighlightsByAppResult struct {
 	} `json:"rows"`
 }
 
-func (self *Dept) databases() []*db.Database {
-	return ([]*db.Database{self.appDB, self.reviewerDB, self.commentsDB,
-		self.highlightsDB, self.scoresDB, self.uploadsDB})
+func (self *Dept) Namespace() Namespace {
+	return self.ns
 }
 
-func NewDept(host string, port string) (dept *Dept, err error) {
-	_, err = db.NewDatabase(host, port, applicationsSuffix)
-	if err != nil {
-		return nil, err
-	}
-	_, err = db.NewDatabase(host, port, reviewersSuffix)
-	if err != nil {
-		return nil, err
-	}
-	commentsDB, err := db.NewDatabase(host, port, commentsSuffix)
-	if err != nil {
-		return nil, err
-	}
-	highlightsDB, err := db.NewDatabase(host, port, highlightsSuffix)
-	if err != nil {
-		return nil, err
-	}
-	_, err = db.NewDatabase(host, port, "uploads")
-	if err != nil {
-		return nil, err
+// databases returns every database the department owns.
+func (self *Dept) databases() []*db.Database {
+	dbs := []*db.Database{self.uploadsDB, self.packetsDB, self.previewsDB}
+	for _, d := range self.docDatabases() {
+		dbs = append(dbs, d.db)
 	}
+	return dbs
+}
 
-	commentsDesign := map[string]interface{}{
-		"_id":      "_design/myviews",
-		"language": "javascript",
-		"views": map[string]interface{}{
-			"byAppId": map[string]interface{}{
-				"map": `function(doc) { emit(doc.appId, doc); }`,
-			},
-		},
+// NewDept creates the department's databases and migrates them to the
+// current version.
+func NewDept(host string, port string, ns Namespace) (*Dept, error) {
+	for _, suffix := range dbSuffixes {
+		_, err := db.NewDatabase(host, port, ns.dbName(suffix))
+		if err != nil {
+			return nil, err
+		}
 	}
-	_, _, err = commentsDB.Insert(commentsDesign)
+	dept, err := LoadDept(host, port, ns)
 	if err != nil {
 		return nil, err
 	}
-	highlightsDesign := map[string]interface{}{
-		"_id":      "_design/myviews",
-		"language": "javascript",
-		"views": map[string]interface{}{
-			"byReader": map[string]interface{}{
-				"map": `function(doc) { emit(doc.readerId, { writerId: doc.writerId, appId: doc.appId }); }`,
-			},
-			"byApp": map[string]interface{}{
-				"map": `function(doc) { emit(doc.appId, { _rev: doc._rev, _id: doc._id, readerId: doc.readerId }); }`,
-			},
-		},
-	}
-	_, _, err = highlightsDB.Insert(highlightsDesign)
+	_, err = dept.Migrate()
 	if err != nil {
 		return nil, err
 	}
+	return dept, nil
+}
 
-	const averagesMap = `function(doc) {
-    var r = { };
-    r[doc.label] = { sum: doc.score, len: 1, avg: doc.score };
-    emit(doc.appId, r);
-  }`
-	const averagesReduce = `function (key, values, rereduce) {
-    var r = { };
-    for (var i = 0; i < values.length; i++) {
-      for (var label in values[i]) {
-        if (!values[i].hasOwnProperty(label)) {
-          continue;
-        }
-        if (!r.hasOwnProperty(label)) {
-          r[label] = { sum: 0, len: 0 };
-        }
-        r[label].sum += values[i][label].sum;
-        r[label].len += values[i][label].len;
-        r[label].avg = r[label].sum / r[label].len;
-      }
-    }
-    return r;
-  }`
-
-	scoresDB, err := db.NewDatabase(host, port, scoresSuffix)
-	if err != nil {
-		return nil, err
-	}
-	scoresDesign := map[string]interface{}{
-		"_id":      "_design/myviews",
-		"language": "javascript",
-		"views": map[string]interface{}{
-			"byId": map[string]interface{}{
-				"map": `function(doc) { emit(doc._id, doc); }`,
-			},
-			"averages": map[string]interface{}{
-				"map":    averagesMap,
-				"reduce": averagesReduce,
-			},
-		},
-	}
-	_, _, err = scoresDB.Insert(scoresDesign)
-	if err != nil {
-		return nil, err
-	}
+// LoadDept loads the department, creating any database it lacks that was
+// added since it was created, e.g., a cache. Returns an error if there is no
+// such department; see NewDept.
+func LoadDept(host string, port string, ns Namespace) (*Dept, error) {
+	return loadDept(host, port, ns, true)
+}
 
-	dept, err = LoadDept(host, port)
-	return
+// OpenDept loads the department without creating databases, so that it can
+// be inspected or deleted without bringing back databases that are gone.
+// Caches it lacks are left nil.
+func OpenDept(host string, port string, ns Namespace) (*Dept, error) {
+	return loadDept(host, port, ns, false)
 }
 
-func LoadDept(host string, port string,) (*Dept, error) {
-	appDb, error := db.NewDatabase(host, port, applicationsSuffix)
-	if error != nil {
-		return nil, error
-	}
-	reviewerDb, error := db.NewDatabase(host, port, reviewersSuffix)
-	if error != nil {
-		return nil, error
-	}
-	commentsDb, error := db.NewDatabase(host, port, commentsSuffix)
-	if error != nil {
-		return nil, error
-	}
-	highlightsDb, error := db.NewDatabase(host, port, highlightsSuffix)
-	if error != nil {
-		return nil, error
-	}
-	scoresDb, error := db.NewDatabase(host, port, scoresSuffix)
-	if error != nil {
-		return nil, error
-	}
-	uploadsDB, error := db.NewDatabase(host, port, "uploads")
-	if error != nil {
-		return nil, error
+// Databases that NewDept has always created, so that a department without
+// them does not exist, e.g., because its name is mistyped. Departments
+// without a namespace may predate settings.
+var requiredSuffixes = []string{applicationsSuffix, reviewersSuffix,
+	settingsSuffix}
+
+func loadDept(host string, port string, ns Namespace,
+	create bool) (*Dept, error) {
+	dbs := make(map[string]*db.Database, len(dbSuffixes))
+	for _, suffix := range dbSuffixes {
+		dbs[suffix] = &db.Database{Host: host, Port: port,
+			Name: ns.dbName(suffix)}
+	}
+	for _, suffix := range requiredSuffixes {
+		if suffix == settingsSuffix && ns == "" {
+			continue
+		}
+		if !dbs[suffix].Exists() {
+			return nil, fmt.Errorf("no department %q; 'apply2 newdept' "+
+				"creates one", string(ns))
+		}
 	}
-	fromApplicantsDB, error := db.NewDatabase(host, port, "from-applicants")
-	if error != nil {
-		return nil, error
+	for _, suffix := range dbSuffixes {
+		if dbs[suffix].Exists() {
+			continue
+		}
+		if create {
+			d, error := db.NewDatabase(host, port, ns.dbName(suffix))
+			if error != nil {
+				return nil, error
+			}
+			dbs[suffix] = &d
+		} else if suffix == packetsSuffix || suffix == previewsSuffix {
+			dbs[suffix] = nil
+		}
 	}
 
-	dept := &Dept{&appDb, &reviewerDb, &commentsDb, &highlightsDb,
-		&scoresDb, &uploadsDB, &fromApplicantsDB}
+	dept := &Dept{ns, dbs[applicationsSuffix], dbs[reviewersSuffix],
+		dbs[commentsSuffix], dbs[highlightsSuffix], dbs[scoresSuffix],
+		dbs[uploadsSuffix], dbs[fromApplicantsSuffix], dbs[lettersSuffix],
+		dbs[settingsSuffix], dbs[matchesSuffix], dbs[notificationsSuffix],
+		dbs[evaluationsSuffix], dbs[annotationsSuffix], dbs[assignmentsSuffix],
+		dbs[packetsSuffix], dbs[previewsSuffix], &CouchStore{dbs[uploadsSuffix]}}
 	for _, deptDB := range dept.databases() {
-		if !deptDB.Exists() {
+		if deptDB != nil && !deptDB.Exists() {
 			return nil, errors.New(fmt.Sprintf("database %v missing", deptDB.Name))
 		}
 	}
+	var error error
+	dept.blobs, error = ParseBlobStore(dept.BlobStoreSpec(), ns,
+		dbs[uploadsSuffix])
+	if error != nil {
+		return nil, error
+	}
 	return dept, nil
 }
 
-func (self *Dept) Delete() {
+// Delete permanently deletes every database of the department. See also
+// SoftDelete.
+func (self *Dept) Delete() error {
+	firstErr := self.deleteBlobs()
+	if firstErr != nil {
+		firstErr = fmt.Errorf("deleting uploads: %v", firstErr)
+	}
 	for _, deptDB := range self.databases() {
 		if deptDB != nil {
-			deptDB.DeleteDatabase()
+			err := deptDB.DeleteDatabase()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("deleting %v: %v", deptDB.Name, err)
+			}
 		}
 	}
+	return firstErr
 }
 
 func (self *Dept) Applications(revId string) ([]map[string]interface{},
@@ -295,6 +320,19 @@ func (self *Dept) Applications(revId string) ([]map[string]interface{},
 	if err != nil {
 		return nil, err
 	}
+	var letters LettersResult
+	err = self.lettersDB.Query("_all_docs", includeDocs, &letters)
+	if err != nil {
+		return nil, err
+	}
+	form := self.EvaluationForm()
+	var evals []Evaluation
+	if form != nil {
+		evals, err = self.Evaluations("")
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	appMap := make(map[string]map[string]interface{},
 		int(apps["total_rows"].(float64)))
@@ -306,11 +344,14 @@ func (self *Dept) Applications(revId string) ([]map[string]interface{},
 		appMap[id]["highlight"] = make([]string, 0, 1)
 	}
 
-  // As reported by students. Assumes that there is a
-  // record in applicants for each record in fromApp
+  // As reported by students. Records without an application are skipped;
+  // 'apply2 fsck' reports them.
   for _, row := range fromApps["rows"].([]interface{}) {
     fromApp := row.(map[string]interface{})["doc"].(map[string]interface{})
     id := fromApp["_id"].(string)
+    if appMap[id] == nil {
+      continue
+    }
     appMap[id]["areas"] = fromApp["areas"]
     appMap[id]["faculty"] = fromApp["faculty"]
     program, found := fromApp["program"]
@@ -323,6 +364,9 @@ func (self *Dept) Applications(revId string) ([]map[string]interface{},
 		row := rawRow.(map[string]interface{})
 		score := row["doc"].(map[string]interface{})
 		app := appMap[score["appId"].(string)]
+		if app == nil {
+			continue
+		}
 		label := "score_" + score["label"].(string)
 		reviewer := score["revId"].(string)
 		val := score["score"].(float64)
@@ -334,14 +378,32 @@ func (self *Dept) Applications(revId string) ([]map[string]interface{},
 		}
 	}
 	for _, row := range highlights.Rows {
+		if appMap[row.Value.AppId] == nil {
+			continue
+		}
 		prev := appMap[row.Value.AppId]["highlight"].([]string)
 		appMap[row.Value.AppId]["highlight"] = append(prev, row.Value.WriterId)
 	}
 	for _, row := range avgs.Rows {
+		if appMap[row.Key] == nil {
+			continue
+		}
 		for label, value := range row.Value {
 			appMap[row.Key]["avgscore_"+label] = value.Avg
 		}
 	}
+	addLetterCounts(appMap, letters)
+	if form != nil {
+		addEvaluationSummaries(appMap, form, evals)
+	}
+	err = self.addAnnotationCounts(appMap)
+	if err != nil {
+		return nil, err
+	}
+	err = self.addPreviews(appMap)
+	if err != nil {
+		return nil, err
+	}
 
 	i := 0
 	result := make([]map[string]interface{}, len(appMap))
@@ -357,6 +419,22 @@ func (self *Dept) NewApplication(app Application) (err error) {
 	return
 }
 
+// PutApplication creates the application id or, if it exists, overwrites the
+// fields that app sets and keeps the rest (e.g., its materials).
+func (self *Dept) PutApplication(id string, app map[string]interface{}) error {
+	var old map[string]interface{}
+	rev, err := self.appDB.Retrieve(id, &old)
+	if err != nil {
+		_, _, err = self.appDB.InsertWith(app, id)
+		return err
+	}
+	for key, val := range app {
+		old[key] = val
+	}
+	_, err = self.appDB.EditWith(old, id, rev)
+	return err
+}
+
 func (self *Dept) NewReviewer(id ReviewerId, name string, pw string) (*Reviewer, error) {
 	ret := &Reviewer{Id: id, Name: name, PasswordHash: util.HashString(pw)}
 	_, _, err := self.reviewerDB.Insert(*ret)
@@ -374,6 +452,14 @@ func (self *Dept) AuthReviewer(id ReviewerId, pw string) (*Reviewer, error) {
 		return nil, err
 	}
 
+	if len(rev.PasswordSalt) > 0 {
+		if !util.CheckPassword(pw, rev.PasswordSalt, rev.PasswordHash) {
+			log.Printf("AuthReviewer(%v, _) - invalid password", id)
+			return nil, errors.New("invalid password")
+		}
+		return &rev, nil
+	}
+
  // If you remove the "if true", the code stops working! I don't know why!!!
   if true {
     l, err := ldap.DialSSL("tcp", "directory.cs.umass.edu:636")
@@ -402,16 +488,60 @@ func (self *Dept) GetReviewerById(revId ReviewerId) (*Reviewer, error) {
 	return &rev, nil
 }
 
-// NewComment does not authenticate its arguments
+func (self *Dept) SetChair(revId ReviewerId, chair bool) error {
+	return self.updateReviewer(revId, func(rev *Reviewer) {
+		rev.Chair = chair
+	})
+}
+
+// NewComment does not authenticate its arguments, but a reply must be to a
+// comment on the same application. Replies to comments that not every
+// reviewer may read are as restricted as the comment; see replyTo. Sets
+// comment.Id and renders comment.HTML.
 func (self *Dept) NewComment(comment *Comment) error {
-	_, _, err := self.commentsDB.Insert(comment)
+	if len(comment.Text) > MaxCommentLength {
+		return ErrCommentTooLong
+	}
+	if !validVisibility(comment.Visibility) {
+		return fmt.Errorf("invalid visibility %q", comment.Visibility)
+	}
+	if comment.ParentId != "" {
+		parent, _, err := self.getComment(comment.ParentId)
+		if err != nil || parent.ApplicantId != comment.ApplicantId {
+			return fmt.Errorf("no comment %v on %v", comment.ParentId,
+				comment.ApplicantId)
+		}
+		comment.replyTo(parent)
+	}
+	comment.Replies = nil
+	comment.HTML = markdown.Render(comment.Text)
+	id, _, err := self.commentsDB.Insert(comment)
 	if err != nil {
 		return err
 	}
+	comment.Id = id
 	return nil
 }
 
-func (self *Dept) LoadComments(appId string) ([]Comment, error) {
+// LoadComments returns the comments on the application that viewer may read
+// as threads: the comments that are not replies, each with its replies. A nil
+// viewer reads only the comments that every reviewer may read.
+func (self *Dept) LoadComments(appId string, viewer *Reviewer) ([]Comment,
+	error) {
+	comments, err := self.loadComments(appId)
+	if err != nil {
+		return nil, err
+	}
+	var visible []Comment
+	for _, c := range comments {
+		if c.VisibleTo(viewer) {
+			visible = append(visible, c)
+		}
+	}
+	return commentThreads(visible), nil
+}
+
+func (self *Dept) loadComments(appId string) ([]Comment, error) {
 	var result CommentsResult
 	query := map[string](interface{}){"key": appId, "include_docs": true}
 	err := self.commentsDB.Query("_design/myviews/_view/byAppId", query, &result)
@@ -522,46 +652,31 @@ func (self *Dept) SetScore(score *Score) error {
 	return err
 }
 
-func (self *Dept) URLOfUpload(name string) string {
-	return fmt.Sprintf("http://%s:%s/%s/%s/file", 
-		self.uploadsDB.Host, self.uploadsDB.Port, self.uploadsDB.Name, name)	
-}
-
-// name is the name to use on the server and path is the relative path to
-// the file on disk. In many 
-func (self *Dept) UploadFile(name string, path string) error {
-	file, err := os.Open(path)
+// AddMaterial links the upload called name to the application appId. field is
+// "materials" or "recs", the lists the client displays, and text is the label
+// shown for the link. Adding a link that is already present does nothing.
+func (self *Dept) AddMaterial(appId string, field string, name string,
+	text string) error {
+	var app map[string]interface{}
+	rev, err := self.appDB.Retrieve(appId, &app)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", self.URLOfUpload(name), file)
-	if err != nil {
-		return err
-	}
-
-	req.Header["Content-Type"] = []string{"application/pdf"}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("got status %d from CouchDB. Full response: %v",
-			resp.StatusCode, resp)
+	mats, _ := app[field].([]interface{})
+	for _, mat := range mats {
+		m, ok := mat.(map[string]interface{})
+		if ok && m["url"] == name {
+			return nil
+		}
 	}
-
-	return nil
-}
-
-func (self *Dept) DownloadFile(name string, w http.ResponseWriter) error {
-	resp, err := http.Get(self.URLOfUpload(name))
+	upload, err := self.OpenUpload(name)
 	if err != nil {
 		return err
 	}
-	// Using http.ServeContent would play better with caching
-	_, err = io.Copy(w, resp.Body)
+	upload.Close()
+	app[field] = append(mats, URL{Text: &text, URL: &name,
+		Validation: upload.Validation})
+	_, err = self.appDB.EditWith(app, appId, rev)
 	return err
 }
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A Namespace names one department's databases for one admissions cycle,
+// e.g., "cs/2014". Its databases are named "cs_2014_applications",
+// "cs_2014_reviewers", and so on. The empty namespace names the databases of
+// a department created before there were namespaces, which have no prefix.
+type Namespace string
+
+var deptNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+var cycleRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// NewNamespace returns the namespace of dept in cycle. The cycle may be empty
+// for a department that does not keep cycles apart. Both must be empty for
+// the legacy, unprefixed namespace.
+func NewNamespace(dept, cycle string) (Namespace, error) {
+	if dept == "" {
+		if cycle != "" {
+			return "", fmt.Errorf("cycle %q given without a department", cycle)
+		}
+		return "", nil
+	}
+	if !deptNameRegexp.MatchString(dept) {
+		return "", fmt.Errorf("invalid department %q (use lowercase letters, "+
+			"digits and dashes, starting with a letter)", dept)
+	}
+	if cycle == "" {
+		return Namespace(dept), nil
+	}
+	if !cycleRegexp.MatchString(cycle) {
+		return "", fmt.Errorf("invalid cycle %q (use lowercase letters, "+
+			"digits and dashes)", cycle)
+	}
+	return Namespace(dept + "/" + cycle), nil
+}
+
+// ParseNamespace parses a namespace written as "DEPT/CYCLE" or "DEPT".
+func ParseNamespace(s string) (Namespace, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 1 {
+		return NewNamespace(parts[0], "")
+	}
+	return NewNamespace(parts[0], parts[1])
+}
+
+func (ns Namespace) Dept() string {
+	return strings.SplitN(string(ns), "/", 2)[0]
+}
+
+func (ns Namespace) Cycle() string {
+	parts := strings.SplitN(string(ns), "/", 2)
+	if len(parts) == 1 {
+		return ""
+	}
+	return parts[1]
+}
+
+// dbName returns the name of the database with the given suffix. Department
+// and cycle names cannot contain underscores, so the prefix is unambiguous.
+func (ns Namespace) dbName(suffix string) string {
+	if ns == "" {
+		return suffix
+	}
+	return strings.Replace(string(ns), "/", "_", -1) + "_" + suffix
+}
+
+// namespaceOf returns the namespace whose applications database is dbName.
+func namespaceOf(dbName string) (Namespace, bool) {
+	if dbName == applicationsSuffix {
+		return "", true
+	}
+	if !strings.HasSuffix(dbName, "_"+applicationsSuffix) {
+		return "", false
+	}
+	prefix := strings.TrimSuffix(dbName, "_"+applicationsSuffix)
+	ns, err := ParseNamespace(strings.Replace(prefix, "_", "/", 1))
+	if err != nil {
+		return "", false
+	}
+	return ns, true
+}
+
+// ListNamespaces returns the namespaces of every department on the CouchDB
+// server.
+func ListNamespaces(host, port string) ([]Namespace, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%s/_all_dbs", host, port))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d from CouchDB listing databases",
+			resp.StatusCode)
+	}
+	var names []string
+	err = json.NewDecoder(resp.Body).Decode(&names)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	for _, name := range names {
+		if ns, ok := namespaceOf(name); ok {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,46 @@
+package model
+
+import "testing"
+
+func TestNamespaces(t *testing.T) {
+	tests := []struct {
+		dept, cycle string
+		ns          Namespace
+		db          string
+	}{
+		{"", "", "", "applications"},
+		{"cs", "", "cs", "cs_applications"},
+		{"cs", "2014", "cs/2014", "cs_2014_applications"},
+		{"math-stats", "fall-2014", "math-stats/fall-2014",
+			"math-stats_fall-2014_applications"},
+	}
+	for _, test := range tests {
+		ns, err := NewNamespace(test.dept, test.cycle)
+		if err != nil || ns != test.ns {
+			t.Errorf("NewNamespace(%q, %q) = %q, %v", test.dept, test.cycle, ns, err)
+			continue
+		}
+		if db := ns.dbName(applicationsSuffix); db != test.db {
+			t.Errorf("%q names database %v, expected %v", ns, db, test.db)
+		}
+		if back, ok := namespaceOf(test.db); !ok || back != ns {
+			t.Errorf("namespaceOf(%v) = %q, %v", test.db, back, ok)
+		}
+		if ns.Dept() != test.dept || ns.Cycle() != test.cycle {
+			t.Errorf("%q has dept %q and cycle %q", ns, ns.Dept(), ns.Cycle())
+		}
+	}
+
+	for _, bad := range [][2]string{{"CS", ""}, {"c_s", ""}, {"2014", ""},
+		{"", "2014"}, {"cs", "20_14"}} {
+		if _, err := NewNamespace(bad[0], bad[1]); err == nil {
+			t.Errorf("NewNamespace(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+	for _, name := range []string{"reviewers", "cs_2014_reviewers",
+		"from-applicants", "a_b_c_applications"} {
+		if ns, ok := namespaceOf(name); ok {
+			t.Errorf("namespaceOf(%v) = %q", name, ns)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mailer"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of notification.
+const NotifyHighlight = "highlight"
+const NotifyMention = "mention"
+const NotifyReply = "reply"
+const NotifyAssigned = "assigned"
+const NotifyUnassigned = "unassigned"
+
+var notifyKinds = []string{NotifyHighlight, NotifyMention, NotifyReply,
+	NotifyAssigned, NotifyUnassigned}
+
+// How a reviewer is emailed about notifications.
+const NotifyImmediate = "immediate"
+const NotifyDaily = "daily"
+const NotifyNever = "never"
+
+// A Notification tells a reviewer that another reviewer did something that
+// concerns them. Notifications are stored for every reviewer, who reads them
+// in the client; Mailed records whether the reviewer has been emailed, or need
+// not be.
+type Notification struct {
+	Id       string     `json:"_id,omitempty"`
+	RevId    ReviewerId `json:"revId"`
+	Kind     string     `json:"kind"`
+	AppId    string     `json:"appId"`
+	AppName  string     `json:"appName,omitempty"`
+	FromId   ReviewerId `json:"fromId"`
+	FromName string     `json:"fromName"`
+	// The comment, for mentions and replies, and its current text, which
+	// Unread and emails fill in.
+	CommentId string    `json:"commentId,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Time      time.Time `json:"time"`
+	Mailed    bool      `json:"mailed,omitempty"`
+	Read      bool      `json:"read,omitempty"`
+	// Set if notify began emailing it right away; see SendDigests.
+	Immediate bool `json:"immediate,omitempty"`
+}
+
+// NotifyPrefs are a reviewer's email preferences. Reviewers without
+// preferences get a daily digest of every kind of notification.
+type NotifyPrefs struct {
+	Email string `json:"email"`
+	// Kinds of notification the reviewer is not emailed about.
+	Mute []string `json:"mute,omitempty"`
+}
+
+var defaultNotifyPrefs = NotifyPrefs{Email: NotifyDaily}
+
+func (self *Reviewer) NotifyPrefs() NotifyPrefs {
+	if self.Notify == nil {
+		return defaultNotifyPrefs
+	}
+	return *self.Notify
+}
+
+// wantsEmail reports whether the reviewer is emailed about notifications of
+// the given kind, in mode NotifyImmediate or NotifyDaily, or not at all.
+func (self *Reviewer) wantsEmail(kind string) string {
+	prefs := self.NotifyPrefs()
+	if self.Email == "" || self.Disabled {
+		return NotifyNever
+	}
+	for _, muted := range prefs.Mute {
+		if muted == kind {
+			return NotifyNever
+		}
+	}
+	return prefs.Email
+}
+
+func (self *Dept) SetNotifyPrefs(revId ReviewerId, prefs NotifyPrefs) error {
+	switch prefs.Email {
+	case NotifyImmediate, NotifyDaily, NotifyNever:
+	default:
+		return fmt.Errorf("invalid email preference %q", prefs.Email)
+	}
+	for _, kind := range prefs.Mute {
+		if !knownKind(kind) {
+			return fmt.Errorf("unknown kind of notification %q", kind)
+		}
+	}
+	return self.updateReviewer(revId, func(rev *Reviewer) {
+		rev.Notify = &prefs
+	})
+}
+
+func knownKind(kind string) bool {
+	for _, k := range notifyKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// A Mailer emails notifications on behalf of the server. URL is the address
+// of the site, linked from each email.
+type Mailer struct {
+	Transport mailer.Transport
+	From      string
+	URL       string
+}
+
+var mentionPattern = regexp.MustCompile(`(^|[^\w.])@([\w.-]*\w)`)
+
+// mentions returns the ids of the reviewers that text mentions as @id.
+func mentions(text string, reviewers map[string]string) []ReviewerId {
+	var ids []ReviewerId
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		id := m[2]
+		if _, found := reviewers[id]; found && !seen[id] {
+			seen[id] = true
+			ids = append(ids, ReviewerId(id))
+		}
+	}
+	return ids
+}
+
+func (self *Dept) appName(appId string) string {
+	var app map[string]interface{}
+	_, err := self.appDB.Retrieve(appId, &app)
+	if err != nil {
+		return ""
+	}
+	first, _ := app["firstName"].(string)
+	last, _ := app["lastName"].(string)
+	return strings.TrimSpace(first + " " + last)
+}
+
+// NotifyHighlight notifies the reader of a highlight.
+func (self *Dept) NotifyHighlight(hl *Highlight, m *Mailer) error {
+	return self.notify(&Notification{
+		RevId:    hl.ReaderId,
+		Kind:     NotifyHighlight,
+		AppId:    hl.ApplicationId,
+		FromId:   hl.WriterId,
+		FromName: hl.WriterName,
+	}, m)
+}
+
+// NotifyAssignment notifies the reviewer that a chair assigned them to the
+// application or, if assigned is false, unassigned them from it.
+func (self *Dept) NotifyAssignment(a *Assignment, assigned bool,
+	m *Mailer) error {
+	kind := NotifyAssigned
+	if !assigned {
+		kind = NotifyUnassigned
+	}
+	return self.notify(&Notification{
+		RevId:    a.RevId,
+		Kind:     kind,
+		AppId:    a.AppId,
+		FromId:   a.AssignerId,
+		FromName: a.AssignerName,
+	}, m)
+}
+
+// NotifyComment notifies the reviewers that a comment mentions and, if it is
+// a reply, the author of the comment it replies to, of those who may read it.
+func (self *Dept) NotifyComment(comment *Comment, m *Mailer) error {
+	reviewers, err := self.GetReviewerIdMap()
+	if err != nil {
+		return err
+	}
+	kinds := make(map[ReviewerId]string)
+	var ids []ReviewerId
+	if comment.ParentId != "" {
+		parent, _, err := self.getComment(comment.ParentId)
+		if err == nil && !parent.Deleted {
+			kinds[parent.ReviewerId] = NotifyReply
+			ids = append(ids, parent.ReviewerId)
+		}
+	}
+	for _, id := range mentions(comment.Text, reviewers) {
+		if _, found := kinds[id]; !found {
+			ids = append(ids, id)
+		}
+		kinds[id] = NotifyMention
+	}
+	for _, id := range ids {
+		rev, err := self.GetReviewerById(id)
+		if err != nil || !comment.VisibleTo(rev) {
+			continue
+		}
+		err = self.notify(&Notification{
+			RevId:     id,
+			Kind:      kinds[id],
+			AppId:     comment.ApplicantId,
+			FromId:    comment.ReviewerId,
+			FromName:  comment.ReviewerName,
+			CommentId: comment.Id,
+		}, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify stores the notification and, if the recipient wants it right away
+// and m is not nil, emails it in the background, so that a slow mail server
+// does not hold up the request. Otherwise, or if that fails, SendDigests
+// emails it later. Reviewers are not notified of what they do themselves.
+func (self *Dept) notify(n *Notification, m *Mailer) error {
+	if n.RevId == n.FromId {
+		return nil
+	}
+	rev, err := self.GetReviewerById(n.RevId)
+	if err != nil {
+		return fmt.Errorf("no reviewer %v", n.RevId)
+	}
+	n.Time = time.Now()
+	n.AppName = self.appName(n.AppId)
+	mode := rev.wantsEmail(n.Kind)
+	n.Mailed = mode == NotifyNever
+	n.Immediate = mode == NotifyImmediate && m != nil
+	id, _, err := self.notificationsDB.Insert(n)
+	if err != nil {
+		return err
+	}
+	if n.Immediate {
+		mailed := *n
+		mailed.Id = id
+		go self.mailNow(rev, &mailed, m)
+	}
+	return nil
+}
+
+// mailNow emails the stored notification n, unless its comment has been
+// deleted since, and marks it mailed.
+func (self *Dept) mailNow(rev *Reviewer, n *Notification, m *Mailer) {
+	notes := self.withComments([]Notification{*n})
+	if len(notes) > 0 {
+		err := m.send(rev, notes)
+		if err != nil {
+			log.Printf("ERROR emailing %v: %v", rev.Id, err)
+			return
+		}
+	}
+	err := self.updateNotification(n.Id, func(n *Notification) {
+		n.Mailed = true
+	})
+	if err != nil {
+		log.Printf("ERROR marking notification %v mailed: %v", n.Id, err)
+	}
+}
+
+func (self *Notification) describe() string {
+	app := self.AppName
+	if app == "" {
+		app = self.AppId
+	}
+	switch self.Kind {
+	case NotifyHighlight:
+		return fmt.Sprintf("%v highlighted %v for you.", self.FromName, app)
+	case NotifyAssigned:
+		return fmt.Sprintf("%v assigned you to review %v.", self.FromName, app)
+	case NotifyUnassigned:
+		return fmt.Sprintf("%v unassigned you from %v.", self.FromName, app)
+	case NotifyMention, NotifyReply:
+		verb := "mentioned you on"
+		if self.Kind == NotifyReply {
+			verb = "replied to your comment on"
+		}
+		return fmt.Sprintf("%v %v %v:\n\n    %v", self.FromName, verb, app,
+			strings.Replace(self.Text, "\n", "\n    ", -1))
+	}
+	return fmt.Sprintf("%v: %v on %v", self.Kind, self.FromName, app)
+}
+
+// send emails the notifications to rev in one message.
+func (self *Mailer) send(rev *Reviewer, notes []Notification) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Hello %v,\n\n", rev.Name)
+	for _, n := range notes {
+		fmt.Fprintf(&body, "%v\n\n", n.describe())
+	}
+	fmt.Fprintf(&body, "Apply2: %v/disembark.html\n\n", strings.TrimRight(
+		self.URL, "/"))
+	fmt.Fprintf(&body, "To change how often you get these emails, use the "+
+		"\"Email me\" menu in Apply2.\n")
+	subject := "Apply2: " + notes[0].describe()
+	if i := strings.Index(subject, "\n"); i >= 0 {
+		subject = strings.TrimSuffix(subject[:i], ":")
+	}
+	if len(notes) > 1 {
+		subject = fmt.Sprintf("Apply2: %v notifications", len(notes))
+	}
+	return self.Transport.Send(&mailer.Message{
+		From:    self.From,
+		To:      rev.Email,
+		Subject: subject,
+		Body:    body.String(),
+	})
+}
+
+type NotificationsResult struct {
+	Rows []struct {
+		Doc Notification `json:"doc"`
+	} `json:"rows"`
+}
+
+type notificationsByTime []Notification
+
+func (self notificationsByTime) Len() int { return len(self) }
+func (self notificationsByTime) Less(i, j int) bool {
+	return self[i].Time.Before(self[j].Time)
+}
+func (self notificationsByTime) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+
+// How long notify may take to email a notification right away, after which
+// SendDigests assumes it failed.
+const immediateGrace = 2 * mailer.SMTPTimeout
+
+// SendDigests emails each reviewer the notifications they have not been
+// emailed about, in one message, and returns the number of messages sent.
+// Run it daily, e.g., with 'apply2 digest' from cron. It also sends
+// immediate notifications that could not be sent when they happened, but not
+// those still being sent.
+func (self *Dept) SendDigests(m *Mailer) (int, error) {
+	var r NotificationsResult
+	err := self.notificationsDB.Query("_design/myviews/_view/unmailed",
+		includeDocs, &r)
+	if err != nil {
+		return 0, err
+	}
+	byRev := make(map[ReviewerId][]Notification)
+	var revIds []string
+	for _, row := range r.Rows {
+		n := row.Doc
+		if n.Immediate && time.Since(n.Time) < immediateGrace {
+			continue
+		}
+		if _, found := byRev[n.RevId]; !found {
+			revIds = append(revIds, string(n.RevId))
+		}
+		byRev[n.RevId] = append(byRev[n.RevId], n)
+	}
+	sort.Strings(revIds)
+
+	sent := 0
+	var firstErr error
+	for _, id := range revIds {
+		notes := byRev[ReviewerId(id)]
+		sort.Sort(notificationsByTime(notes))
+		rev, err := self.GetReviewerById(ReviewerId(id))
+		if err == nil {
+			// Preferences may have changed since the notifications were stored.
+			var wanted []Notification
+			for _, n := range self.withComments(notes) {
+				if rev.wantsEmail(n.Kind) != NotifyNever {
+					wanted = append(wanted, n)
+				}
+			}
+			if len(wanted) > 0 {
+				err = m.send(rev, wanted)
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("emailing %v: %v", id, err)
+					}
+					continue
+				}
+				sent++
+			}
+		}
+		// Reviewers who have been deleted are not emailed.
+		for _, n := range notes {
+			err = self.updateNotification(n.Id, func(n *Notification) {
+				n.Mailed = true
+			})
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return sent, firstErr
+}
+
+// How many times updateNotification tries to write a notification that
+// others are updating too.
+const notificationAttempts = 5
+
+// updateNotification applies update to the stored notification id. It reads
+// the notification afresh, so that update changes only what it sets, and
+// tries again if the notification changes before it is written.
+func (self *Dept) updateNotification(id string,
+	update func(n *Notification)) error {
+	var err error
+	for i := 0; i < notificationAttempts; i++ {
+		var n Notification
+		var rev string
+		rev, err = self.notificationsDB.Retrieve(id, &n)
+		if err != nil {
+			return err
+		}
+		update(&n)
+		_, err = self.notificationsDB.EditWith(n, id, rev)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// withComments fills in the current text of the comments of notes, and
+// drops the notes whose comments have been deleted.
+func (self *Dept) withComments(notes []Notification) []Notification {
+	filled := make([]Notification, 0, len(notes))
+	for _, n := range notes {
+		if n.CommentId != "" {
+			comment, _, err := self.getComment(n.CommentId)
+			if err != nil || comment.Deleted {
+				continue
+			}
+			n.Text = comment.Text
+		}
+		filled = append(filled, n)
+	}
+	return filled
+}
+
+// Unread returns the reviewer's unread notifications, newest first, without
+// those about comments that have been deleted.
+func (self *Dept) Unread(revId ReviewerId) ([]Notification, error) {
+	notes, err := self.unread(revId)
+	if err != nil {
+		return nil, err
+	}
+	return self.withComments(notes), nil
+}
+
+func (self *Dept) unread(revId ReviewerId) ([]Notification, error) {
+	var r NotificationsResult
+	err := self.notificationsDB.Query("_design/myviews/_view/unread",
+		map[string]interface{}{"key": revId, "reduce": false,
+			"include_docs": true}, &r)
+	if err != nil {
+		return nil, err
+	}
+	notes := make([]Notification, len(r.Rows))
+	for i, row := range r.Rows {
+		notes[i] = row.Doc
+	}
+	sort.Sort(sort.Reverse(notificationsByTime(notes)))
+	return notes, nil
+}
+
+// UnreadCount returns the number of notifications that Unread returns.
+func (self *Dept) UnreadCount(revId ReviewerId) (int, error) {
+	notes, err := self.Unread(revId)
+	return len(notes), err
+}
+
+// MarkRead marks the reviewer's notifications with the given ids as read, or
+// all of them if ids is empty. Ids of other reviewers' notifications are
+// ignored.
+func (self *Dept) MarkRead(revId ReviewerId, ids []string) error {
+	unread, err := self.unread(revId)
+	if err != nil {
+		return err
+	}
+	marked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		marked[id] = true
+	}
+	for _, n := range unread {
+		if len(ids) > 0 && !marked[n.Id] {
+			continue
+		}
+		err = self.updateNotification(n.Id, func(n *Notification) {
+			n.Read = true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
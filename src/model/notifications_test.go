@@ -0,0 +1,102 @@
+package model
+
+import (
+	"mailer"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	reviewers := map[string]string{"scooby": "Scooby Doo", "fred.j": "Fred Jones"}
+	tests := []struct {
+		text     string
+		expected []ReviewerId
+	}{
+		{"@scooby, what do you think?", []ReviewerId{"scooby"}},
+		{"ask @fred.j. Or @scooby and @scooby", []ReviewerId{"fred.j", "scooby"}},
+		{"email scooby@cs.umass.edu", nil},
+		{"@shaggy is not a reviewer", nil},
+	}
+	for _, test := range tests {
+		got := mentions(test.text, reviewers)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("mentions(%q) = %v, expected %v", test.text, got,
+				test.expected)
+		}
+	}
+}
+
+type sinkTransport struct {
+	sent []*mailer.Message
+}
+
+func (self *sinkTransport) Send(msg *mailer.Message) error {
+	self.sent = append(self.sent, msg)
+	return nil
+}
+
+func TestMailerSend(t *testing.T) {
+	sink := &sinkTransport{}
+	m := &Mailer{Transport: sink, From: "apply2@example.com",
+		URL: "https://apply.example.com/"}
+	rev := &Reviewer{Id: "scooby", Name: "Scooby Doo", Email: "scooby@example.com"}
+	notes := []Notification{
+		{Kind: NotifyMention, AppName: "Velma Dinkley", FromName: "Fred Jones",
+			Text: "@scooby\nlooks strong"},
+	}
+	m.send(rev, notes)
+	msg := sink.sent[0]
+	if msg.Subject != "Apply2: Fred Jones mentioned you on Velma Dinkley" {
+		t.Errorf("subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.Body, "    @scooby\n    looks strong") ||
+		!strings.Contains(msg.Body, "https://apply.example.com/disembark.html") {
+		t.Errorf("body %q", msg.Body)
+	}
+
+	notes = append(notes, Notification{Kind: NotifyHighlight, AppId: "42",
+		FromName: "Fred Jones"})
+	m.send(rev, notes)
+	if msg := sink.sent[1]; msg.Subject != "Apply2: 2 notifications" ||
+		!strings.Contains(msg.Body, "Fred Jones highlighted 42 for you.") {
+		t.Errorf("digest %q: %q", msg.Subject, msg.Body)
+	}
+}
+
+func TestWantsEmail(t *testing.T) {
+	rev := &Reviewer{Email: "scooby@example.com"}
+	if mode := rev.wantsEmail(NotifyHighlight); mode != NotifyDaily {
+		t.Errorf("default mode %v", mode)
+	}
+	rev.Notify = &NotifyPrefs{Email: NotifyImmediate, Mute: []string{NotifyMention}}
+	if mode := rev.wantsEmail(NotifyMention); mode != NotifyNever {
+		t.Errorf("muted kind has mode %v", mode)
+	}
+	rev.Email = ""
+	if mode := rev.wantsEmail(NotifyHighlight); mode != NotifyNever {
+		t.Errorf("reviewer without email has mode %v", mode)
+	}
+}
+
+func TestDescribeAssignment(t *testing.T) {
+	tests := []struct {
+		n        Notification
+		expected string
+	}{
+		{Notification{Kind: NotifyAssigned, AppName: "Velma Dinkley",
+			FromName: "Fred Jones"},
+			"Fred Jones assigned you to review Velma Dinkley."},
+		{Notification{Kind: NotifyUnassigned, AppId: "42",
+			FromName: "Fred Jones"},
+			"Fred Jones unassigned you from 42."},
+	}
+	for _, test := range tests {
+		if got := test.n.describe(); got != test.expected {
+			t.Errorf("describe() = %q, expected %q", got, test.expected)
+		}
+		if !knownKind(test.n.Kind) {
+			t.Errorf("%v is not a known kind", test.n.Kind)
+		}
+	}
+}
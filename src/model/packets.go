@@ -0,0 +1,345 @@
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"pdf"
+	"sort"
+	"strings"
+)
+import db "code.google.com/p/couch-go"
+
+const packetOrderSetting = "packetOrder"
+
+// Bump to rebuild every cached packet, e.g., when the cover page changes.
+const packetVersion = 1
+
+// DefaultPacketOrder is the order of materials in packets of departments that
+// have not set one. See SetPacketOrder.
+var DefaultPacketOrder = []string{"Application", "Personal statement",
+	"Resume", "Transcript", "Writing sample", "Test scores", "Recommendation"}
+
+// PacketOrder returns the prefixes of material labels in the order that
+// packets include materials.
+func (self *Dept) PacketOrder() []string {
+	var setting struct {
+		Order []string `json:"order"`
+	}
+	_, err := self.getSetting(packetOrderSetting, &setting)
+	if err != nil || len(setting.Order) == 0 {
+		return DefaultPacketOrder
+	}
+	return setting.Order
+}
+
+// SetPacketOrder sets the order of materials in packets. Materials are
+// ordered by the first prefix of their label in order, ignoring case;
+// materials that match no prefix come last, in the order the application
+// lists them.
+func (self *Dept) SetPacketOrder(order []string) error {
+	for _, prefix := range order {
+		if strings.TrimSpace(prefix) == "" {
+			return errors.New("empty label prefix")
+		}
+	}
+	return self.putSetting(packetOrderSetting,
+		map[string]interface{}{"order": order})
+}
+
+type packetMaterial struct {
+	Title  string
+	Upload string
+}
+
+type materialsByRank struct {
+	mats  []packetMaterial
+	ranks []int
+}
+
+func (self materialsByRank) Len() int           { return len(self.mats) }
+func (self materialsByRank) Less(i, j int) bool { return self.ranks[i] < self.ranks[j] }
+func (self materialsByRank) Swap(i, j int) {
+	self.mats[i], self.mats[j] = self.mats[j], self.mats[i]
+	self.ranks[i], self.ranks[j] = self.ranks[j], self.ranks[i]
+}
+
+// packetMaterials returns the application's materials and recommendations in
+// packet order.
+func packetMaterials(app map[string]interface{},
+	order []string) []packetMaterial {
+	var mats []packetMaterial
+	var ranks []int
+	for _, field := range []string{"materials", "recs"} {
+		links, _ := app[field].([]interface{})
+		for _, link := range links {
+			m, _ := link.(map[string]interface{})
+			upload, _ := m["url"].(string)
+			if upload == "" {
+				continue
+			}
+			title, _ := m["text"].(string)
+			if title == "" {
+				title = upload
+			}
+			rank := len(order)
+			for i, prefix := range order {
+				if strings.HasPrefix(strings.ToLower(title),
+					strings.ToLower(prefix)) {
+					rank = i
+					break
+				}
+			}
+			mats = append(mats, packetMaterial{title, upload})
+			ranks = append(ranks, rank)
+		}
+	}
+	sort.Stable(materialsByRank{mats, ranks})
+	return mats
+}
+
+// Fields of the applicant record shown on the cover page, if present.
+var coverFields = []struct{ name, label string }{
+	{"personId", "Id"},
+	{"email", "Email"},
+	{"country", "Country"},
+	{"undergradGPA", "GPA"},
+	{"gradGPA", "GPA (Graduate)"},
+	{"newGREVerbal", "GRE Verbal"},
+	{"newGREMath", "GRE Math"},
+	{"greAnalytic", "GRE Analytic"},
+	{"oldGREVerbal", "GRE Verbal (Old)"},
+	{"oldGREMath", "GRE Math (Old)"},
+}
+
+func coverValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i, elt := range v {
+			strs[i] = fmt.Sprint(elt)
+		}
+		return strings.Join(strs, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+// coverPage returns the title and lines of the applicant's cover page.
+func (self *Dept) coverPage(appId string, app map[string]interface{},
+	mats []packetMaterial) (string, []string, error) {
+	var fromApp map[string]interface{}
+	_, err := self.fromApplicantsDB.Retrieve(appId, &fromApp)
+	if err != nil {
+		fromApp = nil
+	}
+	var avgs struct {
+		Rows []struct {
+			Value map[string]struct {
+				Len int     `json:"len"`
+				Avg float64 `json:"avg"`
+			} `json:"value"`
+		} `json:"rows"`
+	}
+	err = self.scoresDB.Query("_design/myviews/_view/averages",
+		map[string]interface{}{"key": appId, "group": true}, &avgs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	title := strings.TrimSpace(coverValue(app["firstName"]) + " " +
+		coverValue(app["lastName"]))
+	if title == "" {
+		title = appId
+	}
+	var lines []string
+	line := func(label string, v interface{}) {
+		if s := coverValue(v); s != "" {
+			lines = append(lines, label+": "+s)
+		}
+	}
+	program := app["program"]
+	if fromApp["program"] != nil {
+		program = fromApp["program"]
+	}
+	line("Program", program)
+	line("Areas", fromApp["areas"])
+	line("Faculty", fromApp["faculty"])
+	for _, field := range coverFields {
+		line(field.label, app[field.name])
+	}
+	if len(avgs.Rows) > 0 {
+		labels := make([]string, 0, len(avgs.Rows[0].Value))
+		for label := range avgs.Rows[0].Value {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			avg := avgs.Rows[0].Value[label]
+			line("Average "+label, fmt.Sprintf("%.1f (%v reviewers)", avg.Avg,
+				avg.Len))
+		}
+	}
+	lines = append(lines, "", "Materials:")
+	for _, mat := range mats {
+		lines = append(lines, "    "+mat.Title)
+	}
+	return title, lines, nil
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d from CouchDB", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// uploadETag returns the ETag that CouchDB reports for an upload, which
+// changes when the upload does.
+func (self *Dept) uploadETag(name string) string {
+	upload, err := self.OpenUpload(name)
+	if err != nil {
+		return ""
+	}
+	return upload.ETag
+}
+
+// Packet returns a PDF of the applicant's materials, in the order that
+// PacketOrder gives, after a cover page. Materials that cannot be read are
+// replaced by a page that says so. Packets are cached and rebuilt when the
+// materials or the cover page change.
+func (self *Dept) Packet(appId string) ([]byte, error) {
+	var app map[string]interface{}
+	_, err := self.appDB.Retrieve(appId, &app)
+	if err != nil {
+		return nil, fmt.Errorf("no application %v", appId)
+	}
+	mats := packetMaterials(app, self.PacketOrder())
+	title, cover, err := self.coverPage(appId, app, mats)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\n%v\n", packetVersion, title)
+	for _, line := range cover {
+		fmt.Fprintf(hash, "%v\n", line)
+	}
+	for _, mat := range mats {
+		fmt.Fprintf(hash, "%v\n%v\n", mat.Upload, self.uploadETag(mat.Upload))
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	var cached struct {
+		Key string `json:"key"`
+	}
+	_, err = self.packetsDB.Retrieve(appId, &cached)
+	if err == nil && cached.Key == key {
+		data, err := download(attachmentURL(self.packetsDB, appId,
+			"packet.pdf"))
+		if err == nil {
+			return data, nil
+		}
+		log.Printf("reading cached packet for %v: %v", appId, err)
+	}
+
+	var out bytes.Buffer
+	err = self.buildPacket(&out, title, cover, mats)
+	if err != nil {
+		return nil, err
+	}
+	err = self.cachePacket(appId, key, out.Bytes())
+	if err != nil {
+		log.Printf("caching packet for %v: %v", appId, err)
+	}
+	return out.Bytes(), nil
+}
+
+func (self *Dept) readUpload(name string) ([]byte, error) {
+	upload, err := self.OpenUpload(name)
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+	return ioutil.ReadAll(upload)
+}
+
+func (self *Dept) buildPacket(w io.Writer, title string, cover []string,
+	mats []packetMaterial) error {
+	b := pdf.NewBuilder()
+	b.AddText(title, cover)
+	for _, mat := range mats {
+		var doc *pdf.Document
+		data, err := self.readUpload(mat.Upload)
+		if err == nil {
+			doc, err = pdf.Read(data)
+		}
+		if err == nil {
+			err = b.AddDocument(mat.Title, doc)
+		}
+		if err != nil {
+			b.AddText(mat.Title, []string{
+				fmt.Sprintf("This material could not be included: %v.", err),
+				"Open it from the applicant's materials instead.",
+			})
+		}
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// cachePacket stores a packet as an attachment of the document appId in the
+// packets database, whose key field identifies what the packet was built
+// from.
+func (self *Dept) cachePacket(appId string, key string, data []byte) error {
+	return putAttachment(self.packetsDB, appId, map[string]interface{}{"key": key},
+		"packet.pdf", "application/pdf", data)
+}
+
+func attachmentURL(d *db.Database, id string, attachment string) string {
+	return fmt.Sprintf("http://%s:%s/%s/%s/%s", d.Host, d.Port, d.Name,
+		url.PathEscape(id), attachment)
+}
+
+// putAttachment creates or replaces the document id in d, with data attached
+// as attachment.
+func putAttachment(d *db.Database, id string, doc interface{},
+	attachment string, contentType string, data []byte) error {
+	err := putDoc(d, id, doc)
+	if err != nil {
+		return err
+	}
+	var old map[string]interface{}
+	rev, err := d.Retrieve(id, &old)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", attachmentURL(d, id, attachment)+
+		"?rev="+rev, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header["Content-Type"] = []string{contentType}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("got status %d from CouchDB", resp.StatusCode)
+	}
+	return nil
+}
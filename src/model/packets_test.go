@@ -0,0 +1,37 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPacketMaterials(t *testing.T) {
+	var app map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+	  "materials": [
+	    { "text": "Transcript", "url": "1-transcript.pdf" },
+	    { "text": "Portfolio", "url": "1-portfolio.pdf" },
+	    { "text": "resume (updated)", "url": "1-resume.pdf" },
+	    { "text": "Application", "url": "1-app.pdf" },
+	    { "text": "Broken" } ],
+	  "recs": [
+	    { "text": "Recommendation (Hopper)", "url": "1-rec.pdf" },
+	    { "url": "1-misc.pdf" } ] }`), &app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mats := packetMaterials(app, DefaultPacketOrder)
+	expected := []string{"1-app.pdf", "1-resume.pdf", "1-transcript.pdf",
+		"1-rec.pdf", "1-portfolio.pdf", "1-misc.pdf"}
+	if len(mats) != len(expected) {
+		t.Fatalf("packetMaterials = %v", mats)
+	}
+	for i, mat := range mats {
+		if mat.Upload != expected[i] {
+			t.Fatalf("packetMaterials = %v, expected uploads %v", mats, expected)
+		}
+	}
+	if mats[5].Title != "1-misc.pdf" {
+		t.Errorf("untitled material has title %q", mats[5].Title)
+	}
+}
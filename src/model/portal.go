@@ -0,0 +1,291 @@
+package model
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"util"
+)
+
+const applicantChoicesSetting = "applicantChoices"
+
+const DefaultApplicantLinkTTL = 30 * 24 * time.Hour
+
+// The most areas, and the most faculty, that an applicant may name, and the
+// longest name of either.
+const maxApplicantChoices = 5
+const maxChoiceLength = 100
+
+// The most submissions kept in an applicant's history. Older ones are
+// dropped, so that an applicant who submits again and again does not grow
+// their document without bound.
+const maxApplicantHistory = 20
+
+// ErrApplicantLink is returned for applicant links that have expired or been
+// replaced.
+var ErrApplicantLink = errors.New("this link has expired or been replaced")
+
+// An ApplicantLink lets an applicant tell the department their research
+// areas, the faculty they want to work with and their program; see
+// SubmitFromApplicant. Its link carries the nonce, and works until it expires
+// or the chair mints another.
+type ApplicantLink struct {
+	Nonce string `json:"nonce"`
+	// The chair who minted it; empty if it was minted with apply2.
+	MintedBy ReviewerId `json:"mintedBy,omitempty"`
+	Minted   time.Time  `json:"minted"`
+	Expires  time.Time  `json:"expires"`
+}
+
+// An ApplicantSubmission is what an applicant submits. The from-applicants
+// record of the applicant holds their latest submission, which Applications
+// shows, and every submission in its history.
+type ApplicantSubmission struct {
+	Areas     []string `json:"areas"`
+	Faculty   []string `json:"faculty"`
+	Program   string   `json:"program"`
+	Timestamp float64  `json:"timestamp"`
+}
+
+// ApplicantChoices lists what applicants may choose from. An empty list lets
+// applicants write their own.
+type ApplicantChoices struct {
+	Programs []string `json:"programs"`
+	Areas    []string `json:"areas"`
+	Faculty  []string `json:"faculty"`
+}
+
+// ApplicantChoices returns what applicants may choose from; see
+// SetApplicantChoices.
+func (self *Dept) ApplicantChoices() *ApplicantChoices {
+	var choices ApplicantChoices
+	self.getSetting(applicantChoicesSetting, &choices)
+	return &choices
+}
+
+// SetApplicantChoices sets what applicants may choose from. Submissions made
+// earlier are kept as they are.
+func (self *Dept) SetApplicantChoices(choices *ApplicantChoices) error {
+	for _, list := range [][]string{choices.Programs, choices.Areas,
+		choices.Faculty} {
+		seen := make(map[string]bool)
+		for _, choice := range list {
+			if strings.TrimSpace(choice) != choice || choice == "" ||
+				len(choice) > maxChoiceLength {
+				return fmt.Errorf("invalid choice %q", choice)
+			}
+			if seen[choice] {
+				return fmt.Errorf("%q is listed twice", choice)
+			}
+			seen[choice] = true
+		}
+	}
+	return self.putSetting(applicantChoicesSetting, choices)
+}
+
+// ApplicantName returns the applicant's name, or appId if their application
+// has none.
+func (self *Dept) ApplicantName(appId string) string {
+	var app map[string]interface{}
+	self.appDB.Retrieve(appId, &app)
+	name := strings.TrimSpace(coverValue(app["firstName"]) + " " +
+		coverValue(app["lastName"]))
+	if name == "" {
+		return appId
+	}
+	return name
+}
+
+// fromApplicant returns the applicant's from-applicants record, or an empty
+// one if they have none, and its revision, which is empty if they have none.
+func (self *Dept) fromApplicant(appId string) (map[string]interface{},
+	string, error) {
+	var app map[string]interface{}
+	_, err := self.appDB.Retrieve(appId, &app)
+	if err != nil {
+		return nil, "", fmt.Errorf("no application %v", appId)
+	}
+	var doc map[string]interface{}
+	rev, err := self.fromApplicantsDB.Retrieve(appId, &doc)
+	if err != nil || doc == nil {
+		return map[string]interface{}{}, "", nil
+	}
+	return doc, rev, nil
+}
+
+// putFromApplicant stores the applicant's record, failing with a conflict if
+// it has changed since revision rev was read.
+func (self *Dept) putFromApplicant(appId string, doc map[string]interface{},
+	rev string) error {
+	if rev == "" {
+		_, _, err := self.fromApplicantsDB.InsertWith(doc, appId)
+		return err
+	}
+	_, err := self.fromApplicantsDB.EditWith(doc, appId, rev)
+	return err
+}
+
+// MintApplicantLink mints a new link for the applicant, replacing any
+// earlier one.
+func (self *Dept) MintApplicantLink(appId string, by ReviewerId,
+	ttl time.Duration) (*ApplicantLink, error) {
+	doc, rev, err := self.fromApplicant(appId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	link := &ApplicantLink{
+		Nonce:    util.NewNonce(),
+		MintedBy: by,
+		Minted:   now,
+		Expires:  now.Add(ttl),
+	}
+	doc["link"] = link
+	err = self.putFromApplicant(appId, doc, rev)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// checkApplicantLink returns the applicant's record and its revision if
+// nonce is that of their current link. Otherwise, returns ErrApplicantLink.
+func (self *Dept) checkApplicantLink(appId string,
+	nonce string) (map[string]interface{}, string, error) {
+	doc, rev, err := self.fromApplicant(appId)
+	if err != nil {
+		return nil, "", ErrApplicantLink
+	}
+	link, _ := doc["link"].(map[string]interface{})
+	expected, _ := link["nonce"].(string)
+	expires, _ := link["expires"].(string)
+	t, err := time.Parse(time.RFC3339, expires)
+	if expected == "" || err != nil || time.Now().After(t) ||
+		subtle.ConstantTimeCompare([]byte(expected), []byte(nonce)) != 1 {
+		return nil, "", ErrApplicantLink
+	}
+	return doc, rev, nil
+}
+
+// FromApplicant returns the applicant's latest submission, which is empty if
+// they have made none, if nonce is that of their current link.
+func (self *Dept) FromApplicant(appId string,
+	nonce string) (*ApplicantSubmission, error) {
+	doc, _, err := self.checkApplicantLink(appId, nonce)
+	if err != nil {
+		return nil, err
+	}
+	strs := func(v interface{}) []string {
+		list, _ := v.([]interface{})
+		strs := []string{}
+		for _, elt := range list {
+			if s, ok := elt.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	sub := &ApplicantSubmission{Areas: strs(doc["areas"]),
+		Faculty: strs(doc["faculty"])}
+	sub.Program, _ = doc["program"].(string)
+	sub.Timestamp, _ = doc["timestamp"].(float64)
+	return sub, nil
+}
+
+// SubmitFromApplicant records the applicant's submission, if nonce is that of
+// their current link and the submission is valid; see ApplicantChoices.
+func (self *Dept) SubmitFromApplicant(appId string, nonce string,
+	sub *ApplicantSubmission) error {
+	doc, rev, err := self.checkApplicantLink(appId, nonce)
+	if err != nil {
+		return err
+	}
+	err = self.ApplicantChoices().check(sub)
+	if err != nil {
+		return err
+	}
+	sub.Timestamp = float64(time.Now().Unix())
+	history, _ := doc["history"].([]interface{})
+	doc["history"] = appendHistory(history, sub)
+	doc["areas"] = sub.Areas
+	doc["faculty"] = sub.Faculty
+	doc["program"] = sub.Program
+	doc["timestamp"] = sub.Timestamp
+	return self.putFromApplicant(appId, doc, rev)
+}
+
+// appendHistory appends sub to history, dropping the oldest submissions
+// beyond maxApplicantHistory.
+func appendHistory(history []interface{},
+	sub *ApplicantSubmission) []interface{} {
+	history = append(history, sub)
+	if len(history) > maxApplicantHistory {
+		history = history[len(history)-maxApplicantHistory:]
+	}
+	return history
+}
+
+// check trims the submission and checks it against the choices.
+func (self *ApplicantChoices) check(sub *ApplicantSubmission) error {
+	sub.Program = strings.TrimSpace(sub.Program)
+	if sub.Program == "" {
+		return errors.New("choose a program")
+	}
+	err := checkChoices("program", []string{sub.Program}, self.Programs)
+	if err != nil {
+		return err
+	}
+	if sub.Areas, err = trimChoices(sub.Areas); err != nil {
+		return err
+	}
+	if len(sub.Areas) == 0 {
+		return errors.New("choose at least one area")
+	}
+	err = checkChoices("area", sub.Areas, self.Areas)
+	if err != nil {
+		return err
+	}
+	if sub.Faculty, err = trimChoices(sub.Faculty); err != nil {
+		return err
+	}
+	return checkChoices("faculty member", sub.Faculty, self.Faculty)
+}
+
+// trimChoices trims the choices and drops empty ones and repeats.
+func trimChoices(choices []string) ([]string, error) {
+	seen := make(map[string]bool)
+	trimmed := []string{}
+	for _, choice := range choices {
+		choice = strings.TrimSpace(choice)
+		if choice == "" || seen[choice] {
+			continue
+		}
+		seen[choice] = true
+		trimmed = append(trimmed, choice)
+	}
+	if len(trimmed) > maxApplicantChoices {
+		return nil, fmt.Errorf("choose at most %v areas and %v faculty members",
+			maxApplicantChoices, maxApplicantChoices)
+	}
+	return trimmed, nil
+}
+
+// checkChoices checks that every choice is allowed, or, if allowed is empty,
+// not too long.
+func checkChoices(what string, choices []string, allowed []string) error {
+	valid := make(map[string]bool, len(allowed))
+	for _, choice := range allowed {
+		valid[choice] = true
+	}
+	for _, choice := range choices {
+		if len(allowed) == 0 && len(choice) > maxChoiceLength {
+			return fmt.Errorf("the %v %q is too long", what, choice)
+		}
+		if len(allowed) > 0 && !valid[choice] {
+			return fmt.Errorf("unknown %v %q", what, choice)
+		}
+	}
+	return nil
+}
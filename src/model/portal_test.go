@@ -0,0 +1,65 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplicantChoices(t *testing.T) {
+	choices := &ApplicantChoices{Programs: []string{"MS", "PhD"},
+		Areas: []string{"Systems", "Theory"}}
+	sub := &ApplicantSubmission{Program: " PhD ",
+		Areas:   []string{"Theory", "", "Theory "},
+		Faculty: []string{"Grace Hopper"}}
+	if err := choices.check(sub); err != nil {
+		t.Fatalf("check of a valid submission: %v", err)
+	}
+	if sub.Program != "PhD" || len(sub.Areas) != 1 || len(sub.Faculty) != 1 {
+		t.Errorf("check left %+v", sub)
+	}
+
+	tooMany := []string{"a", "b", "c", "d", "e", "f"}
+	for problem, sub := range map[string]*ApplicantSubmission{
+		"choose a program":    {Areas: []string{"Systems"}},
+		"unknown program":     {Program: "MBA", Areas: []string{"Systems"}},
+		"choose at least one": {Program: "MS", Areas: []string{" "}},
+		"unknown area":        {Program: "MS", Areas: []string{"Biology"}},
+		"choose at most":      {Program: "MS", Areas: []string{"Systems"}, Faculty: tooMany},
+		"is too long": {Program: "MS", Areas: []string{"Systems"},
+			Faculty: []string{strings.Repeat("x", maxChoiceLength+1)}},
+	} {
+		err := choices.check(sub)
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("check: %v, expected %q", err, problem)
+		}
+	}
+
+	dept := &Dept{}
+	for _, bad := range []*ApplicantChoices{
+		{Areas: []string{"Systems", "Systems"}},
+		{Programs: []string{" MS"}},
+		{Faculty: []string{""}},
+	} {
+		if err := dept.SetApplicantChoices(bad); err == nil {
+			t.Errorf("SetApplicantChoices(%+v) succeeded", bad)
+		}
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	var history []interface{}
+	var last *ApplicantSubmission
+	for i := 0; i < maxApplicantHistory+3; i++ {
+		last = &ApplicantSubmission{Timestamp: float64(i)}
+		history = appendHistory(history, last)
+	}
+	if len(history) != maxApplicantHistory {
+		t.Fatalf("history has %v submissions", len(history))
+	}
+	if first := history[0].(*ApplicantSubmission); first.Timestamp != 3 {
+		t.Errorf("oldest submission kept is %v", first.Timestamp)
+	}
+	if history[len(history)-1] != last {
+		t.Errorf("latest submission missing")
+	}
+}
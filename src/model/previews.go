@@ -0,0 +1,302 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pdf"
+	"strings"
+	"time"
+)
+
+// Bump to remake every preview, e.g., when snippets or thumbnails change.
+const previewVersion = 1
+
+// The length of snippets, in characters, and the longest side of thumbnails,
+// in pixels.
+const snippetLength = 300
+const thumbnailSize = 200
+
+// A Preview describes an upload: its page count, the start of its text and
+// whether there is a thumbnail of its first page; see PreviewImage.
+type Preview struct {
+	Pages   int    `json:"pages"`
+	Snippet string `json:"snippet"`
+	Image   bool   `json:"image"`
+	// Why the upload could not be previewed, e.g., it is not a PDF.
+	Problem   string  `json:"problem,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+	// The ETag of the upload that the preview was made from.
+	ETag    string `json:"etag"`
+	Version int    `json:"version"`
+}
+
+// MakePreviews makes previews of the materials of every application that
+// have none, or whose upload has changed since. Previews are stored in the
+// previews database, by upload name, with the thumbnail attached, rather than
+// in the department's BlobStore: they are small, made from the uploads, and
+// remade whenever previewVersion changes, so they are cached like packets,
+// and the BlobStore holds only what applicants and letter writers sent.
+// Uploads that cannot be previewed are logged and skipped. Returns the number
+// made.
+func (self *Dept) MakePreviews() (int, error) {
+	apps, err := allDocs(self.appDB)
+	if err != nil {
+		return 0, err
+	}
+	made, failed := 0, 0
+	for _, app := range apps {
+		for _, field := range []string{"materials", "recs"} {
+			mats, _ := app[field].([]interface{})
+			for _, mat := range mats {
+				m, _ := mat.(map[string]interface{})
+				name, _ := m["url"].(string)
+				if name == "" {
+					continue
+				}
+				ok, err := self.makePreview(name)
+				if err != nil {
+					log.Printf("ERROR previewing %v: %v", name, err)
+					failed++
+				}
+				if ok {
+					made++
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return made, fmt.Errorf("%v uploads could not be previewed", failed)
+	}
+	return made, nil
+}
+
+// makePreview makes a preview of the upload name unless it has a current
+// one. Returns whether it made one.
+func (self *Dept) makePreview(name string) (bool, error) {
+	upload, err := self.OpenUpload(name)
+	if err == ErrNoUpload {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer upload.Close()
+	var old Preview
+	_, err = self.previewsDB.Retrieve(name, &old)
+	if err == nil && old.ETag == upload.ETag &&
+		old.Version == previewVersion {
+		return false, nil
+	}
+	data, err := ioutil.ReadAll(upload)
+	if err != nil {
+		return false, err
+	}
+
+	preview, thumbnail := previewOf(data)
+	preview.ETag = upload.ETag
+	if thumbnail == nil {
+		err = putDoc(self.previewsDB, name, preview)
+	} else {
+		err = putAttachment(self.previewsDB, name, preview, "thumbnail.png",
+			"image/png", thumbnail)
+	}
+	return err == nil, err
+}
+
+// readPDF reads PDFs for previews; tests replace it.
+var readPDF = pdf.Read
+
+// previewOf returns the preview of a PDF and its thumbnail, which is nil if
+// it has none. If reading the PDF panics, the preview records that as its
+// problem, so that the upload is not tried again until it changes.
+func previewOf(data []byte) (preview *Preview, thumbnail []byte) {
+	preview = &Preview{Timestamp: float64(time.Now().Unix()),
+		Version: previewVersion}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR previewing a PDF: %v", r)
+			*preview = Preview{Timestamp: preview.Timestamp,
+				Version: previewVersion,
+				Problem: fmt.Sprintf("unreadable PDF: %v", r)}
+			thumbnail = nil
+		}
+	}()
+	doc, err := readPDF(data)
+	if err != nil {
+		preview.Problem = err.Error()
+		return preview, nil
+	}
+	pages, err := doc.Pages()
+	if err != nil {
+		preview.Problem = err.Error()
+		return preview, nil
+	}
+	preview.Pages = len(pages)
+	if len(pages) == 0 {
+		return preview, nil
+	}
+	text, err := doc.Text(pages[0])
+	if err == nil {
+		preview.Snippet = snippet(text, snippetLength)
+	}
+	thumbnail = makeThumbnail(data, doc, pages[0])
+	preview.Image = thumbnail != nil
+	return preview, thumbnail
+}
+
+// snippet returns about the first n characters of text, on one line, ending
+// at a word boundary.
+func snippet(text string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	cut := n
+	for cut > n/2 && runes[cut] != ' ' {
+		cut--
+	}
+	return strings.TrimSpace(string(runes[:cut])) + "…"
+}
+
+// makeThumbnail returns a PNG of the page, rendered by pdftoppm (from Poppler)
+// if it is installed. Otherwise, it scales down the largest JPEG on the page,
+// which shows scanned pages well enough. Returns nil if neither works.
+func makeThumbnail(data []byte, doc *pdf.Document, page pdf.Page) []byte {
+	if pdftoppm, err := exec.LookPath("pdftoppm"); err == nil {
+		img, err := renderFirstPage(pdftoppm, data)
+		if err == nil {
+			return img
+		}
+		log.Printf("rendering a thumbnail: %v", err)
+	}
+	data = doc.JPEG(page)
+	if data == nil {
+		return nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var out bytes.Buffer
+	if png.Encode(&out, scaleDown(img, thumbnailSize)) != nil {
+		return nil
+	}
+	return out.Bytes()
+}
+
+const renderTimeout = 30 * time.Second
+
+func renderFirstPage(pdftoppm string, data []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "apply2-preview")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.pdf")
+	err = ioutil.WriteFile(in, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, pdftoppm, "-f", "1", "-l", "1",
+		"-singlefile", "-png", "-scale-to", fmt.Sprint(thumbnailSize), in,
+		filepath.Join(dir, "out")).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return ioutil.ReadFile(filepath.Join(dir, "out.png"))
+}
+
+// scaleDown scales img so that its longest side is at most size pixels,
+// averaging the pixels that each pixel of the result covers.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	longest := w
+	if h > longest {
+		longest = h
+	}
+	if longest <= size {
+		return img
+	}
+	sw, sh := w*size/longest, h*size/longest
+	if sw < 1 {
+		sw = 1
+	}
+	if sh < 1 {
+		sh = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	for y := 0; y < sh; y++ {
+		y0, y1 := b.Min.Y+y*h/sh, b.Min.Y+(y+1)*h/sh
+		for x := 0; x < sw; x++ {
+			x0, x1 := b.Min.X+x*w/sw, b.Min.X+(x+1)*w/sw
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			scaled.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n),
+				uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return scaled
+}
+
+// PreviewImage returns the thumbnail of the upload name, as a PNG. Returns
+// ErrNoUpload if it has none.
+func (self *Dept) PreviewImage(name string) ([]byte, error) {
+	var preview Preview
+	_, err := self.previewsDB.Retrieve(name, &preview)
+	if err != nil || !preview.Image {
+		return nil, ErrNoUpload
+	}
+	return download(attachmentURL(self.previewsDB, name, "thumbnail.png"))
+}
+
+// addPreviews sets "previews" on every application to the previews of its
+// materials, by upload name.
+func (self *Dept) addPreviews(appMap map[string]map[string]interface{}) error {
+	var r struct {
+		Rows []struct {
+			Id  string   `json:"id"`
+			Doc *Preview `json:"doc"`
+		} `json:"rows"`
+	}
+	err := self.previewsDB.Query("_all_docs", includeDocs, &r)
+	if err != nil {
+		return err
+	}
+	previews := make(map[string]*Preview, len(r.Rows))
+	for _, row := range r.Rows {
+		previews[row.Id] = row.Doc
+	}
+	for _, app := range appMap {
+		appPreviews := make(map[string]*Preview)
+		for _, field := range []string{"materials", "recs"} {
+			mats, _ := app[field].([]interface{})
+			for _, mat := range mats {
+				m, _ := mat.(map[string]interface{})
+				name, _ := m["url"].(string)
+				if previews[name] != nil {
+					appPreviews[name] = previews[name]
+				}
+			}
+		}
+		app["previews"] = appPreviews
+	}
+	return nil
+}
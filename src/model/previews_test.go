@@ -0,0 +1,45 @@
+package model
+
+import (
+	"image"
+	"pdf"
+	"strings"
+	"testing"
+)
+
+func TestPreviewOf(t *testing.T) {
+	preview, _ := previewOf(testPDF(t))
+	if preview.Pages != 1 || preview.Snippet != "Transcript A+" ||
+		preview.Problem != "" {
+		t.Errorf("previewOf(a PDF) = %+v", preview)
+	}
+	preview, thumbnail := previewOf([]byte("hello"))
+	if preview.Problem == "" || thumbnail != nil {
+		t.Errorf("previewOf(text) = %+v", preview)
+	}
+
+	// Panics in the PDF reader are problems with the upload.
+	defer func() { readPDF = pdf.Read }()
+	readPDF = func([]byte) (*pdf.Document, error) { panic("index out of range") }
+	preview, thumbnail = previewOf(testPDF(t))
+	if preview.Problem != "unreadable PDF: index out of range" ||
+		preview.Pages != 0 || preview.Version != previewVersion ||
+		thumbnail != nil {
+		t.Errorf("previewOf(a PDF that panics) = %+v", preview)
+	}
+	readPDF = pdf.Read
+
+	text := strings.Repeat("lorem ipsum\n", 40)
+	s := snippet(text, 30)
+	if s != "lorem ipsum lorem ipsum lorem…" {
+		t.Errorf("snippet = %q", s)
+	}
+	if s = snippet("short  text", 30); s != "short text" {
+		t.Errorf("snippet = %q", s)
+	}
+
+	img := scaleDown(image.NewGray(image.Rect(0, 0, 1700, 2200)), 200)
+	if b := img.Bounds(); b.Dx() != 154 || b.Dy() != 200 {
+		t.Errorf("scaled to %v", b)
+	}
+}
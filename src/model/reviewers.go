@@ -0,0 +1,147 @@
+package model
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type ReviewersResult struct {
+	Rows []struct {
+		Doc Reviewer `json:"doc"`
+	} `json:"rows"`
+}
+
+// Reviewers returns every reviewer, sorted by id.
+func (self *Dept) Reviewers() ([]Reviewer, error) {
+	var r ReviewersResult
+	err := self.reviewerDB.Query("_all_docs", includeDocs, &r)
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]Reviewer, 0, len(r.Rows))
+	for _, row := range r.Rows {
+		id := string(row.Doc.Id)
+		if id != "" && !strings.HasPrefix(id, "_design/") {
+			revs = append(revs, row.Doc)
+		}
+	}
+	sort.Sort(reviewersById(revs))
+	return revs, nil
+}
+
+type reviewersById []Reviewer
+
+func (self reviewersById) Len() int           { return len(self) }
+func (self reviewersById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self reviewersById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *Dept) updateReviewer(revId ReviewerId, update func(*Reviewer)) error {
+	var rev Reviewer
+	_rev, err := self.reviewerDB.Retrieve(string(revId), &rev)
+	if err != nil {
+		return fmt.Errorf("no reviewer %v", revId)
+	}
+	update(&rev)
+	_, err = self.reviewerDB.EditWith(rev, string(revId), _rev)
+	return err
+}
+
+func (self *Dept) SetReviewerName(revId ReviewerId, name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name for %v", revId)
+	}
+	return self.updateReviewer(revId, func(rev *Reviewer) {
+		rev.Name = name
+	})
+}
+
+func (self *Dept) SetReviewerDisabled(revId ReviewerId, disabled bool) error {
+	return self.updateReviewer(revId, func(rev *Reviewer) {
+		rev.Disabled = disabled
+	})
+}
+
+// DeleteReviewer deletes the reviewer's account. Their comments are kept;
+// 'apply2 fsck -repair' deletes their scores and highlights. Disable
+// reviewers instead to keep their scores.
+func (self *Dept) DeleteReviewer(revId ReviewerId) error {
+	var rev Reviewer
+	_rev, err := self.reviewerDB.Retrieve(string(revId), &rev)
+	if err != nil {
+		return fmt.Errorf("no reviewer %v", revId)
+	}
+	return self.reviewerDB.Delete(string(revId), _rev)
+}
+
+// parseReviewers reads a CSV file of "Name,email" rows. The reviewer's id is
+// the part of the email address before the "@". A first row without an email
+// address is taken to be a header.
+func parseReviewers(r io.Reader) ([]Reviewer, []error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	rows, err := in.ReadAll()
+	if err != nil {
+		return nil, []error{err}
+	}
+	first := 1
+	if len(rows) > 0 &&
+		(len(rows[0]) < 2 || !strings.Contains(rows[0][1], "@")) {
+		rows = rows[1:]
+		first = 2
+	}
+
+	var revs []Reviewer
+	var errs []error
+	for i, row := range rows {
+		if len(row) < 2 {
+			errs = append(errs, fmt.Errorf("row %v: expected Name,email", i+first))
+			continue
+		}
+		name, email := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+		at := strings.Index(email, "@")
+		if name == "" || at <= 0 {
+			errs = append(errs, fmt.Errorf("row %v: invalid name %q or email %q",
+				i+first, name, email))
+			continue
+		}
+		revs = append(revs, Reviewer{Id: ReviewerId(email[:at]), Name: name,
+			Email: email})
+	}
+	return revs, errs
+}
+
+// ImportReviewers creates the reviewers listed in a CSV file; see
+// parseReviewers. Rows that cannot be imported, e.g., because the reviewer
+// exists, are reported as errors.
+func (self *Dept) ImportReviewers(r io.Reader) ([]Reviewer, []error) {
+	revs, errs := parseReviewers(r)
+	var added []Reviewer
+	for _, rev := range revs {
+		err := self.CreateReviewer(&rev)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		added = append(added, rev)
+	}
+	return added, errs
+}
+
+// CreateReviewer creates a reviewer who authenticates with LDAP.
+func (self *Dept) CreateReviewer(rev *Reviewer) error {
+	if rev.Id == "" || rev.Name == "" {
+		return fmt.Errorf("reviewer needs a username and a name")
+	}
+	if _, err := self.GetReviewerById(rev.Id); err == nil {
+		return fmt.Errorf("reviewer %v exists", rev.Id)
+	}
+	_, _, err := self.reviewerDB.Insert(*rev)
+	if err != nil {
+		return fmt.Errorf("creating %v: %v", rev.Id, err)
+	}
+	return nil
+}
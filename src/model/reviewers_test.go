@@ -0,0 +1,27 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReviewers(t *testing.T) {
+	revs, errs := parseReviewers(strings.NewReader(`Name,Email
+Scooby Doo, scooby@cs.umass.edu
+"Velma Dinkley, PhD",velma@example.com
+Shaggy
+Fred Jones,fred
+`))
+	if len(revs) != 2 || revs[0].Id != "scooby" || revs[0].Name != "Scooby Doo" ||
+		revs[1].Id != "velma" || revs[1].Email != "velma@example.com" {
+		t.Errorf("parsed %v", revs)
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "row 4") {
+		t.Errorf("errors %v", errs)
+	}
+
+	revs, errs = parseReviewers(strings.NewReader("Scooby Doo,scooby@cs.umass.edu\n"))
+	if len(revs) != 1 || len(errs) != 0 {
+		t.Errorf("headerless file parsed as %v, %v", revs, errs)
+	}
+}
@@ -0,0 +1,295 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An S3Store stores each blob as an object in a bucket of Amazon S3 or a
+// compatible service, with its checksum in the metadata x-amz-meta-sha256.
+// Buckets are addressed by path, which every compatible service supports.
+type S3Store struct {
+	Endpoint  string // e.g., https://s3.amazonaws.com
+	Bucket    string
+	Prefix    string // of object names, e.g., "sample/2014/"
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// The SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (self *S3Store) objectURL(name string) string {
+	return self.Endpoint + "/" + awsEscape(self.Bucket, false) + "/" +
+		awsEscape(self.Prefix+name, false)
+}
+
+func (self *S3Store) request(method string, url string, payloadHash string,
+	body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	return req, nil
+}
+
+// do signs and sends req.
+func (self *S3Store) do(req *http.Request) (*http.Response, error) {
+	self.sign(req, time.Now())
+	return http.DefaultClient.Do(req)
+}
+
+func (self *S3Store) Put(info *BlobInfo, r io.Reader) error {
+	resp, err := self.head(info.Name)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return ErrUploadExists
+	}
+	req, err := self.request("PUT", self.objectURL(info.Name), info.Checksum, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", info.ContentType)
+	req.Header.Set("x-amz-meta-sha256", info.Checksum)
+	if info.Validation != nil {
+		v, err := json.Marshal(info.Validation)
+		if err != nil {
+			return err
+		}
+		// Metadata must be ASCII.
+		req.Header.Set("x-amz-meta-validation", url.QueryEscape(string(v)))
+	}
+	// Services that support conditional writes refuse to replace an object
+	// that was created after the check above.
+	req.Header.Set("If-None-Match", "*")
+	resp, err = self.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrUploadExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d from S3 storing %v", resp.StatusCode,
+			info.Name)
+	}
+	return nil
+}
+
+func (self *S3Store) head(name string) (*http.Response, error) {
+	req, err := self.request("HEAD", self.objectURL(name), emptySHA256, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := self.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("got status %d from S3 reading %v",
+			resp.StatusCode, name)
+	}
+	return resp, nil
+}
+
+func (self *S3Store) Open(name string) (*Blob, error) {
+	resp, err := self.head(name)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoUpload
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("S3 did not report the size of %v", name)
+	}
+	info := BlobInfo{
+		Name:        name,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Checksum:    resp.Header.Get("x-amz-meta-sha256"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if info.Checksum != "" {
+		info.ETag = `"` + info.Checksum + `"`
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	v, err := url.QueryUnescape(resp.Header.Get("x-amz-meta-validation"))
+	if err == nil && v != "" {
+		json.Unmarshal([]byte(v), &info.Validation)
+	}
+	return &Blob{info, &httpReader{
+		url:  self.objectURL(name),
+		name: name,
+		size: info.Size,
+		do: func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("x-amz-content-sha256", emptySHA256)
+			return self.do(req)
+		},
+	}}, nil
+}
+
+func (self *S3Store) Delete(name string) error {
+	// S3 reports success deleting objects that do not exist.
+	resp, err := self.head(name)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoUpload
+	}
+	req, err := self.request("DELETE", self.objectURL(name), emptySHA256, nil)
+	if err != nil {
+		return err
+	}
+	resp, err = self.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d from S3 deleting %v", resp.StatusCode,
+			name)
+	}
+	return nil
+}
+
+func (self *S3Store) Names() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": self.Prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		req, err := self.request("GET", self.Endpoint+"/"+
+			awsEscape(self.Bucket, false)+"?"+canonicalQuery(query),
+			emptySHA256, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := self.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got status %d from S3 listing %v",
+				resp.StatusCode, self.Bucket)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range list.Contents {
+			names = append(names, strings.TrimPrefix(obj.Key, self.Prefix))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// sign adds an AWS Signature Version 4 to req, which must already have the
+// x-amz-content-sha256 header.
+func (self *S3Store) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	payloadHash := req.Header.Get("x-amz-content-sha256")
+
+	query := make(map[string]string)
+	for k, v := range req.URL.Query() {
+		query[k] = v[0]
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + self.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hexSHA256(canonical)
+
+	key := []byte("AWS4" + self.SecretKey)
+	for _, part := range []string{date, self.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		self.AccessKey, scope, signedHeaders, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encodes query with sorted keys, as signatures require.
+func canonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = awsEscape(k, true) + "=" + awsEscape(query[k], true)
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes every byte of s but unreserved characters, and
+// slashes unless slash is set.
+func awsEscape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package model
+
+import db "code.google.com/p/couch-go"
+
+// Department-wide settings are stored as documents in the settings database,
+// one document per setting.
+
+// getSetting reads the setting id into out and returns its revision. Returns
+// an error if the department does not have the setting.
+func (self *Dept) getSetting(id string, out interface{}) (string, error) {
+	return self.settingsDB.Retrieve(id, out)
+}
+
+// putSetting creates or replaces the setting id.
+func (self *Dept) putSetting(id string, setting interface{}) error {
+	return putDoc(self.settingsDB, id, setting)
+}
+
+// putDoc creates or replaces the document id in d.
+func putDoc(d *db.Database, id string, doc interface{}) error {
+	var old map[string]interface{}
+	rev, err := d.Retrieve(id, &old)
+	if err != nil {
+		_, _, err = d.InsertWith(doc, id)
+		return err
+	}
+	_, err = d.EditWith(doc, id, rev)
+	return err
+}
+
+func (self *Dept) deleteSetting(id string) error {
+	var old map[string]interface{}
+	rev, err := self.settingsDB.Retrieve(id, &old)
+	if err != nil {
+		return err
+	}
+	return self.settingsDB.Delete(id, rev)
+}
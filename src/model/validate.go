@@ -0,0 +1,247 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"pdf"
+	"strings"
+	"time"
+)
+
+const scannerSetting = "scanner"
+
+// A Validation records the checks that an upload passed. Uploads that fail
+// them are rejected, so Problem is only set by ValidateMaterials, for uploads
+// stored before the checks existed or changed.
+type Validation struct {
+	Problem string `json:"problem,omitempty"`
+	Pages   int    `json:"pages,omitempty"`
+	// The spec of the scanner that found no malware in the upload; empty if
+	// the department has no scanner.
+	Scanner   string  `json:"scanner,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// An InvalidUploadError is returned when an upload fails validation.
+type InvalidUploadError struct {
+	Name       string
+	Validation *Validation
+}
+
+func (self *InvalidUploadError) Error() string {
+	return fmt.Sprintf("%v: %v", self.Name, self.Validation.Problem)
+}
+
+// A Scanner looks for malware.
+type Scanner interface {
+	// Scan returns the name of the malware found in r, or "" if none.
+	Scan(r io.Reader) (string, error)
+}
+
+// ParseScanner returns the scanner described by spec, which is one of
+//
+//	clamd:unix:SOCKET
+//	clamd:tcp:HOST:PORT
+//
+// Both send uploads to a ClamAV daemon.
+func ParseScanner(spec string) (Scanner, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] != "clamd" ||
+		(parts[1] != "unix" && parts[1] != "tcp") || parts[2] == "" {
+		return nil, fmt.Errorf("unknown scanner %q", spec)
+	}
+	return &ClamdScanner{Network: parts[1], Address: parts[2]}, nil
+}
+
+// ScannerSpec returns the spec of the department's scanner, or "" if it has
+// none; see ParseScanner.
+func (self *Dept) ScannerSpec() string {
+	var setting struct {
+		Spec string `json:"spec"`
+	}
+	self.getSetting(scannerSetting, &setting)
+	return setting.Spec
+}
+
+// SetScanner sets the scanner that checks new uploads. An empty spec removes
+// it.
+func (self *Dept) SetScanner(spec string) error {
+	if spec == "" {
+		if self.ScannerSpec() == "" {
+			return nil
+		}
+		return self.deleteSetting(scannerSetting)
+	}
+	_, err := ParseScanner(spec)
+	if err != nil {
+		return err
+	}
+	return self.putSetting(scannerSetting, map[string]interface{}{"spec": spec})
+}
+
+// validate checks that data is a well-formed, unencrypted PDF with pages, and
+// scans it if the department has a scanner. Returns an error only if the
+// checks could not be made.
+func (self *Dept) validate(data []byte) (*Validation, error) {
+	v := &Validation{Timestamp: float64(time.Now().Unix())}
+	doc, err := pdf.Read(data)
+	switch {
+	case err == pdf.ErrNotPDF:
+		v.Problem = fmt.Sprintf("not a PDF (%v)", http.DetectContentType(data))
+		return v, nil
+	case err == pdf.ErrEncrypted:
+		v.Problem = "encrypted"
+		return v, nil
+	case err != nil:
+		v.Problem = fmt.Sprintf("malformed PDF: %v", err)
+		return v, nil
+	}
+	pages, err := doc.Pages()
+	if err != nil {
+		v.Problem = fmt.Sprintf("malformed PDF: %v", err)
+		return v, nil
+	}
+	if len(pages) == 0 {
+		v.Problem = "the PDF has no pages"
+		return v, nil
+	}
+	v.Pages = len(pages)
+
+	spec := self.ScannerSpec()
+	if spec == "" {
+		return v, nil
+	}
+	scanner, err := ParseScanner(spec)
+	if err != nil {
+		return nil, err
+	}
+	found, err := scanner.Scan(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("scanning: %v", err)
+	}
+	if found != "" {
+		v.Problem = "malware found: " + found
+		return v, nil
+	}
+	v.Scanner = spec
+	return v, nil
+}
+
+// ValidateMaterials checks every material again, e.g., after adding a
+// scanner, and records the results on the materials. Returns the problems
+// found, as "APPLICANT_ID NAME: PROBLEM".
+func (self *Dept) ValidateMaterials() ([]string, error) {
+	apps, err := allDocs(self.appDB)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, app := range apps {
+		appId, _ := app["_id"].(string)
+		for _, field := range []string{"materials", "recs"} {
+			mats, _ := app[field].([]interface{})
+			for _, mat := range mats {
+				m, _ := mat.(map[string]interface{})
+				name, _ := m["url"].(string)
+				if name == "" {
+					continue
+				}
+				v, err := self.validateUpload(name)
+				if err != nil {
+					return nil, fmt.Errorf("%v: %v", name, err)
+				}
+				if v.Problem != "" {
+					problems = append(problems,
+						fmt.Sprintf("%v %v: %v", appId, name, v.Problem))
+				}
+				m["validation"] = v
+			}
+		}
+		_, err = self.appDB.EditWith(app, appId, app["_rev"].(string))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+func (self *Dept) validateUpload(name string) (*Validation, error) {
+	upload, err := self.OpenUpload(name)
+	if err == ErrNoUpload {
+		return &Validation{Problem: "missing",
+			Timestamp: float64(time.Now().Unix())}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+	var data bytes.Buffer
+	_, err = data.ReadFrom(upload)
+	if err != nil {
+		return nil, err
+	}
+	return self.validate(data.Bytes())
+}
+
+// A ClamdScanner sends uploads to a ClamAV daemon, with the INSTREAM command.
+type ClamdScanner struct {
+	Network string // "unix" or "tcp"
+	Address string
+}
+
+// Large uploads take a while to scan.
+const clamdTimeout = 2 * time.Minute
+
+func (self *ClamdScanner) Scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(self.Network, self.Address, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, 32*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			w.Write(size)
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	err = w.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// "stream: OK" or "stream: SIGNATURE FOUND"
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd replied %q", reply)
+}
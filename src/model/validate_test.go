@@ -0,0 +1,128 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"pdf"
+	"strings"
+	"testing"
+)
+import db "code.google.com/p/couch-go"
+
+func testPDF(t *testing.T) []byte {
+	b := pdf.NewBuilder()
+	b.AddText("Transcript", []string{"A+"})
+	var out bytes.Buffer
+	if _, err := b.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestValidateUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dept := &Dept{settingsDB: &db.Database{}, blobs: &FileStore{dir}}
+
+	data := testPDF(t)
+	if err = dept.Upload("good.pdf", bytes.NewReader(data), -1); err != nil {
+		t.Fatalf("Upload of a PDF: %v", err)
+	}
+	upload, err := dept.OpenUpload("good.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.Close()
+	if v := upload.Validation; v == nil || v.Pages != 1 || v.Problem != "" {
+		t.Errorf("validation = %+v", v)
+	}
+
+	encrypted := strings.Replace(string(data), "/Root", "/Encrypt 1 0 R /Root", 1)
+	for problem, content := range map[string]string{
+		"not a PDF (text/plain; charset=utf-8)": "hello",
+		"encrypted":                             encrypted,
+		"malformed PDF":                         "%PDF-1.4\n1 0 obj\n<< /Type",
+	} {
+		err = dept.Upload("bad.pdf", strings.NewReader(content), -1)
+		invalid, ok := err.(*InvalidUploadError)
+		if !ok || !strings.HasPrefix(invalid.Validation.Problem, problem) {
+			t.Errorf("Upload of a bad file: %v, expected %v", err, problem)
+		}
+	}
+	if names, _ := dept.blobs.Names(); len(names) != 1 {
+		t.Errorf("stored rejected uploads: %v", names)
+	}
+}
+
+// fakeClamd answers INSTREAM commands on a Unix socket, finding malware in
+// streams that contain "EICAR".
+func fakeClamd(t *testing.T, socket string) net.Listener {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			cmd, _ := r.ReadString(0)
+			var data bytes.Buffer
+			for cmd == "zINSTREAM\x00" {
+				var size uint32
+				if binary.Read(r, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				io.CopyN(&data, r, int64(size))
+			}
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestClamdScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clamd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "clamd.sock")
+	l := fakeClamd(t, socket)
+	defer l.Close()
+
+	scanner, err := ParseScanner("clamd:unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := scanner.Scan(bytes.NewReader(testPDF(t)))
+	if found != "" || err != nil {
+		t.Errorf("scan of a clean file: %q, %v", found, err)
+	}
+	infected := strings.Repeat("x", 100000) + "EICAR"
+	found, err = scanner.Scan(strings.NewReader(infected))
+	if found != "Eicar-Test-Signature" || err != nil {
+		t.Errorf("scan of an infected file: %q, %v", found, err)
+	}
+	for _, spec := range []string{"clamd:unix:", "clamd:udp:x", "virustotal"} {
+		if _, err := ParseScanner(spec); err == nil {
+			t.Errorf("ParseScanner(%q) succeeded", spec)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// A parser reads objects from buf, starting at pos. doc, if set, resolves
+// the indirect lengths of streams.
+type parser struct {
+	buf []byte
+	pos int
+	doc *Document
+}
+
+var errEOF = errors.New("unexpected end of file")
+
+func isWhite(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isDelim(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func isRegular(c byte) bool {
+	return !isWhite(c) && !isDelim(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (self *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %v: %v", self.pos, fmt.Sprintf(format, args...))
+}
+
+func (self *parser) skipSpace() {
+	for self.pos < len(self.buf) {
+		c := self.buf[self.pos]
+		if c == '%' {
+			for self.pos < len(self.buf) && self.buf[self.pos] != '\n' &&
+				self.buf[self.pos] != '\r' {
+				self.pos++
+			}
+		} else if isWhite(c) {
+			self.pos++
+		} else {
+			return
+		}
+	}
+}
+
+// keyword reads a run of regular characters.
+func (self *parser) keyword() string {
+	self.skipSpace()
+	start := self.pos
+	for self.pos < len(self.buf) && isRegular(self.buf[self.pos]) {
+		self.pos++
+	}
+	return string(self.buf[start:self.pos])
+}
+
+// integer reads a non-negative integer, or returns false and leaves pos
+// where it was.
+func (self *parser) integer() (int, bool) {
+	self.skipSpace()
+	start := self.pos
+	for self.pos < len(self.buf) && isDigit(self.buf[self.pos]) {
+		self.pos++
+	}
+	if self.pos == start || (self.pos < len(self.buf) &&
+		isRegular(self.buf[self.pos])) {
+		self.pos = start
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(self.buf[start:self.pos]))
+	if err != nil {
+		self.pos = start
+		return 0, false
+	}
+	return n, true
+}
+
+// indirect reads "num gen obj" and the object that follows.
+func (self *parser) indirect() (Ref, Object, error) {
+	num, ok := self.integer()
+	if !ok {
+		return Ref{}, nil, self.errorf("expected an object number")
+	}
+	gen, ok := self.integer()
+	if !ok || self.keyword() != "obj" {
+		return Ref{}, nil, self.errorf("expected %v gen obj", num)
+	}
+	obj, err := self.object()
+	return Ref{num, gen}, obj, err
+}
+
+func (self *parser) object() (Object, error) {
+	self.skipSpace()
+	if self.pos >= len(self.buf) {
+		return nil, errEOF
+	}
+	c := self.buf[self.pos]
+	switch {
+	case c == '/':
+		return self.name(), nil
+	case c == '(':
+		return self.literal()
+	case c == '<':
+		if self.pos+1 < len(self.buf) && self.buf[self.pos+1] == '<' {
+			return self.dictOrStream()
+		}
+		return self.hex()
+	case c == '[':
+		self.pos++
+		var arr Array
+		for {
+			self.skipSpace()
+			if self.pos >= len(self.buf) {
+				return nil, errEOF
+			}
+			if self.buf[self.pos] == ']' {
+				self.pos++
+				return arr, nil
+			}
+			obj, err := self.object()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, obj)
+		}
+	case isDigit(c) || c == '+' || c == '-' || c == '.':
+		return self.number()
+	}
+	start := self.pos
+	switch kw := self.keyword(); kw {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "":
+		self.pos++
+		return nil, self.errorf("unexpected %q", c)
+	default:
+		self.pos = start
+		return nil, self.errorf("unexpected %q", kw)
+	}
+}
+
+func (self *parser) name() Name {
+	self.pos++ // '/'
+	var name []byte
+	for self.pos < len(self.buf) && isRegular(self.buf[self.pos]) {
+		c := self.buf[self.pos]
+		if c == '#' && self.pos+2 < len(self.buf) {
+			if b, err := strconv.ParseUint(string(self.buf[self.pos+1:self.pos+3]),
+				16, 8); err == nil {
+				name = append(name, byte(b))
+				self.pos += 3
+				continue
+			}
+		}
+		name = append(name, c)
+		self.pos++
+	}
+	return Name(name)
+}
+
+func (self *parser) literal() (Object, error) {
+	self.pos++ // '('
+	var s []byte
+	depth := 1
+	for self.pos < len(self.buf) {
+		c := self.buf[self.pos]
+		self.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return String(s), nil
+			}
+		case '\\':
+			if self.pos >= len(self.buf) {
+				return nil, errEOF
+			}
+			c = self.buf[self.pos]
+			self.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if self.pos < len(self.buf) && self.buf[self.pos] == '\n' {
+					self.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					n := int(c - '0')
+					for i := 0; i < 2 && self.pos < len(self.buf) &&
+						self.buf[self.pos] >= '0' && self.buf[self.pos] <= '7'; i++ {
+						n = n*8 + int(self.buf[self.pos]-'0')
+						self.pos++
+					}
+					c = byte(n)
+				}
+			}
+		}
+		s = append(s, c)
+	}
+	return nil, errEOF
+}
+
+func (self *parser) hex() (Object, error) {
+	self.pos++ // '<'
+	var digits []byte
+	for self.pos < len(self.buf) && self.buf[self.pos] != '>' {
+		c := self.buf[self.pos]
+		self.pos++
+		if isWhite(c) {
+			continue
+		}
+		if _, err := strconv.ParseUint(string(c), 16, 8); err != nil {
+			return nil, self.errorf("invalid hex string")
+		}
+		digits = append(digits, c)
+	}
+	if self.pos >= len(self.buf) {
+		return nil, errEOF
+	}
+	self.pos++ // '>'
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, len(digits)/2)
+	for i := range s {
+		b, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		s[i] = byte(b)
+	}
+	return String(s), nil
+}
+
+// number reads a number, or a reference if the number is followed by a
+// generation and R.
+func (self *parser) number() (Object, error) {
+	start := self.pos
+	for self.pos < len(self.buf) &&
+		(isDigit(self.buf[self.pos]) || bytes.IndexByte([]byte("+-."),
+			self.buf[self.pos]) >= 0) {
+		self.pos++
+	}
+	text := string(self.buf[start:self.pos])
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		if n >= 0 && isDigit(text[0]) {
+			end := self.pos
+			if gen, ok := self.integer(); ok {
+				if self.keyword() == "R" {
+					return Ref{int(n), gen}, nil
+				}
+			}
+			self.pos = end
+		}
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		// Real files contain numbers like "--5"; treat them as 0.
+		return int64(0), nil
+	}
+	return f, nil
+}
+
+func (self *parser) dictOrStream() (Object, error) {
+	self.pos += 2 // '<<'
+	dict := make(Dict)
+	for {
+		self.skipSpace()
+		if self.pos+1 >= len(self.buf) {
+			return nil, errEOF
+		}
+		if self.buf[self.pos] == '>' && self.buf[self.pos+1] == '>' {
+			self.pos += 2
+			break
+		}
+		if self.buf[self.pos] != '/' {
+			return nil, self.errorf("expected a name in dictionary")
+		}
+		key := self.name()
+		value, err := self.object()
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = value
+	}
+	end := self.pos
+	if self.keyword() != "stream" {
+		self.pos = end
+		return dict, nil
+	}
+	return self.stream(dict)
+}
+
+var endstream = []byte("endstream")
+
+// stream reads the data of a stream whose dictionary has been read. Lengths
+// are often wrong in real files, so if "endstream" does not follow the
+// stated length, the data ends at the next "endstream".
+func (self *parser) stream(dict Dict) (Object, error) {
+	if self.pos < len(self.buf) && self.buf[self.pos] == '\r' {
+		self.pos++
+	}
+	if self.pos < len(self.buf) && self.buf[self.pos] == '\n' {
+		self.pos++
+	}
+	start := self.pos
+	length := -1
+	if self.doc != nil {
+		length = self.doc.integer(dict["Length"], -1)
+	} else if n, ok := dict["Length"].(int64); ok {
+		length = int(n)
+	}
+	if length >= 0 && length <= len(self.buf)-start {
+		self.pos = start + length
+		self.skipSpace()
+		if bytes.HasPrefix(self.buf[self.pos:], endstream) {
+			self.pos += len(endstream)
+			return &Stream{dict, self.buf[start : start+length]}, nil
+		}
+	}
+	i := bytes.Index(self.buf[start:], endstream)
+	if i < 0 {
+		return nil, errEOF
+	}
+	data := self.buf[start : start+i]
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	self.pos = start + i + len(endstream)
+	return &Stream{dict, data}, nil
+}
@@ -0,0 +1,181 @@
+// Package pdf reads PDF files and writes new ones made of their pages.
+//
+// It understands enough of PDF to take a file apart into pages, whether it
+// uses cross-reference tables or (from PDF 1.5) cross-reference and object
+// streams, and to copy those pages into a new file. It does not render
+// pages, which are copied as they are, but it can extract their text and
+// scanned images. It cannot read encrypted files.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// PDF objects are represented by these types and by nil, bool, int64 and
+// float64.
+type Name string
+
+// A String holds the bytes of a PDF string, whether literal or hex.
+type String string
+
+type Array []Object
+
+type Dict map[Name]Object
+
+// A Ref refers to an indirect object.
+type Ref struct {
+	Num int
+	Gen int
+}
+
+// A Stream is a dictionary followed by data, which is kept encoded.
+type Stream struct {
+	Dict Dict
+	Data []byte
+}
+
+type Object interface{}
+
+var ErrNotPDF = errors.New("not a PDF file")
+var ErrEncrypted = errors.New("encrypted PDF files are not supported")
+var ErrTooLarge = errors.New("stream is too large to decode")
+
+// The most bytes a stream may decode to, so that a small stream cannot
+// exhaust memory.
+var maxDecodedSize = 64 << 20
+
+// decode returns the data of the stream with its filters undone. Only
+// FlateDecode, with or without a PNG predictor, is supported; that is what
+// cross-reference and object streams use.
+func (self *Document) decode(s *Stream) ([]byte, error) {
+	var filters Array
+	switch f := self.Resolve(s.Dict["Filter"]).(type) {
+	case nil:
+	case Name:
+		filters = Array{f}
+	case Array:
+		filters = f
+	default:
+		return nil, fmt.Errorf("invalid filter %v", f)
+	}
+	var params Array
+	switch p := self.Resolve(s.Dict["DecodeParms"]).(type) {
+	case Dict:
+		params = Array{p}
+	case Array:
+		params = p
+	}
+	data := s.Data
+	for i, filter := range filters {
+		if self.Resolve(filter) != Name("FlateDecode") {
+			return nil, fmt.Errorf("unsupported filter %v", filter)
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(r, int64(maxDecodedSize)+1))
+		if err != nil && len(data) == 0 {
+			return nil, err
+		}
+		if len(data) > maxDecodedSize {
+			return nil, ErrTooLarge
+		}
+		if i < len(params) {
+			if p, ok := self.Resolve(params[i]).(Dict); ok {
+				data, err = self.unpredict(data, p)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// unpredict undoes a PNG predictor.
+func (self *Document) unpredict(data []byte, params Dict) ([]byte, error) {
+	predictor := self.integer(params["Predictor"], 1)
+	if predictor < 10 {
+		if predictor != 1 {
+			return nil, fmt.Errorf("unsupported predictor %v", predictor)
+		}
+		return data, nil
+	}
+	colors := self.integer(params["Colors"], 1)
+	bits := self.integer(params["BitsPerComponent"], 8)
+	columns := self.integer(params["Columns"], 1)
+	if colors < 1 || colors > 32 || bits < 1 || bits > 16 || columns < 1 {
+		return nil, errors.New("invalid predictor parameters")
+	}
+	// Rows longer than the data hold nothing.
+	if columns > len(data) {
+		return nil, nil
+	}
+	bpp := (colors*bits + 7) / 8
+	rowLen := (colors*bits*columns + 7) / 8
+	var out []byte
+	prev := make([]byte, rowLen)
+	for len(data) >= rowLen+1 {
+		filter, row := data[0], append([]byte(nil), data[1:rowLen+1]...)
+		data = data[rowLen+1:]
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("invalid PNG filter %v", filter)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// integer returns obj as an int, or def if it is not a number.
+func (self *Document) integer(obj Object, def int) int {
+	switch n := self.Resolve(obj).(type) {
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return def
+}
@@ -0,0 +1,331 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func build(t *testing.T, fn func(b *Builder)) []byte {
+	b := NewBuilder()
+	fn(b)
+	var out bytes.Buffer
+	_, err := b.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func pageCount(t *testing.T, data []byte) int {
+	doc, err := Read(data)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	pages, err := doc.Pages()
+	if err != nil {
+		t.Fatalf("Pages: %v", err)
+	}
+	return len(pages)
+}
+
+func TestText(t *testing.T) {
+	var lines []string
+	for i := 0; i < 60; i++ {
+		lines = append(lines, fmt.Sprintf("Line %v (with parentheses) \\ é", i))
+	}
+	data := build(t, func(b *Builder) { b.AddText("Cover", lines) })
+	if n := pageCount(t, data); n != 2 {
+		t.Fatalf("60 lines took %v pages, expected 2", n)
+	}
+	if !bytes.Contains(data, []byte(`(Line 0 \(with parentheses\) \\ \351) Tj`)) {
+		t.Errorf("text not escaped:\n%s", data)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	lines := wrap("aaaa bbbb cccc", 9)
+	if len(lines) != 2 || lines[0] != "aaaa bbbb" || lines[1] != "cccc" {
+		t.Errorf("wrap at spaces: %q", lines)
+	}
+	lines = wrap("aaaaaaaaaaaa", 5)
+	if len(lines) != 3 || lines[0] != "aaaaa" || lines[2] != "aa" {
+		t.Errorf("wrap without spaces: %q", lines)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	one := build(t, func(b *Builder) { b.AddText("One", []string{"first"}) })
+	two := build(t, func(b *Builder) {
+		b.AddText("Two", []string{"second"})
+		b.AddText("Three", []string{"third"})
+	})
+	merged := build(t, func(b *Builder) {
+		b.AddText("Cover", nil)
+		for _, data := range [][]byte{one, two} {
+			doc, err := Read(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = b.AddDocument("Part", doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if n := pageCount(t, merged); n != 4 {
+		t.Fatalf("merged document has %v pages, expected 4", n)
+	}
+	for _, text := range []string{"(first)", "(second)", "(third)"} {
+		if !bytes.Contains(merged, []byte(text)) {
+			t.Errorf("merged document lacks %v", text)
+		}
+	}
+	doc, _ := Read(merged)
+	root := doc.Resolve(doc.Trailer["Root"]).(Dict)
+	outline := doc.Resolve(root["Outlines"]).(Dict)
+	if doc.integer(outline["Count"], 0) != 3 {
+		t.Errorf("outline %v", outline)
+	}
+}
+
+func flate(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// A PDF 1.5 file whose page tree is in an object stream, indexed by a
+// cross-reference stream with a PNG predictor.
+func compressedPDF() []byte {
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.5\n")
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 /MediaBox [0 0 200 200] >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>",
+	}
+	var header, body bytes.Buffer
+	for i, obj := range objs {
+		fmt.Fprintf(&header, "%v %v ", i+1, body.Len())
+		body.WriteString(obj + "\n")
+	}
+	stm := flate(append(header.Bytes(), body.Bytes()...))
+	offsets := make(map[int]int)
+	offsets[4] = out.Len()
+	fmt.Fprintf(&out, "4 0 obj\n<< /Type /ObjStm /N 3 /First %v /Filter /FlateDecode /Length %v >>\nstream\n",
+		header.Len(), len(stm))
+	out.Write(stm)
+	out.WriteString("\nendstream\nendobj\n")
+	content := "BT /F1 12 Tf 10 10 Td (compressed) Tj ET"
+	offsets[5] = out.Len()
+	fmt.Fprintf(&out, "5 0 obj\n<< /Length 6 0 R >>\nstream\n%v\nendstream\nendobj\n",
+		content)
+	offsets[6] = out.Len()
+	fmt.Fprintf(&out, "6 0 obj\n%v\nendobj\n", len(content))
+
+	// Rows of type (1 byte), offset or stream (2), index (1), each
+	// predicted with the PNG Up filter.
+	var rows [][]byte
+	rows = append(rows, []byte{0, 0, 0, 255})
+	for i := 1; i <= 3; i++ {
+		rows = append(rows, []byte{2, 0, 4, byte(i - 1)})
+	}
+	for i := 4; i <= 7; i++ {
+		off := out.Len()
+		if i < 7 {
+			off = offsets[i]
+		}
+		rows = append(rows, []byte{1, byte(off >> 8), byte(off), 0})
+	}
+	var predicted []byte
+	prev := make([]byte, 4)
+	for _, row := range rows {
+		predicted = append(predicted, 2)
+		for i := range row {
+			predicted = append(predicted, row[i]-prev[i])
+		}
+		prev = row
+	}
+	xref := flate(predicted)
+	fmt.Fprintf(&out, "7 0 obj\n<< /Type /XRef /Size 8 /W [1 2 1] /Root 1 0 R "+
+		"/Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 4 >> "+
+		"/Length %v >>\nstream\n", len(xref))
+	xrefOffset := offsets[6] + len(fmt.Sprintf("6 0 obj\n%v\nendobj\n", len(content)))
+	out.Write(xref)
+	fmt.Fprintf(&out, "\nendstream\nendobj\nstartxref\n%v\n%%%%EOF\n", xrefOffset)
+	return out.Bytes()
+}
+
+func TestCompressed(t *testing.T) {
+	data := compressedPDF()
+	doc, err := Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.scanned {
+		t.Errorf("scanned the file instead of reading its xref stream")
+	}
+	pages, err := doc.Pages()
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("Pages() = %v, %v", pages, err)
+	}
+	if box, _ := pages[0].Dict["MediaBox"].(Array); len(box) != 4 {
+		t.Errorf("page did not inherit its MediaBox: %v", pages[0].Dict)
+	}
+	merged := build(t, func(b *Builder) {
+		if err := b.AddDocument("Compressed", doc); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !bytes.Contains(merged, []byte("(compressed) Tj")) ||
+		!bytes.Contains(merged, []byte("/MediaBox [0 0 200 200]")) {
+		t.Errorf("merged document:\n%s", merged)
+	}
+}
+
+func TestDamagedXref(t *testing.T) {
+	data := build(t, func(b *Builder) { b.AddText("Damaged", []string{"x"}) })
+	i := bytes.LastIndex(data, []byte("startxref"))
+	damaged := append(append([]byte(nil), data[:i]...),
+		[]byte("startxref\n12\n%%EOF\n")...)
+	if n := pageCount(t, damaged); n != 1 {
+		t.Errorf("damaged file has %v pages", n)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := Read([]byte("hello")); err != ErrNotPDF {
+		t.Errorf("Read of a text file: %v", err)
+	}
+	data := build(t, func(b *Builder) { b.AddText("Secret", nil) })
+	encrypted := strings.Replace(string(data), "/Root", "/Encrypt 1 0 R /Root", 1)
+	if _, err := Read([]byte(encrypted)); err != ErrEncrypted {
+		t.Errorf("Read of an encrypted file: %v", err)
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	data := build(t, func(b *Builder) {
+		b.AddText("Transcript", []string{"Algorithms  A", "Compilers (A-)"})
+	})
+	doc, _ := Read(data)
+	pages, _ := doc.Pages()
+	text, err := doc.Text(pages[0])
+	if err != nil || text != "Transcript\nAlgorithms A\nCompilers (A-)" {
+		t.Errorf("Text() = %q, %v", text, err)
+	}
+
+	// A two-byte font, readable only through its ToUnicode map.
+	cmap := "/CIDInit /ProcSet findresource begin 12 dict begin begincmap\n" +
+		"1 begincodespacerange <0000> <FFFF> endcodespacerange\n" +
+		"1 beginbfchar <0003> <0020> endbfchar\n" +
+		"2 beginbfrange <0010> <0012> <0041> <0020> <0021> [<00E9> <D83DDE00>] endbfrange\n" +
+		"endcmap end end"
+	doc = &Document{cache: map[int]Object{
+		1: &Stream{Dict{}, []byte(cmap)},
+		2: &Stream{Dict{}, []byte("BT /F1 1 Tf [<00100011> -300 <0012>] TJ " +
+			"0 -10 Td <00200003 0021> Tj ET q BI /W 1 ID xEIx EI Q " +
+			"BT /F2 1 Tf <0010> Tj ET")}},
+	}
+	page := Page{Dict: Dict{
+		"Contents": Ref{2, 0},
+		"Resources": Dict{"Font": Dict{
+			"F1": Dict{"Subtype": Name("Type0"), "ToUnicode": Ref{1, 0}},
+			"F2": Dict{"Subtype": Name("Type0")},
+		}},
+	}}
+	text, err = doc.Text(page)
+	if err != nil || text != "AB C\né \U0001F600" {
+		t.Errorf("Text() with a ToUnicode map = %q, %v", text, err)
+	}
+}
+
+// readAll reads everything that previews read from data, and fails the test
+// if that panics.
+func readAll(t *testing.T, data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("reading %q panicked: %v", data, r)
+		}
+	}()
+	doc, err := Read(data)
+	if err != nil {
+		return
+	}
+	pages, err := doc.Pages()
+	if err != nil {
+		return
+	}
+	for _, page := range pages {
+		doc.Text(page)
+		doc.JPEG(page)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	objStm := func(dict string) string {
+		return "%PDF-1.5\n1 0 obj <</Type/Catalog/Pages 2 0 R>> endobj\n" +
+			"3 0 obj <<" + dict + ">> stream\n2 0 <<>>\nendstream endobj\n" +
+			"xref\n0 4\n0000000000 65535 f \n0000000009 00000 n \n" +
+			"0000000000 00000 n \n0000000053 00000 n \n" +
+			"trailer <</Root 1 0 R>>\nstartxref\n"
+	}
+	inputs := []string{
+		"%PDF-1.5\n1 0 obj <</Type/ObjStm/N 1/First -1/Length 2>> stream\nxx\nendstream endobj",
+		objStm("/Type/ObjStm/N 1/First -1/Length 8"),
+		objStm("/Type/ObjStm/N -1/First 4/Length 8"),
+		objStm("/Type/ObjStm/N 1000000000/First 4/Length 8"),
+		objStm("/Type/ObjStm/N 1/First 4/Length 9223372036854775807"),
+		"%PDF-1.4\n1 0 obj <</Length -5>> stream\nabc\nendstream endobj\n" +
+			"trailer <</Root 1 0 R/Prev -10/XRefStm -3>>\nstartxref\n-1\n",
+		"%PDF-1.4\nxref\n0 2\n0000000000 65535 f \n9999999999 00000 n \n" +
+			"trailer <</Root 1 0 R>>\nstartxref\n9\n",
+		"%PDF-1.5\n1 0 obj <</Type/XRef/W [1 8 1]/Index [-5 -1]/Length 0>> " +
+			"stream\n\nendstream endobj\nstartxref\n9\n",
+		"%PDF-1.5\n1 0 obj <</Type/XRef/W [1 8 0]/Size 1/Length 9>> stream\n" +
+			"\x01\xff\xff\xff\xff\xff\xff\xff\xff\nendstream endobj\nstartxref\n9\n",
+	}
+	for _, input := range inputs {
+		readAll(t, []byte(input))
+	}
+	// A compressed file with each of its bytes changed in turn.
+	data := compressedPDF()
+	for i := range data {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0xff
+		readAll(t, damaged)
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	defer func(max int) { maxDecodedSize = max }(maxDecodedSize)
+	maxDecodedSize = 1000
+	doc := &Document{cache: map[int]Object{}}
+	bomb := &Stream{Dict{"Filter": Name("FlateDecode")},
+		flate(make([]byte, 1001))}
+	if _, err := doc.decode(bomb); err != ErrTooLarge {
+		t.Errorf("decode of a stream that is too large: %v", err)
+	}
+	bomb.Data = flate(make([]byte, 1000))
+	if data, err := doc.decode(bomb); err != nil || len(data) != 1000 {
+		t.Errorf("decode of a stream at the limit: %v, %v", len(data), err)
+	}
+	params := Dict{"Predictor": int64(12), "Colors": int64(1 << 40),
+		"Columns": int64(1 << 40)}
+	if _, err := doc.unpredict(make([]byte, 10), params); err == nil {
+		t.Errorf("unpredict with huge rows did not fail")
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add(compressedPDF())
+	f.Add([]byte("%PDF-1.5\n1 0 obj <</Type/ObjStm/N 1/First -1/Length 2>> " +
+		"stream\nxx\nendstream endobj"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readAll(t, data)
+	})
+}
@@ -0,0 +1,429 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Where an object is stored: at an offset in the file, or at an index in an
+// object stream.
+type xrefEntry struct {
+	offset   int
+	inStream bool
+	stream   int
+	index    int
+}
+
+// A Document is a PDF file that has been read into memory.
+type Document struct {
+	buf     []byte
+	xref    map[int]xrefEntry
+	Trailer Dict
+	cache   map[int]Object
+	// Set once the objects have been found by scanning the file.
+	scanned bool
+}
+
+// Read parses a PDF file. If the file's cross-reference information is
+// damaged, Read finds the objects by scanning the file.
+func Read(data []byte) (*Document, error) {
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return nil, ErrNotPDF
+	}
+	doc := &Document{buf: data, xref: make(map[int]xrefEntry),
+		cache: make(map[int]Object)}
+	err := doc.readXrefs()
+	if err != nil || doc.Trailer["Root"] == nil {
+		err = doc.scan()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if doc.Trailer["Encrypt"] != nil {
+		return nil, ErrEncrypted
+	}
+	return doc, nil
+}
+
+// readXrefs reads the cross-reference sections, newest first, starting at
+// the last startxref.
+func (self *Document) readXrefs() error {
+	i := bytes.LastIndex(self.buf, []byte("startxref"))
+	if i < 0 {
+		return fmt.Errorf("no startxref")
+	}
+	p := &parser{buf: self.buf, pos: i + len("startxref")}
+	offset, ok := p.integer()
+	if !ok {
+		return fmt.Errorf("invalid startxref")
+	}
+	seen := make(map[int]bool)
+	for !seen[offset] {
+		seen[offset] = true
+		trailer, err := self.readXref(offset)
+		if err != nil {
+			return err
+		}
+		if self.Trailer == nil {
+			self.Trailer = trailer
+		}
+		// Hybrid files keep part of their cross-references in a stream.
+		if stm, ok := trailer["XRefStm"].(int64); ok && !seen[int(stm)] {
+			seen[int(stm)] = true
+			_, err = self.readXref(int(stm))
+			if err != nil {
+				return err
+			}
+		}
+		prev, ok := trailer["Prev"].(int64)
+		if !ok {
+			break
+		}
+		offset = int(prev)
+	}
+	return nil
+}
+
+// add records where object num is, unless a newer section already has.
+func (self *Document) add(num int, entry xrefEntry) {
+	if _, found := self.xref[num]; !found {
+		self.xref[num] = entry
+	}
+}
+
+// readXref reads the cross-reference table or stream at offset and returns
+// its trailer.
+func (self *Document) readXref(offset int) (Dict, error) {
+	if offset < 0 || offset >= len(self.buf) {
+		return nil, fmt.Errorf("xref offset %v out of range", offset)
+	}
+	p := &parser{buf: self.buf, pos: offset}
+	start := p.pos
+	if p.keyword() != "xref" {
+		p.pos = start
+		return self.readXrefStream(p)
+	}
+	for {
+		first, ok := p.integer()
+		if !ok {
+			break
+		}
+		count, ok := p.integer()
+		if !ok {
+			return nil, p.errorf("invalid xref subsection")
+		}
+		for i := 0; i < count; i++ {
+			off, ok1 := p.integer()
+			_, ok2 := p.integer()
+			kind := p.keyword()
+			if !ok1 || !ok2 || (kind != "n" && kind != "f") {
+				return nil, p.errorf("invalid xref entry")
+			}
+			if kind == "n" {
+				if off >= len(self.buf) {
+					return nil, p.errorf("xref offset %v out of range", off)
+				}
+				self.add(first+i, xrefEntry{offset: off})
+			} else {
+				self.add(first+i, xrefEntry{offset: -1})
+			}
+		}
+	}
+	if p.keyword() != "trailer" {
+		return nil, p.errorf("expected trailer")
+	}
+	obj, err := p.object()
+	if err != nil {
+		return nil, err
+	}
+	trailer, ok := obj.(Dict)
+	if !ok {
+		return nil, p.errorf("invalid trailer")
+	}
+	return trailer, nil
+}
+
+func (self *Document) readXrefStream(p *parser) (Dict, error) {
+	p.doc = self
+	_, obj, err := p.indirect()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := obj.(*Stream)
+	if !ok || s.Dict["Type"] != Name("XRef") {
+		return nil, p.errorf("expected an xref stream")
+	}
+	data, err := self.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	w, _ := s.Dict["W"].(Array)
+	if len(w) != 3 {
+		return nil, p.errorf("invalid xref stream widths")
+	}
+	var widths [3]int
+	for i := range widths {
+		widths[i] = self.integer(w[i], -1)
+		if widths[i] < 0 || widths[i] > 8 {
+			return nil, p.errorf("invalid xref stream widths")
+		}
+	}
+	index, _ := s.Dict["Index"].(Array)
+	if index == nil {
+		index = Array{int64(0), s.Dict["Size"]}
+	}
+	entryLen := widths[0] + widths[1] + widths[2]
+	for i := 0; i+1 < len(index); i += 2 {
+		first, count := self.integer(index[i], 0), self.integer(index[i+1], 0)
+		if first < 0 || count < 0 {
+			return nil, p.errorf("invalid xref stream index")
+		}
+		for j := 0; j < count && len(data) >= entryLen && entryLen > 0; j++ {
+			var fields [3]int
+			for k, width := range widths {
+				for _, b := range data[:width] {
+					fields[k] = fields[k]<<8 | int(b)
+				}
+				data = data[width:]
+			}
+			if widths[0] == 0 {
+				fields[0] = 1
+			}
+			switch fields[0] {
+			case 0:
+				self.add(first+j, xrefEntry{offset: -1})
+			case 1:
+				if fields[1] < 0 || fields[1] >= len(self.buf) {
+					return nil, p.errorf("xref offset %v out of range", fields[1])
+				}
+				self.add(first+j, xrefEntry{offset: fields[1]})
+			case 2:
+				if fields[1] < 0 || fields[2] < 0 {
+					return nil, p.errorf("invalid xref stream entry")
+				}
+				self.add(first+j, xrefEntry{inStream: true, stream: fields[1],
+					index: fields[2]})
+			}
+		}
+	}
+	return s.Dict, nil
+}
+
+var objPattern = regexp.MustCompile(`(?:^|[^0-9])(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+
+// scan finds objects by looking for "num gen obj" throughout the file, for
+// files whose cross-references are damaged. Later definitions win, as they
+// would in an incremental update. The trailer is the last one in the file,
+// or else one made up from the catalog.
+func (self *Document) scan() error {
+	self.scanned = true
+	self.xref = make(map[int]xrefEntry)
+	self.cache = make(map[int]Object)
+	for _, m := range objPattern.FindAllSubmatchIndex(self.buf, -1) {
+		num, _ := strconv.Atoi(string(self.buf[m[2]:m[3]]))
+		self.xref[num] = xrefEntry{offset: m[2]}
+	}
+	if i := bytes.LastIndex(self.buf, []byte("trailer")); i >= 0 {
+		p := &parser{buf: self.buf, pos: i + len("trailer")}
+		if trailer, ok := p.objectOrNil().(Dict); ok && trailer["Root"] != nil {
+			self.Trailer = trailer
+			return nil
+		}
+	}
+	for num := range self.xref {
+		if d, ok := self.Resolve(Ref{num, 0}).(Dict); ok &&
+			d["Type"] == Name("Catalog") {
+			self.Trailer = Dict{"Root": Ref{num, 0}}
+			return nil
+		}
+	}
+	// Objects in object streams have no "obj" to find.
+	for num := range self.xref {
+		s, ok := self.Resolve(Ref{num, 0}).(*Stream)
+		if !ok || s.Dict["Type"] != Name("ObjStm") {
+			continue
+		}
+		objs, err := self.objectStream(num)
+		if err != nil {
+			continue
+		}
+		for n, obj := range objs {
+			if d, ok := obj.(Dict); ok && d["Type"] == Name("Catalog") {
+				self.Trailer = Dict{"Root": Ref{n, 0}}
+				self.cache[n] = obj
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no document catalog")
+}
+
+func (self *parser) objectOrNil() Object {
+	obj, err := self.object()
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// Resolve returns the object that obj refers to, or obj itself if it is not
+// a reference. Missing and unreadable objects are null.
+func (self *Document) Resolve(obj Object) Object {
+	for i := 0; i < 32; i++ {
+		ref, ok := obj.(Ref)
+		if !ok {
+			return obj
+		}
+		obj = self.object(ref.Num)
+	}
+	return nil
+}
+
+func (self *Document) object(num int) Object {
+	if obj, found := self.cache[num]; found {
+		return obj
+	}
+	// Guard against objects whose stream lengths refer to themselves.
+	self.cache[num] = nil
+	obj, err := self.load(num)
+	if err != nil && !self.scanned {
+		// The offset is wrong; look for the object instead.
+		if self.scan() == nil {
+			obj, err = self.load(num)
+		}
+	}
+	if err != nil {
+		obj = nil
+	}
+	self.cache[num] = obj
+	return obj
+}
+
+func (self *Document) load(num int) (Object, error) {
+	entry, found := self.xref[num]
+	if !found || entry.offset < 0 {
+		return nil, nil
+	}
+	if entry.inStream {
+		objs, err := self.objectStream(entry.stream)
+		if err != nil {
+			return nil, err
+		}
+		return objs[num], nil
+	}
+	if entry.offset >= len(self.buf) {
+		return nil, fmt.Errorf("object %v out of range", num)
+	}
+	p := &parser{buf: self.buf, pos: entry.offset, doc: self}
+	ref, obj, err := p.indirect()
+	if err != nil {
+		return nil, err
+	}
+	if ref.Num != num {
+		return nil, fmt.Errorf("found object %v where %v should be", ref.Num,
+			num)
+	}
+	return obj, nil
+}
+
+// objectStream returns the objects in object stream num, by number.
+func (self *Document) objectStream(num int) (map[int]Object, error) {
+	s, ok := self.Resolve(Ref{num, 0}).(*Stream)
+	if !ok {
+		return nil, fmt.Errorf("object %v is not an object stream", num)
+	}
+	data, err := self.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	// Each object takes at least four bytes of the header: "0 0 ".
+	n := self.integer(s.Dict["N"], 0)
+	first := self.integer(s.Dict["First"], 0)
+	if first < 0 || first > len(data) || n < 0 || n > first/4+1 {
+		return nil, fmt.Errorf("invalid object stream %v", num)
+	}
+	header := &parser{buf: data[:first]}
+	objs := make(map[int]Object, n)
+	for i := 0; i < n; i++ {
+		objNum, ok1 := header.integer()
+		offset, ok2 := header.integer()
+		if !ok1 || !ok2 || offset > len(data)-first {
+			return nil, fmt.Errorf("invalid object stream %v", num)
+		}
+		p := &parser{buf: data, pos: first + offset, doc: self}
+		obj, err := p.object()
+		if err != nil {
+			return nil, err
+		}
+		// A newer definition elsewhere takes precedence.
+		if entry := self.xref[objNum]; entry.inStream && entry.stream == num {
+			self.cache[objNum] = obj
+		}
+		objs[objNum] = obj
+	}
+	return objs, nil
+}
+
+// A Page is a page of a document, with the attributes it inherits from the
+// page tree filled in.
+type Page struct {
+	Ref  Ref
+	Dict Dict
+}
+
+var inheritable = []Name{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// Pages returns the document's pages in order.
+func (self *Document) Pages() ([]Page, error) {
+	root, ok := self.Resolve(self.Trailer["Root"]).(Dict)
+	if !ok {
+		return nil, fmt.Errorf("no document catalog")
+	}
+	var pages []Page
+	seen := make(map[Ref]bool)
+	var walk func(node Object, inherited Dict)
+	walk = func(node Object, inherited Dict) {
+		ref, _ := node.(Ref)
+		if seen[ref] && ref != (Ref{}) {
+			return
+		}
+		seen[ref] = true
+		dict, ok := self.Resolve(node).(Dict)
+		if !ok {
+			return
+		}
+		kids, hasKids := self.Resolve(dict["Kids"]).(Array)
+		if dict["Type"] == Name("Pages") || (hasKids && dict["Type"] != Name("Page")) {
+			attrs := make(Dict)
+			for _, key := range inheritable {
+				if v, found := dict[key]; found {
+					attrs[key] = v
+				} else if v, found := inherited[key]; found {
+					attrs[key] = v
+				}
+			}
+			for _, kid := range kids {
+				walk(kid, attrs)
+			}
+			return
+		}
+		page := make(Dict, len(dict))
+		for k, v := range dict {
+			page[k] = v
+		}
+		for _, key := range inheritable {
+			if _, found := page[key]; !found && inherited[key] != nil {
+				page[key] = inherited[key]
+			}
+		}
+		pages = append(pages, Page{ref, page})
+	}
+	walk(root["Pages"], nil)
+	return pages, nil
+}
@@ -0,0 +1,331 @@
+package pdf
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Text returns the text that page shows, in the order it shows it, with a
+// newline wherever it moves to a new line. It decodes fonts with ToUnicode
+// maps and simple fonts in standard encodings (as Latin-1); text in other
+// fonts is left out.
+func (self *Document) Text(page Page) (string, error) {
+	content, err := self.contents(page)
+	if err != nil {
+		return "", err
+	}
+	fonts, _ := self.Resolve(self.resources(page)["Font"]).(Dict)
+	decoders := make(map[Name]*textDecoder)
+	var font *textDecoder
+
+	var out bytes.Buffer
+	show := func(s Object) {
+		if str, ok := s.(String); ok && font != nil {
+			out.WriteString(font.decode([]byte(str)))
+		}
+	}
+	p := &parser{buf: content}
+	var operands []Object
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.buf) {
+			break
+		}
+		c := p.buf[p.pos]
+		if c == '/' || c == '(' || c == '<' || c == '[' || isDigit(c) ||
+			c == '+' || c == '-' || c == '.' {
+			obj, err := p.object()
+			if err != nil {
+				// Skip what cannot be read, as viewers do.
+				p.pos++
+				operands = nil
+				continue
+			}
+			operands = append(operands, obj)
+			continue
+		}
+		op := p.keyword()
+		if op == "" {
+			p.pos++
+		}
+		last := func() Object {
+			if len(operands) == 0 {
+				return nil
+			}
+			return operands[len(operands)-1]
+		}
+		switch op {
+		case "Tf":
+			if len(operands) >= 2 {
+				name, _ := operands[0].(Name)
+				if _, found := decoders[name]; !found {
+					f, _ := self.Resolve(fonts[name]).(Dict)
+					decoders[name] = self.newTextDecoder(f)
+				}
+				font = decoders[name]
+			}
+		case "Tj":
+			show(last())
+		case "'", "\"":
+			out.WriteByte('\n')
+			show(last())
+		case "TJ":
+			arr, _ := last().(Array)
+			for _, elt := range arr {
+				switch n := elt.(type) {
+				case int64:
+					if n < -250 {
+						out.WriteByte(' ')
+					}
+				case float64:
+					if n < -250 {
+						out.WriteByte(' ')
+					}
+				default:
+					show(elt)
+				}
+			}
+		case "Td", "TD":
+			if len(operands) == 2 && operands[1] != int64(0) {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(' ')
+			}
+		case "T*", "Tm", "BT", "ET":
+			out.WriteByte('\n')
+		case "ID":
+			p.pos = inlineImageEnd(p.buf, p.pos)
+		}
+		operands = nil
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	text := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			text = append(text, line)
+		}
+	}
+	return strings.Join(text, "\n"), nil
+}
+
+// inlineImageEnd returns the position after the EI that ends the data of an
+// inline image, which starts at pos.
+func inlineImageEnd(buf []byte, pos int) int {
+	for i := pos + 1; i+1 < len(buf); i++ {
+		if buf[i] == 'E' && buf[i+1] == 'I' && isWhite(buf[i-1]) &&
+			(i+2 == len(buf) || !isRegular(buf[i+2])) {
+			return i + 2
+		}
+	}
+	return len(buf)
+}
+
+func (self *Document) resources(page Page) Dict {
+	res, _ := self.Resolve(page.Dict["Resources"]).(Dict)
+	return res
+}
+
+// contents returns the page's content streams, decoded and joined.
+func (self *Document) contents(page Page) ([]byte, error) {
+	var streams Array
+	switch c := self.Resolve(page.Dict["Contents"]).(type) {
+	case *Stream:
+		streams = Array{c}
+	case Array:
+		streams = c
+	}
+	var content []byte
+	for _, s := range streams {
+		stream, ok := self.Resolve(s).(*Stream)
+		if !ok {
+			continue
+		}
+		data, err := self.decode(stream)
+		if err != nil {
+			return nil, err
+		}
+		content = append(append(content, data...), '\n')
+	}
+	return content, nil
+}
+
+// A textDecoder maps the codes in strings shown in a font to text.
+type textDecoder struct {
+	// By code, from the font's ToUnicode map. If nil, codes are single
+	// Latin-1 bytes.
+	codes map[string]string
+	// Whether codes are two bytes and there is no map to read them with.
+	unreadable bool
+}
+
+func (self *Document) newTextDecoder(font Dict) *textDecoder {
+	if s, ok := self.Resolve(font["ToUnicode"]).(*Stream); ok {
+		if data, err := self.decode(s); err == nil {
+			if codes := parseCMap(data); len(codes) > 0 {
+				return &textDecoder{codes: codes}
+			}
+		}
+	}
+	return &textDecoder{unreadable: font["Subtype"] == Name("Type0")}
+}
+
+func (self *textDecoder) decode(s []byte) string {
+	if self.unreadable {
+		return ""
+	}
+	if self.codes == nil {
+		runes := make([]rune, len(s))
+		for i, b := range s {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	var out strings.Builder
+	for len(s) > 0 {
+		n := 1
+		for ; n <= 4 && n <= len(s); n++ {
+			if text, found := self.codes[string(s[:n])]; found {
+				out.WriteString(text)
+				break
+			}
+		}
+		if n > 4 || n > len(s) {
+			n = 1
+		}
+		s = s[n:]
+	}
+	return out.String()
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap.
+func parseCMap(data []byte) map[string]string {
+	codes := make(map[string]string)
+	p := &parser{buf: data}
+	var operands []Object
+	mode := ""
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.buf) {
+			return codes
+		}
+		c := p.buf[p.pos]
+		if c == '<' || c == '[' || c == '/' || c == '(' || isDigit(c) {
+			obj, err := p.object()
+			if err != nil {
+				return codes
+			}
+			operands = append(operands, obj)
+		} else {
+			op := p.keyword()
+			if op == "" {
+				p.pos++
+			}
+			switch op {
+			case "beginbfchar", "beginbfrange":
+				mode = op
+			case "endbfchar", "endbfrange":
+				mode = ""
+			}
+			operands = nil
+			continue
+		}
+
+		switch {
+		case mode == "beginbfchar" && len(operands) == 2:
+			src, _ := operands[0].(String)
+			dst, _ := operands[1].(String)
+			codes[string(src)] = utf16BE([]byte(dst))
+			operands = nil
+		case mode == "beginbfrange" && len(operands) == 3:
+			lo, _ := operands[0].(String)
+			hi, _ := operands[1].(String)
+			if len(lo) == len(hi) && len(lo) > 0 && len(lo) <= 4 {
+				mapRange(codes, []byte(lo), codeValue([]byte(hi)), operands[2])
+			}
+			operands = nil
+		case mode == "":
+			operands = nil
+		}
+	}
+}
+
+// mapRange maps the codes from lo to hi to consecutive characters from dst,
+// or to the strings in dst if it is an array.
+func mapRange(codes map[string]string, lo []byte, hi int, dst Object) {
+	start := codeValue(lo)
+	if hi < start || hi-start > 0xffff {
+		return
+	}
+	for code := start; code <= hi; code++ {
+		src := make([]byte, len(lo))
+		for i, v := len(src)-1, code; i >= 0; i, v = i-1, v>>8 {
+			src[i] = byte(v)
+		}
+		switch d := dst.(type) {
+		case String:
+			text := []rune(utf16BE([]byte(d)))
+			if len(text) > 0 {
+				text[len(text)-1] += rune(code - start)
+			}
+			codes[string(src)] = string(text)
+		case Array:
+			if code-start < len(d) {
+				if s, ok := d[code-start].(String); ok {
+					codes[string(src)] = utf16BE([]byte(s))
+				}
+			}
+		}
+	}
+}
+
+func codeValue(code []byte) int {
+	v := 0
+	for _, b := range code {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// utf16BE decodes UTF-16BE text, as ToUnicode maps hold it.
+func utf16BE(b []byte) string {
+	var runes []rune
+	for i := 0; i+1 < len(b); i += 2 {
+		r := rune(b[i])<<8 | rune(b[i+1])
+		if r >= 0xd800 && r < 0xdc00 && i+3 < len(b) {
+			lo := rune(b[i+2])<<8 | rune(b[i+3])
+			if lo >= 0xdc00 && lo < 0xe000 {
+				r = 0x10000 + (r-0xd800)<<10 + (lo - 0xdc00)
+				i += 2
+			}
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// JPEG returns the data of the largest JPEG image that page uses, or nil if
+// it uses none. A scanned page is usually one such image.
+func (self *Document) JPEG(page Page) []byte {
+	xobjects, _ := self.Resolve(self.resources(page)["XObject"]).(Dict)
+	var largest []byte
+	largestArea := 0
+	for _, obj := range xobjects {
+		s, ok := self.Resolve(obj).(*Stream)
+		if !ok || self.Resolve(s.Dict["Subtype"]) != Name("Image") {
+			continue
+		}
+		filter := self.Resolve(s.Dict["Filter"])
+		if arr, ok := filter.(Array); ok && len(arr) == 1 {
+			filter = self.Resolve(arr[0])
+		}
+		if filter != Name("DCTDecode") {
+			continue
+		}
+		area := self.integer(s.Dict["Width"], 0) * self.integer(s.Dict["Height"], 0)
+		if area > largestArea {
+			largest, largestArea = s.Data, area
+		}
+	}
+	return largest
+}
@@ -0,0 +1,371 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Builder assembles a new document from text pages and the pages of other
+// documents. Each part starts an entry in the document's outline.
+type Builder struct {
+	objects []Object // object n is objects[n-1]
+	pages   []Ref
+	outline []outlineEntry
+	root    Ref // the page tree
+	font    Ref
+}
+
+type outlineEntry struct {
+	title string
+	page  Ref
+}
+
+func NewBuilder() *Builder {
+	b := &Builder{}
+	b.root = b.reserve()
+	return b
+}
+
+func (self *Builder) reserve() Ref {
+	self.objects = append(self.objects, nil)
+	return Ref{len(self.objects), 0}
+}
+
+func (self *Builder) add(obj Object) Ref {
+	ref := self.reserve()
+	self.objects[ref.Num-1] = obj
+	return ref
+}
+
+// US Letter, in points.
+const pageWidth, pageHeight = 612, 792
+const margin = 72
+
+var letterBox = Array{int64(0), int64(0), int64(pageWidth), int64(pageHeight)}
+
+// Text pages wrap lines at this many characters.
+const lineWidth = 80
+
+// AddText adds pages showing title and then lines of text, wrapped to fit.
+func (self *Builder) AddText(title string, lines []string) {
+	if self.font == (Ref{}) {
+		self.font = self.add(Dict{
+			"Type":     Name("Font"),
+			"Subtype":  Name("Type1"),
+			"BaseFont": Name("Helvetica"),
+			"Encoding": Name("WinAnsiEncoding"),
+		})
+	}
+	var wrapped []string
+	for _, line := range lines {
+		wrapped = append(wrapped, wrap(line, lineWidth)...)
+	}
+	first := true
+	for first || len(wrapped) > 0 {
+		var content bytes.Buffer
+		y := pageHeight - margin
+		content.WriteString("BT\n")
+		if first {
+			fmt.Fprintf(&content, "/F1 18 Tf %v %v Td %s Tj\n", margin, y,
+				serialize(latin1(title)))
+			y -= 36
+			content.WriteString("/F1 11 Tf 0 -36 Td\n")
+		} else {
+			fmt.Fprintf(&content, "/F1 11 Tf %v %v Td\n", margin, y)
+		}
+		for len(wrapped) > 0 && y > margin {
+			fmt.Fprintf(&content, "%s Tj 0 -15 Td\n",
+				serialize(latin1(wrapped[0])))
+			wrapped = wrapped[1:]
+			y -= 15
+		}
+		content.WriteString("ET\n")
+		contents := self.add(&Stream{Dict{"Length": int64(content.Len())},
+			content.Bytes()})
+		page := self.add(Dict{
+			"Type":      Name("Page"),
+			"Parent":    self.root,
+			"MediaBox":  letterBox,
+			"Contents":  contents,
+			"Resources": Dict{"Font": Dict{"F1": self.font}},
+		})
+		if first {
+			self.outline = append(self.outline, outlineEntry{title, page})
+		}
+		self.pages = append(self.pages, page)
+		first = false
+	}
+}
+
+// wrap breaks line into lines of at most width characters, at spaces where
+// possible.
+func wrap(line string, width int) []string {
+	var lines []string
+	for utf8.RuneCountInString(line) > width {
+		runes := []rune(line)
+		cut := strings.LastIndex(string(runes[:width+1]), " ")
+		if cut <= 0 {
+			cut = len(string(runes[:width]))
+		}
+		lines = append(lines, strings.TrimRight(line[:cut], " "))
+		line = strings.TrimLeft(line[cut:], " ")
+	}
+	return append(lines, line)
+}
+
+// latin1 encodes s for the standard fonts, replacing characters they lack.
+func latin1(s string) String {
+	var b []byte
+	for _, r := range s {
+		if r < 256 && r != '\t' {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, '?')
+		}
+	}
+	return String(b)
+}
+
+// AddDocument adds the pages of doc, with title as their outline entry.
+func (self *Builder) AddDocument(title string, doc *Document) error {
+	pages, err := doc.Pages()
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("the document has no pages")
+	}
+	c := &copier{self, doc, make(map[Ref]Ref)}
+	var refs []Ref
+	for _, page := range pages {
+		ref := self.reserve()
+		if page.Ref != (Ref{}) {
+			c.copied[page.Ref] = ref
+		}
+		refs = append(refs, ref)
+	}
+	for i, page := range pages {
+		dict := c.copy(page.Dict).(Dict)
+		dict["Parent"] = self.root
+		if dict["MediaBox"] == nil {
+			dict["MediaBox"] = letterBox
+		}
+		self.objects[refs[i].Num-1] = dict
+	}
+	self.outline = append(self.outline, outlineEntry{title, refs[0]})
+	self.pages = append(self.pages, refs...)
+	return nil
+}
+
+// A copier copies objects from a document into a builder, renumbering them.
+type copier struct {
+	b      *Builder
+	doc    *Document
+	copied map[Ref]Ref
+}
+
+func (self *copier) copy(obj Object) Object {
+	switch o := obj.(type) {
+	case Ref:
+		if ref, found := self.copied[o]; found {
+			return ref
+		}
+		target := self.doc.Resolve(o)
+		if d, ok := target.(Dict); ok && d["Type"] == Name("Pages") {
+			// Parents of annotations and of pages not in the tree.
+			return self.b.root
+		}
+		ref := self.b.reserve()
+		self.copied[o] = ref
+		self.b.objects[ref.Num-1] = self.copy(target)
+		return ref
+	case Dict:
+		d := make(Dict, len(o))
+		for k, v := range o {
+			d[k] = self.copy(v)
+		}
+		return d
+	case Array:
+		a := make(Array, len(o))
+		for i, v := range o {
+			a[i] = self.copy(v)
+		}
+		return a
+	case *Stream:
+		d := make(Dict, len(o.Dict))
+		for k, v := range o.Dict {
+			if k != "Length" {
+				d[k] = self.copy(v)
+			}
+		}
+		d["Length"] = int64(len(o.Data))
+		return &Stream{d, o.Data}
+	}
+	return obj
+}
+
+// WriteTo writes the document. Call it once, after adding every part.
+func (self *Builder) WriteTo(w io.Writer) (int64, error) {
+	kids := make(Array, len(self.pages))
+	for i, page := range self.pages {
+		kids[i] = page
+	}
+	self.objects[self.root.Num-1] = Dict{
+		"Type":  Name("Pages"),
+		"Kids":  kids,
+		"Count": int64(len(kids)),
+	}
+	catalog := Dict{"Type": Name("Catalog"), "Pages": self.root}
+	if len(self.outline) > 0 {
+		catalog["Outlines"] = self.addOutline()
+		catalog["PageMode"] = Name("UseOutlines")
+	}
+	catalogRef := self.add(catalog)
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(self.objects))
+	for i, obj := range self.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%v 0 obj\n", i+1)
+		out.Write(serialize(obj))
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %v\n0000000000 65535 f \n", len(self.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n%s\nstartxref\n%v\n%%%%EOF\n", serialize(Dict{
+		"Size": int64(len(self.objects) + 1),
+		"Root": catalogRef,
+	}), xref)
+	n, err := w.Write(out.Bytes())
+	return int64(n), err
+}
+
+func (self *Builder) addOutline() Ref {
+	root := self.reserve()
+	items := make([]Ref, len(self.outline))
+	for i := range items {
+		items[i] = self.reserve()
+	}
+	for i, entry := range self.outline {
+		item := Dict{
+			"Title":  String(utf16(entry.title)),
+			"Parent": root,
+			"Dest":   Array{entry.page, Name("Fit")},
+		}
+		if i > 0 {
+			item["Prev"] = items[i-1]
+		}
+		if i+1 < len(items) {
+			item["Next"] = items[i+1]
+		}
+		self.objects[items[i].Num-1] = item
+	}
+	self.objects[root.Num-1] = Dict{
+		"Type":  Name("Outlines"),
+		"First": items[0],
+		"Last":  items[len(items)-1],
+		"Count": int64(len(items)),
+	}
+	return root
+}
+
+// utf16 encodes s as a PDF text string in UTF-16BE, for outline titles.
+func utf16(s string) string {
+	b := []byte{0xfe, 0xff}
+	for _, r := range s {
+		if r >= 0x10000 {
+			r -= 0x10000
+			hi, lo := 0xd800+(r>>10), 0xdc00+(r&0x3ff)
+			b = append(b, byte(hi>>8), byte(hi), byte(lo>>8), byte(lo))
+		} else {
+			b = append(b, byte(r>>8), byte(r))
+		}
+	}
+	return string(b)
+}
+
+func serialize(obj Object) []byte {
+	var out bytes.Buffer
+	write(&out, obj)
+	return out.Bytes()
+}
+
+func write(out *bytes.Buffer, obj Object) {
+	switch o := obj.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(o))
+	case int64:
+		out.WriteString(strconv.FormatInt(o, 10))
+	case int:
+		out.WriteString(strconv.Itoa(o))
+	case float64:
+		out.WriteString(strconv.FormatFloat(o, 'f', -1, 64))
+	case String:
+		out.WriteByte('(')
+		for i := 0; i < len(o); i++ {
+			c := o[i]
+			switch {
+			case c == '(' || c == ')' || c == '\\':
+				out.WriteByte('\\')
+				out.WriteByte(c)
+			case c < 0x20 || c >= 0x7f:
+				fmt.Fprintf(out, "\\%03o", c)
+			default:
+				out.WriteByte(c)
+			}
+		}
+		out.WriteByte(')')
+	case Name:
+		out.WriteByte('/')
+		for i := 0; i < len(o); i++ {
+			c := o[i]
+			if c <= 0x20 || c >= 0x7f || c == '#' || isDelim(c) {
+				fmt.Fprintf(out, "#%02x", c)
+			} else {
+				out.WriteByte(c)
+			}
+		}
+	case Array:
+		out.WriteByte('[')
+		for i, v := range o {
+			if i > 0 {
+				out.WriteByte(' ')
+			}
+			write(out, v)
+		}
+		out.WriteByte(']')
+	case Dict:
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		out.WriteString("<<")
+		for _, k := range keys {
+			write(out, Name(k))
+			out.WriteByte(' ')
+			write(out, o[Name(k)])
+		}
+		out.WriteString(">>")
+	case Ref:
+		fmt.Fprintf(out, "%v %v R", o.Num, o.Gen)
+	case *Stream:
+		write(out, o.Dict)
+		out.WriteString("\nstream\n")
+		out.Write(o.Data)
+		out.WriteString("\nendstream")
+	default:
+		panic(fmt.Sprintf("cannot write %T", obj))
+	}
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"caps"
+	"export"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"model"
 	"net"
@@ -12,6 +15,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 	"util"
 )
@@ -20,21 +25,167 @@ const dataKey = "data"
 const materialKey = "material"
 const fetchCommentsKey = "fetchComments"
 const postCommentKey = "postComment"
+const editCommentKey = "editComment"
+const deleteCommentKey = "deleteComment"
 const setHighlightKey = "setHighlight"
 const delHighlightKey = "delHighlight"
 const setScoreKey = "setScore"
+const evaluateKey = "evaluate"
+const annotationsKey = "annotations"
+const deleteAnnotationKey = "deleteAnnotation"
+const packetKey = "packet"
+const previewKey = "preview"
+const exportKey = "export"
+const historyKey = "history"
+const setMatchKey = "setMatch"
+const reviewersKey = "reviewers"
+const setupKey = "setup"
+const notifyPrefsKey = "notifyPrefs"
+const notificationsKey = "notifications"
+const applicantLinkKey = "applicantLink"
+const applicantKey = "applicant"
+const assignKey = "assign"
 
 var capServer caps.CapServer
-var dept *model.Dept
+var depts map[model.Namespace]*model.Dept
+
+// Emails notifications as they happen, if set by SetMailer. Without it,
+// notifications wait for 'apply2 digest'.
+var notifyMailer *model.Mailer
+
+func SetMailer(m *model.Mailer) {
+	notifyMailer = m
+}
+
+// The closure of the capabilities granted at login.
+type ReviewerEnv struct {
+	Dept       model.Namespace  `json:"d"`
+	ReviewerId model.ReviewerId `json:"i"`
+}
 
 type FetchCommentsEnv struct {
+	Dept         model.Namespace  `json:"d"`
 	ReviewerName string           `json:"n"`
 	ReviewerId   model.ReviewerId `json:"i"`
 	AppId        string           `json:"a"`
 }
 
-func dataHandler(key string, w http.ResponseWriter, r *http.Request) {
-	apps, err := dept.Applications(key)
+type CommentEnv struct {
+	Dept       model.Namespace  `json:"d"`
+	ReviewerId model.ReviewerId `json:"i"`
+	CommentId  string           `json:"c"`
+}
+
+// Grants capabilities to edit and delete a comment to its author.
+func grantCommentCaps(ns model.Namespace, comment *model.Comment) map[string]string {
+	env, err := util.JSONToString(&CommentEnv{ns, comment.ReviewerId,
+		comment.Id})
+	if err != nil {
+		panic(err)
+	}
+	return map[string]string{
+		"edit":   capServer.Grant(editCommentKey, env),
+		"delete": capServer.Grant(deleteCommentKey, env),
+	}
+}
+
+type AnnotationEnv struct {
+	Dept         model.Namespace  `json:"d"`
+	ReviewerId   model.ReviewerId `json:"i"`
+	AnnotationId string           `json:"a"`
+}
+
+type MatchEnv struct {
+	Dept       model.Namespace  `json:"d"`
+	ReviewerId model.ReviewerId `json:"i"`
+	MatchId    string           `json:"m"`
+}
+
+// The closure of a password setup link. The nonce must match the reviewer's
+// pending invitation.
+type SetupEnv struct {
+	Dept       model.Namespace  `json:"d"`
+	ReviewerId model.ReviewerId `json:"i"`
+	Nonce      string           `json:"n"`
+}
+
+// The closure of an applicant's link. The nonce must match the applicant's
+// current link.
+type ApplicantEnv struct {
+	Dept  model.Namespace `json:"d"`
+	AppId string          `json:"a"`
+	Nonce string          `json:"n"`
+}
+
+func grantReviewer(key string, ns model.Namespace, revId model.ReviewerId) string {
+	env, err := util.JSONToString(&ReviewerEnv{ns, revId})
+	if err != nil {
+		panic(err)
+	}
+	return capServer.Grant(key, env)
+}
+
+// Decodes the closure of a capability granted by grantReviewer.
+func reviewerEnv(v string) (*model.Dept, model.ReviewerId) {
+	var env ReviewerEnv
+	err := util.StringToJSON(v, &env)
+	if err != nil {
+		panic(err)
+	}
+	return deptOf(env.Dept), env.ReviewerId
+}
+
+func deptOf(ns model.Namespace) *model.Dept {
+	dept, found := depts[ns]
+	if !found {
+		panic(fmt.Sprintf("department %q is not served", ns))
+	}
+	return dept
+}
+
+// The fields that every capability's closure shares. Capabilities granted to
+// reviewers also name the reviewer.
+type capEnv struct {
+	Dept       model.Namespace  `json:"d"`
+	ReviewerId model.ReviewerId `json:"i"`
+}
+
+// checked refuses requests to a department that was deleted after the
+// server started, and requests from reviewers who were disabled or deleted
+// after they logged in. Capabilities do not expire, so these would otherwise
+// still work.
+func checked(handler caps.HandlerFunc) caps.HandlerFunc {
+	return func(v string, w http.ResponseWriter, r *http.Request) {
+		var env capEnv
+		err := util.StringToJSON(v, &env)
+		if err != nil {
+			panic(err)
+		}
+		dept := deptOf(env.Dept)
+		if dept.Deletion() != nil {
+			log.Printf("%v ERROR request to deleted department %q", r.RemoteAddr,
+				env.Dept)
+			w.WriteHeader(http.StatusGone)
+			r.Close = true
+			return
+		}
+		if env.ReviewerId != "" {
+			rev, err := dept.GetReviewerById(env.ReviewerId)
+			if err != nil || rev.Disabled {
+				log.Printf("%v SECURITY ERROR %v is disabled or deleted and used "+
+					"a capability", r.RemoteAddr, env.ReviewerId)
+				w.WriteHeader(http.StatusForbidden)
+				r.Close = true
+				return
+			}
+		}
+		handler(v, w, r)
+	}
+}
+
+func dataHandler(v string, w http.ResponseWriter, r *http.Request) {
+	dept, key := reviewerEnv(v)
+	apps, err := dept.Applications(string(key))
 	if err != nil {
 		log.Printf("reading apps: %v", err)
 		return
@@ -47,10 +198,11 @@ func dataHandler(key string, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func materialHandler(key string, w http.ResponseWriter, r *http.Request) {
+func materialHandler(v string, w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		panic("expected GET")
 	}
+	dept, key := reviewerEnv(v)
 
 	untrustedDocName, err := url.QueryUnescape(r.URL.RawQuery)
 	if err != nil {
@@ -69,18 +221,169 @@ func materialHandler(key string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	upload, err := dept.OpenUpload(docName)
+	if err == model.ErrNoUpload {
+		w.WriteHeader(http.StatusNotFound)
+		r.Close = true
+		return
+	}
+	if err != nil {
+		log.Printf("dept.OpenUpload(%v) error: %v", docName, err)
+		w.WriteHeader(http.StatusBadGateway)
+		r.Close = true
+		return
+	}
+	defer upload.Close()
+
 	log.Printf("%v %v downloaded %v", r.RemoteAddr, key, docName)
+	// Uploads come from applicants and letter writers, so only PDFs are shown
+	// in the browser; anything else, e.g., HTML with scripts, is downloaded.
+	disposition := "attachment"
+	if upload.ContentType == "application/pdf" {
+		disposition = "inline"
+	}
 	w.Header().Add("Content-Disposition",
-		fmt.Sprintf("inline; filename = %q", docName))
-  w.Header().Add("Content-Type", "application/pdf")
-	err = dept.DownloadFile(docName, w)
+		fmt.Sprintf("%v; filename = %q", disposition, docName))
+	w.Header().Add("Content-Type", upload.ContentType)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	// The capability in the URL may be revoked, so browsers may cache uploads
+	// only briefly, and must not share them.
+	w.Header().Add("Cache-Control", "private, max-age=3600")
+	if upload.ETag != "" {
+		w.Header().Add("ETag", upload.ETag)
+	}
+	// Handles Range, If-None-Match and If-Modified-Since.
+	http.ServeContent(w, r, docName, upload.ModTime, upload)
+}
+
+// Responds with the applicant's materials merged into one PDF, after a cover
+// page.
+func packetHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		panic("expected GET")
+	}
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
 	if err != nil {
-		log.Printf("dept.DownloadFile(%v, _) error: %v", docName, err)
+		panic(err)
+	}
+	data, err := deptOf(arg.Dept).Packet(arg.AppId)
+	if err != nil {
+		log.Printf("%v ERROR Packet(%v): %v", r.RemoteAddr, arg.AppId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		r.Close = true
+		return
+	}
+	log.Printf("%v %v downloaded the packet of %v", r.RemoteAddr,
+		arg.ReviewerId, arg.AppId)
+	w.Header().Add("Content-Disposition",
+		fmt.Sprintf("inline; filename = %q", arg.AppId+"-packet.pdf"))
+	w.Header().Add("Content-Type", "application/pdf")
+	w.Write(data)
+}
+
+// Responds with the thumbnail of the first page of the upload named by the
+// query.
+func previewHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		panic("expected GET")
+	}
+	dept, _ := reviewerEnv(v)
+
+	name, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		panic(err)
+	}
+	data, err := dept.PreviewImage(name)
+	if err == model.ErrNoUpload {
+		w.WriteHeader(http.StatusNotFound)
+		r.Close = true
+		return
+	}
+	if err != nil {
+		log.Printf("dept.PreviewImage(%v) error: %v", name, err)
+		w.WriteHeader(http.StatusBadGateway)
+		r.Close = true
+		return
+	}
+	w.Header().Add("Content-Type", "image/png")
+	w.Header().Add("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// Exports the department's applications. Accepts the query parameters format
+// ("csv", "json" or "xlsx"), columns (comma-separated column keys) and filter
+// (a filter serialized by the client).
+func exportHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		panic("expected GET")
+	}
+	dept, key := reviewerEnv(v)
+
+	rev, err := dept.GetReviewerById(key)
+	if err != nil {
+		panic(err)
+	}
+	if !rev.Chair {
+		log.Printf("%v SECURITY ERROR %v is not a chair and tried to export",
+			r.RemoteAddr, key)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		panic(err)
+	}
+	opts := &export.Options{Format: query.Get("format")}
+	if opts.Format == "" {
+		opts.Format = "csv"
+	}
+	if columns := query.Get("columns"); columns != "" {
+		opts.Columns = strings.Split(columns, ",")
+	}
+	if filter := query.Get("filter"); filter != "" {
+		opts.Filter, err = export.ParseFilter([]byte(filter))
+		if err != nil {
+			log.Printf("%v ERROR parsing export filter: %v", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+	}
+
+	apps, err := dept.Applications(string(key))
+	if err != nil {
+		panic(err)
+	}
+	reviewers, err := dept.GetReviewerIdMap()
+	if err != nil {
+		panic(err)
+	}
+
+	var buf bytes.Buffer
+	err = export.Write(&buf, apps, reviewers, opts)
+	if err != nil {
+		log.Printf("%v ERROR exporting: %v", r.RemoteAddr, err)
 		w.WriteHeader(http.StatusBadRequest)
 		r.Close = true
+		return
 	}
+
+	log.Printf("%v %v exported %v applications as %v", r.RemoteAddr, key,
+		len(apps), opts.Format)
+	w.Header().Add("Content-Type", export.ContentType(opts.Format))
+	w.Header().Add("Content-Disposition",
+		fmt.Sprintf("attachment; filename = %q", "applicants."+opts.Format))
+	w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
 }
 
+// Posts the body as a comment, replying to the comment in the query parameter
+// parent, if any, and visible as the query parameter visibility says (see
+// model.Comment.VisibleTo). Responds with the new comment's id, text,
+// HTML, visibility and caps.
 func postCommentHandler(v string, w http.ResponseWriter, r *http.Request) {
 	// TODO: use and enforce PUT
 	var arg FetchCommentsEnv
@@ -89,26 +392,131 @@ func postCommentHandler(v string, w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	buf := make([]byte, r.ContentLength)
-	_, err = io.ReadFull(r.Body, buf)
+	buf, err := readComment(r)
+	if err == model.ErrCommentTooLong {
+		log.Printf("%v ERROR %v posted a comment of over %v bytes", r.RemoteAddr,
+			arg.ReviewerId, model.MaxCommentLength)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		r.Close = true
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 
 	now := time.Now().Unix()
 
-	err = dept.NewComment(&model.Comment{arg.AppId, arg.ReviewerId,
-		arg.ReviewerName, float64(now), string(buf)})
+	dept := deptOf(arg.Dept)
+	comment := &model.Comment{
+		ApplicantId:  arg.AppId,
+		ReviewerId:   arg.ReviewerId,
+		ReviewerName: arg.ReviewerName,
+		Timestamp:    float64(now),
+		Text:         string(buf),
+		ParentId:     r.URL.Query().Get("parent"),
+		Visibility:   r.URL.Query().Get("visibility"),
+	}
+	err = dept.NewComment(comment)
+	if err != nil {
+		log.Printf("%v ERROR NewComment by %v: %v", r.RemoteAddr, arg.ReviewerId,
+			err)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	err = dept.NotifyComment(comment, notifyMailer)
+	if err != nil {
+		log.Printf("%v ERROR notifying of a comment by %v: %v", r.RemoteAddr,
+			arg.ReviewerId, err)
+	}
+	_ = util.JSONResponse(w, map[string]interface{}{
+		"id":         comment.Id,
+		"text":       comment.Text,
+		"html":       comment.HTML,
+		"visibility": comment.Visibility,
+		"caps":       grantCommentCaps(arg.Dept, comment),
+	})
+}
+
+// Replaces the text of a comment with the body. Responds with the new text
+// rendered as HTML.
+func editCommentHandler(v string, w http.ResponseWriter, r *http.Request) {
+	changeComment(v, w, r, func(dept *model.Dept,
+		env *CommentEnv) (interface{}, error) {
+		buf, err := readComment(r)
+		if err != nil {
+			return nil, err
+		}
+		html, err := dept.EditComment(env.CommentId, env.ReviewerId, string(buf))
+		return map[string]interface{}{"html": html}, err
+	})
+}
+
+// readComment reads the text of a comment from the body of the request, which
+// may not say how long it is. Returns model.ErrCommentTooLong if it is too
+// long.
+func readComment(r *http.Request) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body,
+		model.MaxCommentLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > model.MaxCommentLength {
+		return nil, model.ErrCommentTooLong
+	}
+	return buf, nil
+}
+
+func deleteCommentHandler(v string, w http.ResponseWriter, r *http.Request) {
+	changeComment(v, w, r, func(dept *model.Dept,
+		env *CommentEnv) (interface{}, error) {
+		return nil, dept.DeleteComment(env.CommentId, env.ReviewerId)
+	})
+}
+
+// Runs change on the comment in the closure and responds with its result, if
+// any.
+func changeComment(v string, w http.ResponseWriter, r *http.Request,
+	change func(dept *model.Dept, env *CommentEnv) (interface{}, error)) {
+	var env CommentEnv
+	err := util.StringToJSON(v, &env)
 	if err != nil {
 		panic(err)
 	}
+	if r.Method != "POST" {
+		log.Printf("%v SECURITY ERROR %v trying to %v to %v", r.RemoteAddr,
+			env.ReviewerId, r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	resp, err := change(deptOf(env.Dept), &env)
+	if err == model.ErrNotAuthor {
+		log.Printf("%v SECURITY ERROR %v tried to change comment %v",
+			r.RemoteAddr, env.ReviewerId, env.CommentId)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+	if err != nil {
+		log.Printf("%v ERROR changing comment %v: %v", r.RemoteAddr,
+			env.CommentId, err)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	if resp != nil {
+		_ = util.JSONResponse(w, resp)
+		return
+	}
 	w.WriteHeader(200)
 }
 
-func fetchCommentsHandler(key string, w http.ResponseWriter, r *http.Request) {
+func fetchCommentsHandler(v string, w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		panic("expected GET")
 	}
+	dept, key := reviewerEnv(v)
 
 	query, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
@@ -116,17 +524,18 @@ func fetchCommentsHandler(key string, w http.ResponseWriter, r *http.Request) {
 	}
 	appId := query.Get("appId")
 
-	comments, err := dept.LoadComments(appId)
+	rev, err := dept.GetReviewerById(key)
 	if err != nil {
 		panic(err)
 	}
 
-	rev, err := dept.GetReviewerById(model.ReviewerId(key))
+	comments, err := dept.LoadComments(appId, rev)
 	if err != nil {
 		panic(err)
 	}
 
-	env, err := util.JSONToString(&FetchCommentsEnv{rev.Name, rev.Id, appId})
+	env, err := util.JSONToString(&FetchCommentsEnv{dept.Namespace(), rev.Name,
+		rev.Id, appId})
 	if err != nil {
 		panic(err)
 	}
@@ -136,19 +545,530 @@ func fetchCommentsHandler(key string, w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	_ = util.JSONResponse(w, map[string]interface{}{
+	assigned, err := dept.AssignmentsByApp(appId)
+	if err != nil {
+		panic(err)
+	}
+
+	letters, err := dept.LoadLetters(appId)
+	if err != nil {
+		panic(err)
+	}
+
+	// Capabilities to edit and delete the reviewer's own comments, by id.
+	commentCaps := make(map[string]map[string]string)
+	model.WalkComments(comments, func(comment *model.Comment) {
+		if comment.ReviewerId == rev.Id && !comment.Deleted {
+			commentCaps[comment.Id] = grantCommentCaps(dept.Namespace(), comment)
+		}
+	})
+
+	evaluations, err := dept.Evaluations(appId)
+	if err != nil {
+		panic(err)
+	}
+
+	resp := map[string]interface{}{
 		"appId":          appId,
 		"comments":       comments,
+		"commentCaps":    commentCaps,
 		"post":           capServer.Grant(postCommentKey, env),
 		"setScoreCap":    capServer.Grant(setScoreKey, env),
 		"highlightCap":   capServer.Grant(setHighlightKey, env),
 		"unhighlightCap": capServer.Grant(delHighlightKey, env),
+		"historyCap":     capServer.Grant(historyKey, env),
 		"highlightedBy":  highlightedBy,
-	})
+		"assigned":       assigned,
+		"letters":        letters,
+		"evaluationForm": dept.EvaluationForm(),
+		"evaluations":    evaluations,
+		"evaluateCap":    capServer.Grant(evaluateKey, env),
+		"annotationsCap": capServer.Grant(annotationsKey, env),
+		"packetCap":      capServer.Grant(packetKey, env),
+	}
+	if rev.Chair {
+		resp["applicantLinkCap"] = capServer.Grant(applicantLinkKey, env)
+		resp["assignCap"] = capServer.Grant(assignKey, env)
+	}
+	_ = util.JSONResponse(w, resp)
 
 	log.Printf("%v fetched comments for %v", key, appId)
 }
 
+// Returns the applicant's records from prior cycles. Chairs also see suggested
+// matches, with capabilities to confirm or reject them.
+func historyHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		panic("expected GET")
+	}
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
+	if err != nil {
+		panic(err)
+	}
+	dept := deptOf(arg.Dept)
+	rev, err := dept.GetReviewerById(arg.ReviewerId)
+	if err != nil {
+		panic(err)
+	}
+	records, err := dept.History(arg.AppId, rev.Chair)
+	if err != nil {
+		panic(err)
+	}
+
+	type historyEntry struct {
+		model.PriorRecord
+		SetMatchCap string `json:"setMatchCap,omitempty"`
+	}
+	entries := make([]historyEntry, len(records))
+	for i, record := range records {
+		entries[i].PriorRecord = record
+		if !rev.Chair {
+			continue
+		}
+		env, err := util.JSONToString(&MatchEnv{arg.Dept, rev.Id,
+			record.Match.Id})
+		if err != nil {
+			panic(err)
+		}
+		entries[i].SetMatchCap = capServer.Grant(setMatchKey, env)
+	}
+	_ = util.JSONResponse(w, entries)
+}
+
+// Confirms or rejects a match suggested between an applicant and a prior
+// applicant. Only chairs are granted this capability.
+func setMatchHandler(v string, w http.ResponseWriter, r *http.Request) {
+	var arg MatchEnv
+	err := util.StringToJSON(v, &arg)
+	if err != nil {
+		panic(err)
+	}
+	if r.Method != "POST" {
+		log.Printf("%v SECURITY ERROR %v trying to %v to %v", r.RemoteAddr,
+			arg.ReviewerId, r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	dept := deptOf(arg.Dept)
+	rev, err := dept.GetReviewerById(arg.ReviewerId)
+	if err != nil {
+		panic(err)
+	}
+	if !rev.Chair {
+		log.Printf("%v SECURITY ERROR %v is no longer a chair and tried to set "+
+			"match %v", r.RemoteAddr, arg.ReviewerId, arg.MatchId)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+	var req struct {
+		Status string `json:"status"`
+	}
+	err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	err = dept.SetMatchStatus(arg.MatchId, req.Status)
+	if err != nil {
+		log.Printf("%v ERROR SetMatchStatus(%v, %v): %v", r.RemoteAddr,
+			arg.MatchId, req.Status, err)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	log.Printf("%v %v set match %v to %v", r.RemoteAddr, arg.ReviewerId,
+		arg.MatchId, req.Status)
+	w.WriteHeader(200)
+}
+
+// Reviewer management for chairs. A GET lists reviewers. A POST performs the
+// operation in the body: {"op": "create", "id", "name", "email"},
+// {"op": "rename", "id", "name"}, {"op": "disable" or "enable", "id"},
+// {"op": "delete", "id"} or {"op": "import", "csv"}. Responds with the
+// reviewers after the operation.
+func reviewersHandler(v string, w http.ResponseWriter, r *http.Request) {
+	dept, key := reviewerEnv(v)
+	chair, err := dept.GetReviewerById(key)
+	if err != nil {
+		panic(err)
+	}
+	if !chair.Chair || chair.Disabled {
+		log.Printf("%v SECURITY ERROR %v is not a chair and tried to manage "+
+			"reviewers", r.RemoteAddr, key)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+
+	var errs []string
+	if r.Method == "POST" {
+		var req struct {
+			Op    string           `json:"op"`
+			Id    model.ReviewerId `json:"id"`
+			Name  string           `json:"name"`
+			Email string           `json:"email"`
+			CSV   string           `json:"csv"`
+		}
+		err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		switch req.Op {
+		case "create":
+			err = dept.CreateReviewer(&model.Reviewer{Id: req.Id, Name: req.Name,
+				Email: req.Email})
+		case "rename":
+			err = dept.SetReviewerName(req.Id, req.Name)
+		case "disable", "enable":
+			if req.Id == key {
+				err = fmt.Errorf("you cannot %v yourself", req.Op)
+			} else {
+				err = dept.SetReviewerDisabled(req.Id, req.Op == "disable")
+			}
+		case "delete":
+			if req.Id == key {
+				err = fmt.Errorf("you cannot delete yourself")
+			} else {
+				err = dept.DeleteReviewer(req.Id)
+			}
+		case "import":
+			_, importErrs := dept.ImportReviewers(strings.NewReader(req.CSV))
+			for _, e := range importErrs {
+				errs = append(errs, e.Error())
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", req.Op)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		log.Printf("%v %v managed reviewers: %v %v (errors: %v)", r.RemoteAddr,
+			key, req.Op, req.Id, errs)
+	} else if r.Method != "GET" {
+		panic("expected GET or POST")
+	}
+
+	revs, err := dept.Reviewers()
+	if err != nil {
+		panic(err)
+	}
+	type reviewerInfo struct {
+		Id       model.ReviewerId `json:"id"`
+		Name     string           `json:"name"`
+		Email    string           `json:"email"`
+		Chair    bool             `json:"chair"`
+		Disabled bool             `json:"disabled"`
+		// The state of the reviewer's invitation, if they were invited.
+		Invitation string `json:"invitation,omitempty"`
+	}
+	infos := make([]reviewerInfo, len(revs))
+	now := time.Now()
+	for i, rev := range revs {
+		infos[i] = reviewerInfo{rev.Id, rev.Name, rev.Email, rev.Chair,
+			rev.Disabled, ""}
+		if rev.Invitation != nil {
+			infos[i].Invitation = rev.Invitation.State(now)
+		}
+	}
+	_ = util.JSONResponse(w, map[string]interface{}{
+		"reviewers": infos,
+		"errors":    errs,
+	})
+}
+
+// SetupLink returns the link, under baseURL, at which a reviewer accepts
+// their invitation and sets a password. The server must use the same key.
+func SetupLink(key []byte, baseURL string, ns model.Namespace,
+	revId model.ReviewerId, nonce string) string {
+	env, err := util.JSONToString(&SetupEnv{ns, revId, nonce})
+	if err != nil {
+		panic(err)
+	}
+	capPath := caps.NewCryptCapServer("/caps/", key, key).Grant(setupKey, env)
+	return strings.TrimRight(baseURL, "/") + "/setup.html#" + capPath
+}
+
+// ApplicantLink returns the link, under baseURL, at which an applicant
+// submits their areas, faculty and program. The server must use the same key.
+func ApplicantLink(key []byte, baseURL string, ns model.Namespace,
+	appId string, nonce string) string {
+	env, err := util.JSONToString(&ApplicantEnv{ns, appId, nonce})
+	if err != nil {
+		panic(err)
+	}
+	capPath := caps.NewCryptCapServer("/caps/", key, key).Grant(applicantKey, env)
+	return strings.TrimRight(baseURL, "/") + "/applicant.html#" + capPath
+}
+
+// Responds to POST by minting a new link for the applicant, replacing any
+// earlier one, with {"cap", "expires"}. The client makes the link from cap,
+// as ApplicantLink does.
+func applicantLinkHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("expected POST")
+	}
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
+	if err != nil {
+		panic(err)
+	}
+	dept := deptOf(arg.Dept)
+	rev, err := dept.GetReviewerById(arg.ReviewerId)
+	if err != nil {
+		panic(err)
+	}
+	if !rev.Chair || rev.Disabled {
+		log.Printf("%v SECURITY ERROR %v is not an enabled chair and tried to "+
+			"mint a link for %v", r.RemoteAddr, arg.ReviewerId, arg.AppId)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+	link, err := dept.MintApplicantLink(arg.AppId, rev.Id,
+		model.DefaultApplicantLinkTTL)
+	if err != nil {
+		log.Printf("%v ERROR MintApplicantLink(%v): %v", r.RemoteAddr,
+			arg.AppId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		r.Close = true
+		return
+	}
+	env, err := util.JSONToString(&ApplicantEnv{arg.Dept, arg.AppId, link.Nonce})
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("%v %v minted a link for %v", r.RemoteAddr, rev.Id, arg.AppId)
+	util.JSONResponse(w, map[string]interface{}{
+		"cap":     capServer.Grant(applicantKey, env),
+		"expires": link.Expires,
+	})
+}
+
+// Responds to POST of {"revId", "assigned"} by assigning the reviewer to the
+// application, or unassigning them, and notifying them if that changes
+// anything.
+func assignHandler(v string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		panic("expected POST")
+	}
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
+	if err != nil {
+		panic(err)
+	}
+	var req struct {
+		RevId    model.ReviewerId `json:"revId"`
+		Assigned bool             `json:"assigned"`
+	}
+	err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+	if err != nil {
+		panic(err)
+	}
+	dept := deptOf(arg.Dept)
+	rev, err := dept.GetReviewerById(arg.ReviewerId)
+	if err != nil {
+		panic(err)
+	}
+	if !rev.Chair || rev.Disabled {
+		log.Printf("%v SECURITY ERROR %v is not an enabled chair and tried to "+
+			"assign %v to %v", r.RemoteAddr, arg.ReviewerId, req.RevId, arg.AppId)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+	a := &model.Assignment{
+		AppId:        arg.AppId,
+		RevId:        req.RevId,
+		AssignerId:   rev.Id,
+		AssignerName: rev.Name,
+	}
+	changed := false
+	if req.Assigned {
+		changed, err = dept.SetAssignment(a)
+	} else {
+		var old *model.Assignment
+		old, err = dept.DelAssignment(arg.AppId, req.RevId)
+		changed = old != nil
+	}
+	if err != nil {
+		log.Printf("%v ERROR assigning %v to %v: %v", r.RemoteAddr, req.RevId,
+			arg.AppId, err)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	if changed {
+		log.Printf("%v %v set assignment of %v to %v: %v", r.RemoteAddr, rev.Id,
+			req.RevId, arg.AppId, req.Assigned)
+		err = dept.NotifyAssignment(a, req.Assigned, notifyMailer)
+		if err != nil {
+			log.Printf("%v ERROR notifying %v of an assignment: %v", r.RemoteAddr,
+				req.RevId, err)
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// Responds to GET with the applicant's name, their latest submission and
+// the choices, and to POST of a submission by recording it. Either responds
+// with {"msg"} if the link is no longer valid, and POST does if the
+// submission is invalid.
+func applicantHandler(v string, w http.ResponseWriter, r *http.Request) {
+	var env ApplicantEnv
+	err := util.StringToJSON(v, &env)
+	if err != nil {
+		panic(err)
+	}
+	dept := deptOf(env.Dept)
+	sub, err := dept.FromApplicant(env.AppId, env.Nonce)
+	if err != nil {
+		util.JSONResponse(w, map[string]interface{}{"msg": err.Error()})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		util.JSONResponse(w, map[string]interface{}{
+			"name":       dept.ApplicantName(env.AppId),
+			"dept":       env.Dept,
+			"submission": sub,
+			"choices":    dept.ApplicantChoices(),
+		})
+	case "POST":
+		var req model.ApplicantSubmission
+		err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		err = dept.SubmitFromApplicant(env.AppId, env.Nonce, &req)
+		if err != nil {
+			util.JSONResponse(w, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		log.Printf("%v applicant %v submitted their areas and faculty",
+			r.RemoteAddr, env.AppId)
+		util.JSONResponse(w, map[string]interface{}{"submission": req})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		r.Close = true
+	}
+}
+
+// Responds to GET with the reviewer's name and to POST {"password"} by
+// setting their password. Either responds with {"msg"} if the link is no
+// longer valid.
+func setupHandler(v string, w http.ResponseWriter, r *http.Request) {
+	var env SetupEnv
+	err := util.StringToJSON(v, &env)
+	if err != nil {
+		panic(err)
+	}
+	dept := deptOf(env.Dept)
+	rev, err := dept.GetReviewerById(env.ReviewerId)
+	if err != nil || rev.Disabled || rev.Invitation == nil ||
+		!rev.Invitation.Matches(env.Nonce) ||
+		rev.Invitation.State(time.Now()) != model.InvitationSent {
+		util.JSONResponse(w, map[string]interface{}{
+			"msg": "this link has expired or has already been used"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		util.JSONResponse(w, map[string]interface{}{
+			"revId":        rev.Id,
+			"friendlyName": rev.Name,
+			"dept":         env.Dept,
+		})
+	case "POST":
+		var req struct {
+			Password string `json:"password"`
+		}
+		err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		err = dept.AcceptInvitation(env.ReviewerId, env.Nonce, req.Password)
+		if err != nil {
+			util.JSONResponse(w, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		log.Printf("%v %v set a password from an invitation", r.RemoteAddr,
+			env.ReviewerId)
+		util.JSONResponse(w, map[string]interface{}{"revId": rev.Id})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		r.Close = true
+	}
+}
+
+// Responds to GET with the reviewer's notification preferences and to POST
+// of new preferences by setting them.
+func notifyPrefsHandler(v string, w http.ResponseWriter, r *http.Request) {
+	dept, revId := reviewerEnv(v)
+	if r.Method == "POST" {
+		var prefs model.NotifyPrefs
+		err := util.ReaderToJSON(r.Body, int(r.ContentLength), &prefs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		err = dept.SetNotifyPrefs(revId, prefs)
+		if err != nil {
+			log.Printf("%v ERROR SetNotifyPrefs(%v): %v", r.RemoteAddr, revId, err)
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+	} else if r.Method != "GET" {
+		panic("expected GET or POST")
+	}
+	rev, err := dept.GetReviewerById(revId)
+	if err != nil {
+		panic(err)
+	}
+	_ = util.JSONResponse(w, rev.NotifyPrefs())
+}
+
+// Responds with the reviewer's unread notifications. POST {"ids"} first marks
+// those notifications read, or all of them if ids is empty.
+func notificationsHandler(v string, w http.ResponseWriter, r *http.Request) {
+	dept, revId := reviewerEnv(v)
+	if r.Method == "POST" {
+		var req struct {
+			Ids []string `json:"ids"`
+		}
+		err := util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		err = dept.MarkRead(revId, req.Ids)
+		if err != nil {
+			panic(err)
+		}
+	} else if r.Method != "GET" {
+		panic("expected GET or POST")
+	}
+	notes, err := dept.Unread(revId)
+	if err != nil {
+		panic(err)
+	}
+	_ = util.JSONResponse(w, notes)
+}
+
 func setHighlightHandler(v string, w http.ResponseWriter, r *http.Request) {
 	// TODO: use and enforce PUT
 	var arg FetchCommentsEnv
@@ -171,10 +1091,16 @@ func setHighlightHandler(v string, w http.ResponseWriter, r *http.Request) {
 		arg.ReviewerName,
 		float64(now),
 	}
+	dept := deptOf(arg.Dept)
 	err = dept.SetHighlight(hl)
 	if err != nil {
 		panic(err)
 	}
+	err = dept.NotifyHighlight(hl, notifyMailer)
+	if err != nil {
+		log.Printf("%v ERROR notifying %v of a highlight: %v", r.RemoteAddr,
+			hl.ReaderId, err)
+	}
 	w.WriteHeader(200)
 }
 
@@ -193,7 +1119,7 @@ func delHighlightHandler(key string, w http.ResponseWriter, r *http.Request) {
 		r.Close = true
 		return
 	}
-	err = dept.DelHighlight(arg.AppId, string(arg.ReviewerId))
+	err = deptOf(arg.Dept).DelHighlight(arg.AppId, string(arg.ReviewerId))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		r.Close = true
@@ -204,6 +1130,29 @@ func delHighlightHandler(key string, w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
+// Returns the department a reviewer logs in to, given its name as typed on
+// the login form. The name may be left blank when the server has a legacy
+// department or serves only one department.
+func loginDept(name string) *model.Dept {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		if dept, found := depts[""]; found {
+			return dept
+		}
+		if len(depts) == 1 {
+			for _, dept := range depts {
+				return dept
+			}
+		}
+		return nil
+	}
+	ns, err := model.ParseNamespace(name)
+	if err != nil {
+		return nil
+	}
+	return depts[ns]
+}
+
 // Authenticates a login request and returns capabilities to initial data.
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -213,35 +1162,64 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var cred struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Dept     string `json:"dept"`
 	}
 	err := util.JSONBody(r, &cred)
 	if err != nil {
 		panic(fmt.Sprintf("invalid request: %v", err))
 	}
 
-	log.Printf("%v attempt to login", cred.Username)
+	log.Printf("%v attempt to login to %q", cred.Username, cred.Dept)
+	dept := loginDept(cred.Dept)
+	// Departments deleted since the server started are still in depts.
+	if dept == nil || dept.Deletion() != nil {
+		util.JSONResponse(w,
+			map[string]interface{}{"msg": "unknown department"})
+		return
+	}
 	rev, err := dept.AuthReviewer(model.ReviewerId(cred.Username), cred.Password)
 	if err != nil {
 		util.JSONResponse(w,
 			map[string]interface{}{"msg": "invalid username or password"})
 		return
 	}
+	if rev.Disabled {
+		log.Printf("%v is disabled and tried to log in", cred.Username)
+		util.JSONResponse(w,
+			map[string]interface{}{"msg": "your account is disabled"})
+		return
+	}
 
 	reviewers, err := dept.GetReviewerIdMap()
 	if err != nil {
 		panic(err)
 	}
+	unread, err := dept.UnreadCount(rev.Id)
+	if err != nil {
+		log.Printf("ERROR UnreadCount(%v): %v", rev.Id, err)
+	}
 
-	matsCap := capServer.Grant(materialKey, cred.Username)
+	ns := dept.Namespace()
+	matsCap := grantReviewer(materialKey, ns, rev.Id)
 
-	err = util.JSONResponse(w, map[string]interface{}{
-		"revId":             cred.Username,
-		"friendlyName":      rev.Name,
-		"appsCap":           capServer.Grant(dataKey, cred.Username),
-		"materialsCap":      matsCap,
-		"fetchCommentsCap":  capServer.Grant(fetchCommentsKey, cred.Username),
-		"reviewers":         reviewers,
-	})
+	resp := map[string]interface{}{
+		"revId":            cred.Username,
+		"friendlyName":     rev.Name,
+		"dept":             ns,
+		"appsCap":          grantReviewer(dataKey, ns, rev.Id),
+		"materialsCap":     matsCap,
+		"previewsCap":      grantReviewer(previewKey, ns, rev.Id),
+		"fetchCommentsCap": grantReviewer(fetchCommentsKey, ns, rev.Id),
+		"notifyPrefsCap":   grantReviewer(notifyPrefsKey, ns, rev.Id),
+		"notificationsCap": grantReviewer(notificationsKey, ns, rev.Id),
+		"unreadCount":      unread,
+		"reviewers":        reviewers,
+	}
+	if rev.Chair {
+		resp["exportCap"] = grantReviewer(exportKey, ns, rev.Id)
+		resp["reviewersCap"] = grantReviewer(reviewersKey, ns, rev.Id)
+	}
+	err = util.JSONResponse(w, resp)
 	if err != nil {
 		panic("serializing response")
 	}
@@ -274,7 +1252,7 @@ func setScoreHandler(key string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	score := &model.Score{arg.AppId, arg.ReviewerId, req.Label, req.Score}
-	err = dept.SetScore(score)
+	err = deptOf(arg.Dept).SetScore(score)
 	if err != nil {
 		w.WriteHeader(500)
 		r.Close = true
@@ -285,22 +1263,219 @@ func setScoreHandler(key string, w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func Serve(dbhost string, dbport string, key []byte, isTesting bool) {
+// Submits the reviewer's evaluation of the applicant, {"answers"} by question
+// id. Responds with the stored evaluation, or {"msg"} if the answers do not
+// fit the department's evaluation form.
+func evaluateHandler(v string, w http.ResponseWriter, r *http.Request) {
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
+	if err != nil {
+		panic(err)
+	}
+	if r.Method != "POST" {
+		log.Printf("%v SECURITY ERROR %v trying to %v to %v", r.RemoteAddr,
+			arg.ReviewerId, r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	var req struct {
+		Answers map[string]interface{} `json:"answers"`
+	}
+	err = util.ReaderToJSON(r.Body, int(r.ContentLength), &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	eval := &model.Evaluation{
+		AppId:        arg.AppId,
+		RevId:        arg.ReviewerId,
+		ReviewerName: arg.ReviewerName,
+		Answers:      req.Answers,
+	}
+	err = deptOf(arg.Dept).SubmitEvaluation(eval)
+	if err != nil {
+		log.Printf("%v ERROR SubmitEvaluation by %v of %v: %v", r.RemoteAddr,
+			arg.ReviewerId, arg.AppId, err)
+		_ = util.JSONResponse(w, map[string]interface{}{"msg": err.Error()})
+		return
+	}
+	_ = util.JSONResponse(w, map[string]interface{}{"evaluation": eval})
+}
+
+// An annotation as the client sees it, with the capability to delete it if
+// the reviewer wrote it.
+type annotationResponse struct {
+	model.Annotation
+	DeleteCap string `json:"deleteCap,omitempty"`
+}
+
+func annotationFor(ns model.Namespace, revId model.ReviewerId,
+	a model.Annotation) annotationResponse {
+	resp := annotationResponse{Annotation: a}
+	if a.RevId == revId {
+		env, err := util.JSONToString(&AnnotationEnv{ns, revId, a.Id})
+		if err != nil {
+			panic(err)
+		}
+		resp.DeleteCap = capServer.Grant(deleteAnnotationKey, env)
+	}
+	return resp
+}
 
-	_dept, err := model.LoadDept(dbhost, dbport)
+// Responds to GET with the annotations of the applicant's material in the
+// query parameter material, or of all their materials, in page order. POST
+// {material, page, region, text} annotates a material and responds with the
+// new annotation.
+func annotationsHandler(v string, w http.ResponseWriter, r *http.Request) {
+	var arg FetchCommentsEnv
+	err := util.StringToJSON(v, &arg)
 	if err != nil {
 		panic(err)
 	}
-	dept = _dept
+	dept := deptOf(arg.Dept)
+	switch r.Method {
+	case "GET":
+		annotations, err := dept.Annotations(arg.AppId,
+			r.URL.Query().Get("material"))
+		if err != nil {
+			panic(err)
+		}
+		resp := make([]annotationResponse, len(annotations))
+		for i, a := range annotations {
+			resp[i] = annotationFor(arg.Dept, arg.ReviewerId, a)
+		}
+		_ = util.JSONResponse(w, resp)
+	case "POST":
+		var a model.Annotation
+		err = util.ReaderToJSON(r.Body, int(r.ContentLength), &a)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		a.AppId = arg.AppId
+		a.RevId = arg.ReviewerId
+		a.ReviewerName = arg.ReviewerName
+		err = dept.NewAnnotation(&a)
+		if err != nil {
+			log.Printf("%v ERROR NewAnnotation by %v: %v", r.RemoteAddr,
+				arg.ReviewerId, err)
+			w.WriteHeader(http.StatusBadRequest)
+			r.Close = true
+			return
+		}
+		_ = util.JSONResponse(w, annotationFor(arg.Dept, arg.ReviewerId, a))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		r.Close = true
+	}
+}
+
+func deleteAnnotationHandler(v string, w http.ResponseWriter,
+	r *http.Request) {
+	var env AnnotationEnv
+	err := util.StringToJSON(v, &env)
+	if err != nil {
+		panic(err)
+	}
+	if r.Method != "POST" {
+		log.Printf("%v SECURITY ERROR %v trying to %v to %v", r.RemoteAddr,
+			env.ReviewerId, r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	err = deptOf(env.Dept).DeleteAnnotation(env.AnnotationId, env.ReviewerId)
+	if err == model.ErrNotAuthor {
+		log.Printf("%v SECURITY ERROR %v tried to delete annotation %v",
+			r.RemoteAddr, env.ReviewerId, env.AnnotationId)
+		w.WriteHeader(http.StatusForbidden)
+		r.Close = true
+		return
+	}
+	if err != nil {
+		log.Printf("%v ERROR deleting annotation %v: %v", r.RemoteAddr,
+			env.AnnotationId, err)
+		w.WriteHeader(http.StatusBadRequest)
+		r.Close = true
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// How often the server makes previews of new materials.
+const previewInterval = 5 * time.Minute
+
+func makePreviews() {
+	for {
+		for ns, dept := range depts {
+			if dept.Deletion() != nil {
+				continue
+			}
+			made, err := dept.MakePreviews()
+			if err != nil {
+				log.Printf("ERROR making previews for %q: %v", ns, err)
+			} else if made > 0 {
+				log.Printf("Made %v previews for %q", made, ns)
+			}
+		}
+		time.Sleep(previewInterval)
+	}
+}
+
+func Serve(dbhost string, dbport string, namespaces []model.Namespace,
+	key []byte, isTesting bool) {
+
+	depts = make(map[model.Namespace]*model.Dept)
+	for _, ns := range namespaces {
+		dept, err := model.LoadDept(dbhost, dbport, ns)
+		if err != nil {
+			panic(fmt.Sprintf("loading department %q: %v", ns, err))
+		}
+		if dept.Deletion() != nil {
+			log.Printf("Not serving deleted department %q", ns)
+			continue
+		}
+		err = dept.CheckVersion()
+		if err != nil {
+			panic(err)
+		}
+		depts[ns] = dept
+		log.Printf("Serving department %q", ns)
+	}
+	if len(depts) == 0 {
+		panic("no departments to serve")
+	}
 
 	capServer = caps.NewCryptCapServer("/caps/", key, key)
-	capServer.HandleFunc(dataKey, dataHandler)
-	capServer.HandleFunc(materialKey, materialHandler)
-	capServer.HandleFunc(fetchCommentsKey, fetchCommentsHandler)
-	capServer.HandleFunc(postCommentKey, postCommentHandler)
-	capServer.HandleFunc(setHighlightKey, setHighlightHandler)
-	capServer.HandleFunc(delHighlightKey, delHighlightHandler)
-	capServer.HandleFunc(setScoreKey, setScoreHandler)
+	capServer.HandleFunc(dataKey, checked(dataHandler))
+	capServer.HandleFunc(materialKey, checked(materialHandler))
+	capServer.HandleFunc(fetchCommentsKey, checked(fetchCommentsHandler))
+	capServer.HandleFunc(postCommentKey, checked(postCommentHandler))
+	capServer.HandleFunc(editCommentKey, checked(editCommentHandler))
+	capServer.HandleFunc(deleteCommentKey, checked(deleteCommentHandler))
+	capServer.HandleFunc(setHighlightKey, checked(setHighlightHandler))
+	capServer.HandleFunc(delHighlightKey, checked(delHighlightHandler))
+	capServer.HandleFunc(setScoreKey, checked(setScoreHandler))
+	capServer.HandleFunc(evaluateKey, checked(evaluateHandler))
+	capServer.HandleFunc(annotationsKey, checked(annotationsHandler))
+	capServer.HandleFunc(deleteAnnotationKey, checked(deleteAnnotationHandler))
+	capServer.HandleFunc(packetKey, checked(packetHandler))
+	capServer.HandleFunc(previewKey, checked(previewHandler))
+	capServer.HandleFunc(exportKey, checked(exportHandler))
+	capServer.HandleFunc(historyKey, checked(historyHandler))
+	capServer.HandleFunc(setMatchKey, checked(setMatchHandler))
+	capServer.HandleFunc(reviewersKey, checked(reviewersHandler))
+	capServer.HandleFunc(setupKey, checked(setupHandler))
+	capServer.HandleFunc(notifyPrefsKey, checked(notifyPrefsHandler))
+	capServer.HandleFunc(notificationsKey, checked(notificationsHandler))
+	capServer.HandleFunc(assignKey, checked(assignHandler))
+	capServer.HandleFunc(applicantLinkKey, checked(applicantLinkHandler))
+	capServer.HandleFunc(applicantKey, checked(applicantHandler))
+
+	go makePreviews()
 
 	http.HandleFunc("/caps/", util.ProtectHandler(capServer.CapHandler()))
 	http.HandleFunc("/login", util.ProtectHandler(loginHandler))
@@ -8,6 +8,7 @@ import (
   "strconv"
   "regexp"
   "fmt"
+  "strings"
 )
 
 type Application struct {
@@ -28,6 +29,8 @@ type Application struct {
   UndergradGPA *float64 `json:"undergradGPA"`
   GradGPA *float64 `json:"gradGPA"`
   ExternalOrgs []string `json:"externalOrgs"`
+  // The graduate school's decision, e.g., for exports; empty if undecided.
+  Decision string `json:"decision,omitempty"`
 }
 
 func (self *Application) Id() string {
@@ -109,6 +112,7 @@ func rowToStruct(row []string) *Application {
     ExternalOrgs: removeBlanks([]string{i("External Org 1"),
     										                i("External Org 2"),
          							    			        i("External Org 3")}),
+    Decision: i("UMass Decision"),
 	}
 }
 
@@ -129,7 +133,7 @@ func isHeaderOK(header []string) bool {
 	return true
 }
 
-func ImportCSV(dbhost, dbport, csvFile string) {
+func ImportCSV(dbhost, dbport string, ns model.Namespace, csvFile string) {
 	f, err := os.Open(csvFile)
 	if err != nil {
 		log.Fatalf("Could not open %v\n%v\n", csvFile, err)
@@ -152,7 +156,7 @@ func ImportCSV(dbhost, dbport, csvFile string) {
 		os.Exit(1)
   	}
 
-	dept, err := model.LoadDept(dbhost, dbport)
+	dept, err := model.LoadDept(dbhost, dbport, ns)
 	if err != nil {
 		log.Fatalf("Could not load department.\n%v\n", err)
 		os.Exit(1)
@@ -170,8 +174,9 @@ func ImportCSV(dbhost, dbport, csvFile string) {
 }
 
 // It should be completely obvious that these regular expressions do not overlap.
+// Letters may name their writer after "Recommendation".
 var letterRegexp = 
-  regexp.MustCompile(`^GCMP_(\d+)_(?:\d+)_(.*)_GS_Adm_Recommendation\.pdf$`)
+  regexp.MustCompile(`^GCMP_(\d+)_(?:\d+)_(.*)_GS_Adm_Recommendation(?:_(.+))?\.pdf$`)
 var resumeRegexp = 
   regexp.MustCompile(`^GCMP_(\d+)_(?:\d+)_(.*)_GS_Adm_Resume\.pdf$`)
 var personalStatementRegexp = 
@@ -189,6 +194,48 @@ var financialRegexp =
 var testScoresRegexp =
   regexp.MustCompile(`^GCMP_(\d+)_(?:\d+)_(.*)_GS_Adm_Test_Scores\.pdf$`)
 
+// A materialKind describes one kind of document that UMass sends us. Text is
+// the label the client displays and field is the application list ("materials"
+// or "recs") that the document belongs in.
+type materialKind struct {
+	text   string
+	field  string
+	regexp *regexp.Regexp
+}
+
+var materialKinds = []materialKind{
+	{"Recommendation", "recs", letterRegexp},
+	{"Resume", "materials", resumeRegexp},
+	{"Transcript", "materials", transcriptRegexp},
+	{"Personal statement", "materials", personalStatementRegexp},
+	{"Application", "materials", applicationRegexp},
+	{"Writing sample", "materials", writingSampleRegexp},
+	{"Miscellaneous", "materials", miscRegexp},
+	{"Financial statement", "materials", financialRegexp},
+	{"Test scores", "materials", testScoresRegexp},
+}
+
+// classify returns the kind of the document called name and the Person Id of
+// the applicant it belongs to. kind is nil if name is not recognized.
+func classify(name string) (kind *materialKind, personId string) {
+	for i := range materialKinds {
+		if m := materialKinds[i].regexp.FindStringSubmatch(name); m != nil {
+			return &materialKinds[i], m[1]
+		}
+	}
+	return nil, ""
+}
+
+// letterWriter returns the writer named in the file name of a letter, or "" if
+// the file name does not name one.
+func letterWriter(name string) string {
+	m := letterRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	return strings.Replace(m[3], "_", " ", -1)
+}
+
 func ImportPDFs(path string) {
 	log.Printf("Reading materials from %v.\n", path);
 
@@ -206,27 +253,8 @@ func ImportPDFs(path string) {
 
 	for _, file := range(files) {
 		name := file.Name()
-		if m := letterRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := resumeRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := transcriptRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := personalStatementRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := applicationRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := writingSampleRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := miscRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := financialRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else if m := testScoresRegexp.FindStringSubmatch(name); m != nil {
-			continue;
-		}	else {
+		if kind, _ := classify(name); kind == nil {
 			fmt.Printf("Unclassified: %s\n", name);
 		}
-
 	}
 }
@@ -0,0 +1,218 @@
+package umass
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"model"
+	"path"
+	"strings"
+	"time"
+)
+
+// A zipReport tallies the outcome of importing an archive. Entries are
+// identified by their path, with nested archives separated by "!".
+type zipReport struct {
+	imported     int
+	seen         map[string]string
+	duplicates   []string
+	unclassified []string
+	corrupt      []string
+	rejected     []string
+	failed       []string
+	// Bytes of nested archives held in memory; see maxNestedZipSize.
+	buffered int64
+}
+
+func newZipReport() *zipReport {
+	return &zipReport{seen: make(map[string]string)}
+}
+
+func (self *zipReport) print() {
+	fmt.Printf("Imported %v materials.\n", self.imported)
+	for _, name := range self.duplicates {
+		fmt.Printf("Duplicate: %s\n", name)
+	}
+	for _, name := range self.unclassified {
+		fmt.Printf("Unclassified: %s\n", name)
+	}
+	for _, name := range self.corrupt {
+		fmt.Printf("Corrupt: %s\n", name)
+	}
+	for _, name := range self.rejected {
+		fmt.Printf("Rejected: %s\n", name)
+	}
+	for _, name := range self.failed {
+		fmt.Printf("Failed: %s\n", name)
+	}
+}
+
+// An uploadFunc stores the material called name, of the given kind, for the
+// applicant personId. It must consume r, which holds size bytes.
+type uploadFunc func(kind *materialKind, personId string, name string,
+	r io.Reader, size int64) error
+
+// checkedReader remembers the first error, other than io.EOF, returned by the
+// underlying reader. The zip package only reports checksum failures once an
+// entry has been read in full, which happens deep inside the upload.
+type checkedReader struct {
+	r   io.Reader
+	err error
+}
+
+func (self *checkedReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	if err != nil && err != io.EOF && self.err == nil {
+		self.err = err
+	}
+	return n, err
+}
+
+// importZip classifies and uploads every entry of archive, which is nested
+// depth archives deep. Nested archives are read into memory and imported
+// recursively; nothing is written to disk.
+func importZip(archive *zip.Reader, where string, depth int,
+	report *zipReport, upload uploadFunc) {
+	for _, f := range archive.File {
+		entry := where + "!" + f.Name
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		name := path.Base(f.Name)
+		if strings.HasSuffix(strings.ToLower(name), ".zip") {
+			importNestedZip(f, entry, depth+1, report, upload)
+			continue
+		}
+
+		kind, personId := classify(name)
+		if kind == nil {
+			report.unclassified = append(report.unclassified, entry)
+			continue
+		}
+
+		if prev, found := report.seen[name]; found {
+			report.duplicates = append(report.duplicates,
+				fmt.Sprintf("%s (already read from %s)", entry, prev))
+			continue
+		}
+		report.seen[name] = entry
+
+		rc, err := f.Open()
+		if err != nil {
+			log.Printf("Could not open %v.\n%v\n", entry, err)
+			report.corrupt = append(report.corrupt, entry)
+			continue
+		}
+		body := &checkedReader{r: rc}
+		err = upload(kind, personId, name, body, int64(f.UncompressedSize64))
+		rc.Close()
+		if body.err != nil {
+			log.Printf("Could not read %v.\n%v\n", entry, body.err)
+			report.corrupt = append(report.corrupt, entry)
+		} else if err == model.ErrUploadExists {
+			report.duplicates = append(report.duplicates,
+				fmt.Sprintf("%s (already in the database)", entry))
+		} else if invalid, ok := err.(*model.InvalidUploadError); ok {
+			report.rejected = append(report.rejected,
+				fmt.Sprintf("%s (%s)", entry, invalid.Validation.Problem))
+		} else if err != nil {
+			log.Printf("Could not upload %v.\n%v\n", entry, err)
+			report.failed = append(report.failed, entry)
+		} else {
+			report.imported++
+		}
+	}
+}
+
+// Nested archives are read into memory, so archives nested more than
+// maxZipDepth deep, or that would take the archives held in memory at once
+// past maxNestedZipSize bytes, are reported as corrupt rather than read.
+const maxZipDepth = 3
+
+var maxNestedZipSize int64 = 512 << 20
+
+func importNestedZip(f *zip.File, entry string, depth int,
+	report *zipReport, upload uploadFunc) {
+	if depth > maxZipDepth {
+		log.Printf("Could not read %v.\nit is nested more than %v archives "+
+			"deep\n", entry, maxZipDepth)
+		report.corrupt = append(report.corrupt, entry)
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		log.Printf("Could not open %v.\n%v\n", entry, err)
+		report.corrupt = append(report.corrupt, entry)
+		return
+	}
+	budget := maxNestedZipSize - report.buffered
+	buf, err := ioutil.ReadAll(io.LimitReader(rc, budget+1))
+	rc.Close()
+	if err != nil {
+		log.Printf("Could not read %v.\n%v\n", entry, err)
+		report.corrupt = append(report.corrupt, entry)
+		return
+	}
+	if int64(len(buf)) > budget {
+		log.Printf("Could not read %v.\nit and the archives it is in are "+
+			"larger than %v bytes\n", entry, maxNestedZipSize)
+		report.corrupt = append(report.corrupt, entry)
+		return
+	}
+	nested, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		log.Printf("Could not read archive %v.\n%v\n", entry, err)
+		report.corrupt = append(report.corrupt, entry)
+		return
+	}
+	report.buffered += int64(len(buf))
+	importZip(nested, entry, depth, report, upload)
+	report.buffered -= int64(len(buf))
+}
+
+// ImportZip uploads the materials in zipFile, and in any archives nested
+// within it, and links them to their applications.
+func ImportZip(dbhost, dbport string, ns model.Namespace, zipFile string) {
+	log.Printf("Reading materials from %v.\n", zipFile)
+
+	archive, err := zip.OpenReader(zipFile)
+	if err != nil {
+		log.Fatalf("Could not open %v.\n%v\n", zipFile, err)
+		return
+	}
+	defer archive.Close()
+
+	dept, err := model.LoadDept(dbhost, dbport, ns)
+	if err != nil {
+		log.Fatalf("Could not load department.\n%v\n", err)
+		return
+	}
+
+	report := newZipReport()
+	importZip(&archive.Reader, zipFile, 0, report,
+		func(kind *materialKind, personId string, name string, r io.Reader,
+			size int64) error {
+			err := dept.Upload(name, r, size)
+			if err != nil {
+				return err
+			}
+			err = dept.AddMaterial(personId, kind.field, name, kind.text)
+			if err != nil {
+				return err
+			}
+			if kind.field != "recs" {
+				return nil
+			}
+			return dept.SetLetter(&model.Letter{
+				ApplicantId: personId,
+				Writer:      letterWriter(name),
+				Received:    float64(time.Now().Unix()),
+				Upload:      name,
+			})
+		})
+	report.print()
+}
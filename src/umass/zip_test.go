@@ -0,0 +1,218 @@
+package umass
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"model"
+	"strings"
+	"testing"
+)
+
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, body := range files {
+		// Stored, not deflated, so that tests can corrupt the contents in place.
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatalf("CreateHeader(%v) = %v", name, err)
+		}
+		_, err = f.Write(body)
+		if err != nil {
+			t.Fatalf("Write(%v) = %v", name, err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func zipReader(t *testing.T, buf []byte) *zip.Reader {
+	r, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("zip.NewReader = %v", err)
+	}
+	return r
+}
+
+type upload struct {
+	text     string
+	personId string
+	body     string
+}
+
+func recordingUpload(uploads map[string]upload) uploadFunc {
+	return func(kind *materialKind, personId string, name string, r io.Reader,
+		size int64) error {
+		if _, found := uploads[name]; found {
+			return model.ErrUploadExists
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		uploads[name] = upload{kind.text, personId, string(body)}
+		return nil
+	}
+}
+
+func TestClassify(t *testing.T) {
+	kind, personId := classify("GCMP_123_4_Doe_Jane_GS_Adm_Unofficial_Transcript.pdf")
+	if kind == nil || kind.text != "Transcript" || personId != "123" {
+		t.Fatalf("classify gave %v, %v", kind, personId)
+	}
+	kind, _ = classify("GCMP_123_4_Doe_Jane_GS_Adm_Recommendation.pdf")
+	if kind == nil || kind.field != "recs" {
+		t.Fatalf("expected a recommendation, got %v", kind)
+	}
+	name := "GCMP_123_4_Doe_Jane_GS_Adm_Recommendation_Alan_Turing.pdf"
+	kind, personId = classify(name)
+	if kind == nil || personId != "123" || letterWriter(name) != "Alan Turing" {
+		t.Fatalf("classify(%v) gave %v, %v, %q", name, kind, personId,
+			letterWriter(name))
+	}
+	kind, _ = classify("notes.txt")
+	if kind != nil {
+		t.Fatalf("expected nil, got %v", kind)
+	}
+}
+
+func TestImportZip(t *testing.T) {
+	resume := "GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf"
+	appl := "GCMP_2_1_Roe_Rick_GS_Adm_Appl.pdf"
+	inner := zipBytes(t, map[string][]byte{
+		"inner/" + appl: []byte("application"),
+		resume:          []byte("resume again"),
+	})
+	outer := zipBytes(t, map[string][]byte{
+		resume:      []byte("resume"),
+		"notes.txt": []byte("hello"),
+		"more.zip":  inner,
+		"bad.zip":   []byte("not an archive"),
+	})
+
+	uploads := make(map[string]upload)
+	report := newZipReport()
+	importZip(zipReader(t, outer), "outer.zip", 0, report,
+		recordingUpload(uploads))
+
+	if report.imported != 2 {
+		t.Fatalf("expected 2 imports, got %v", report.imported)
+	}
+	if uploads[appl].personId != "2" || uploads[appl].body != "application" {
+		t.Fatalf("nested entry uploaded as %v", uploads[appl])
+	}
+	if len(report.duplicates) != 1 {
+		t.Fatalf("expected 1 duplicate, got %v", report.duplicates)
+	}
+	if len(report.unclassified) != 1 ||
+		report.unclassified[0] != "outer.zip!notes.txt" {
+		t.Fatalf("unclassified: %v", report.unclassified)
+	}
+	if len(report.corrupt) != 1 || report.corrupt[0] != "outer.zip!bad.zip" {
+		t.Fatalf("corrupt: %v", report.corrupt)
+	}
+}
+
+func TestImportZipChecksum(t *testing.T) {
+	buf := zipBytes(t, map[string][]byte{
+		"GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf": []byte("%PDF-intact"),
+	})
+	ix := bytes.Index(buf, []byte("intact"))
+	copy(buf[ix:], []byte("broken"))
+
+	uploads := make(map[string]upload)
+	report := newZipReport()
+	importZip(zipReader(t, buf), "a.zip", 0, report,
+		recordingUpload(uploads))
+	if report.imported != 0 || len(report.corrupt) != 1 {
+		t.Fatalf("expected a corrupt entry, got %v imported, %v corrupt",
+			report.imported, report.corrupt)
+	}
+}
+
+func TestImportZipAlreadyUploaded(t *testing.T) {
+	name := "GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf"
+	uploads := map[string]upload{name: upload{}}
+	report := newZipReport()
+	importZip(zipReader(t, zipBytes(t, map[string][]byte{name: []byte("x")})),
+		"a.zip", 0, report, recordingUpload(uploads))
+	if report.imported != 0 || len(report.duplicates) != 1 {
+		t.Fatalf("expected a duplicate, got %v", report.duplicates)
+	}
+}
+
+func TestImportZipNestedTooLarge(t *testing.T) {
+	inner := zipBytes(t, map[string][]byte{
+		"GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf": bytes.Repeat([]byte("x"), 1000),
+	})
+	outer := zipBytes(t, map[string][]byte{"big.zip": inner})
+	defer func(max int64) { maxNestedZipSize = max }(maxNestedZipSize)
+	maxNestedZipSize = int64(len(inner) - 1)
+
+	uploads := make(map[string]upload)
+	report := newZipReport()
+	importZip(zipReader(t, outer), "a.zip", 0, report,
+		recordingUpload(uploads))
+	if report.imported != 0 || len(report.corrupt) != 1 ||
+		report.corrupt[0] != "a.zip!big.zip" {
+		t.Fatalf("expected a corrupt entry, got %v imported, %v corrupt",
+			report.imported, report.corrupt)
+	}
+}
+
+func TestImportZipNestedTooDeep(t *testing.T) {
+	name := "GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf"
+	archive := zipBytes(t, map[string][]byte{name: []byte("x")})
+	where := "a.zip"
+	for i := 0; i < maxZipDepth; i++ {
+		archive = zipBytes(t, map[string][]byte{"n.zip": archive})
+		where += "!n.zip"
+	}
+	uploads := make(map[string]upload)
+	report := newZipReport()
+	importZip(zipReader(t, archive), "a.zip", 0, report,
+		recordingUpload(uploads))
+	if report.imported != 1 || len(report.corrupt) != 0 {
+		t.Fatalf("archives nested %v deep: %v imported, %v corrupt",
+			maxZipDepth, report.imported, report.corrupt)
+	}
+
+	archive = zipBytes(t, map[string][]byte{"n.zip": archive})
+	where = "a.zip!n.zip" + strings.TrimPrefix(where, "a.zip")
+	uploads = make(map[string]upload)
+	report = newZipReport()
+	importZip(zipReader(t, archive), "a.zip", 0, report,
+		recordingUpload(uploads))
+	if report.imported != 0 || len(report.corrupt) != 1 ||
+		report.corrupt[0] != where {
+		t.Fatalf("expected %v to be corrupt, got %v imported, %v corrupt", where,
+			report.imported, report.corrupt)
+	}
+}
+
+func TestImportZipNestedBudget(t *testing.T) {
+	inner := zipBytes(t, map[string][]byte{
+		"GCMP_1_1_Doe_Jane_GS_Adm_Resume.pdf": bytes.Repeat([]byte("x"), 1000),
+	})
+	middle := zipBytes(t, map[string][]byte{"inner.zip": inner})
+	outer := zipBytes(t, map[string][]byte{"middle.zip": middle})
+	defer func(max int64) { maxNestedZipSize = max }(maxNestedZipSize)
+	// Each archive fits, but not both at once.
+	maxNestedZipSize = int64(len(middle) + len(inner) - 1)
+
+	uploads := make(map[string]upload)
+	report := newZipReport()
+	importZip(zipReader(t, outer), "a.zip", 0, report,
+		recordingUpload(uploads))
+	if report.imported != 0 || len(report.corrupt) != 1 ||
+		report.corrupt[0] != "a.zip!middle.zip!inner.zip" ||
+		report.buffered != 0 {
+		t.Fatalf("expected a corrupt entry, got %v imported, %v corrupt",
+			report.imported, report.corrupt)
+	}
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Iterations of PBKDF2 for stored passwords.
+const passwordIterations = 10000
+
+// NewSalt returns a random salt for HashPassword.
+func NewSalt() []byte {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+// NewNonce returns a random hex string, suitable for a single-use token.
+func NewNonce() string {
+	return hex.EncodeToString(NewSalt())
+}
+
+// pbkdf2 derives a key of keyLen bytes from password and salt with
+// PBKDF2-HMAC-SHA256 (RFC 2898).
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func HashPassword(password string, salt []byte) []byte {
+	return pbkdf2([]byte(password), salt, passwordIterations, sha256.Size)
+}
+
+// CheckPassword compares password to a hash from HashPassword in constant
+// time.
+func CheckPassword(password string, salt []byte, hash []byte) bool {
+	return subtle.ConstantTimeCompare(HashPassword(password, salt), hash) == 1
+}
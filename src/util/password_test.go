@@ -0,0 +1,36 @@
+package util
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPbkdf2(t *testing.T) {
+	tests := []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+	}
+	for _, test := range tests {
+		key := pbkdf2([]byte("password"), []byte("salt"), test.iterations, 32)
+		if hex.EncodeToString(key) != test.expected {
+			t.Errorf("pbkdf2 with %v iterations = %x", test.iterations, key)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	salt := NewSalt()
+	hash := HashPassword("correct horse", salt)
+	if !CheckPassword("correct horse", salt, hash) {
+		t.Errorf("rejected the right password")
+	}
+	if CheckPassword("correct horse ", salt, hash) {
+		t.Errorf("accepted the wrong password")
+	}
+	if CheckPassword("correct horse", NewSalt(), hash) {
+		t.Errorf("accepted the password with another salt")
+	}
+}
@@ -441,9 +441,20 @@ export class SetCol extends TextCol {
       return F.DIVSty({ className: 'set' }, []);
     }
     var materialsCap = this.materialsCap_;
+    var annotations = val['annotations'] || {};
+    var previews = val['previews'] || {};
     function dispLink(v) {
-      return F.DIV(F.A({ target: '_blank', href: materialsCap + "?" + v.url }, 
-        F.TEXT(v.text)));
+      var n = annotations[v.url];
+      var problem = v.validation && v.validation.problem;
+      var preview = previews[v.url];
+      var pages = preview && preview.pages;
+      return F.DIV(F.A({ target: '_blank', href: materialsCap + "?" + v.url,
+                         title: preview ? preview.snippet : '' }, 
+        F.TEXT(v.text)),
+        F.TEXT(pages ? ' (' + pages + ' pp.)' : ''),
+        F.TEXT(n ? ' (' + n + (n === 1 ? ' note)' : ' notes)') : ''),
+        problem ? F.SPANSty({ className: 'err' }, [F.TEXT(' (' + problem + ')')])
+                : F.TEXT(''));
     }
 
     function isValidLink(link) {
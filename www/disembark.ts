@@ -18,11 +18,18 @@ interface URLArgs {
 interface LoginResponse {
   appsCap: string;
   materialsCap: string;
+  previewsCap: string;
   fetchCommentsCap: string;
   changePasswordCap: string;
+  exportCap?: string;
+  reviewersCap?: string;
+  notifyPrefsCap: string;
+  notificationsCap: string;
+  unreadCount: number;
   reviewers: { [id : string]: string };
   revId: string;
-  friendlyName: string
+  friendlyName: string;
+  dept: string
 }
 
 interface Application {
@@ -31,18 +38,96 @@ interface Application {
 }
 
 interface AppComment {
+  _id?: string;
   reviewerName: string;
   timestamp: number;
   text: string;
+  html?: string;
+  parentId?: string;
+  visibility?: string;
+  edited?: number;
+  deleted?: boolean;
+  replies?: Array<AppComment>;
+}
+
+interface CommentCaps {
+  edit: string;
+  delete: string
+}
+
+interface PostCommentResponse {
+  id: string;
+  text: string;
+  html: string;
+  visibility: string;
+  caps: CommentCaps
+}
+
+interface Letter {
+  writer: string;
+  received: number;
+  upload?: string;
+}
+
+interface PriorRecord {
+  match: { priorCycle: string; reason: string; status: string };
+  app: { [field : string]: any };
+  comments?: Array<AppComment>;
+  scores?: Array<{ revId: string; label: string; score: number }>;
+  reviewers?: { [id : string]: string };
+  setMatchCap?: string
 }
 
 interface FetchCapResponse {
   comments: Array<AppComment>;
+  letters: Array<Letter>;
   post: string;
   highlightCap: string;
   unhighlightCap: string;
   highlightedBy: Array<string>;
-  setScoreCap: string
+  // Ids of the reviewers assigned to the application.
+  assigned: Array<string>;
+  setScoreCap: string;
+  historyCap: string;
+  evaluationForm?: EvaluationForm;
+  evaluations: Array<Evaluation>;
+  evaluateCap: string;
+  // GET lists annotations on the materials; POST adds one.
+  annotationsCap: string;
+  packetCap: string;
+  // Chairs only. POST mints a new link for the applicant.
+  applicantLinkCap?: string;
+  // Chairs only. POST of { revId, assigned } assigns or unassigns a reviewer.
+  assignCap?: string
+}
+
+interface FormQuestion {
+  id: string;
+  label: string;
+  type: string;
+  required?: bool;
+  choices?: Array<string>;
+  min?: number;
+  max?: number
+}
+
+interface EvaluationForm {
+  version: number;
+  sections: Array<{ title: string; questions: Array<FormQuestion> }>
+}
+
+interface Evaluation {
+  revId: string;
+  reviewerName: string;
+  formVersion: number;
+  answers: { [id : string]: any };
+  timestamp: number
+}
+
+interface QuestionSummary {
+  answers: number;
+  mean?: number;
+  choices?: { [choice : string]: number }
 }
 
 /**
@@ -51,6 +136,7 @@ interface FetchCapResponse {
 var Reviewers;
 
 var myRevId;
+var myName : string;
 
 
 
@@ -216,12 +302,181 @@ function selectedRow(table) {
   .filterE(function(src) { return src !== false; });
 }
 
-function dispComment(comment) {
-  return F.DIVClass('row',
-           F.DIVClass('comment cell',
-             F.DIV(comment.reviewerName),
-             F.DIV(F.TEXT(util.relativeDate(comment.timestamp))),
-             F.DIVSty({}, comment.text)));
+var visibilityLabels = {
+  '': '',
+  chairs: ' · chairs only',
+  private: ' · private note'
+};
+
+/**
+ * Displays a comment and its replies. With post, the capability to post
+ * comments on the application, the reviewer may reply, and edit or delete
+ * the comments that caps has capabilities for.
+ */
+function dispComment(comment : AppComment, post? : string,
+                     caps? : { [id : string]: CommentCaps }) : HTMLElement {
+  // The server renders comments to sanitized HTML. Comments from servers
+  // that predate rendering are shown as text.
+  var source = comment.text;
+  var text = F.DIV();
+  if (comment.deleted) {
+    text.textContent = '[deleted]';
+  }
+  else if (typeof comment.html === 'string') {
+    text.innerHTML = comment.html;
+  }
+  else {
+    text.textContent = comment.text;
+  }
+  var when = util.relativeDate(comment.timestamp) +
+    (comment.edited ? ' (edited ' + util.relativeDate(comment.edited) + ')' : '') +
+    (visibilityLabels[comment.visibility || ''] || '');
+  var replies = F.DIVClass('replies');
+  var cell = F.DIVClass('comment cell',
+               F.DIV(comment.reviewerName),
+               F.DIV(F.TEXT(when)),
+               text);
+  (comment.replies || []).forEach(function(reply) {
+    replies.appendChild(dispComment(reply, post, caps));
+  });
+  if (post && comment._id && !comment.deleted) {
+    var actions = F.DIV();
+    var reply = F.SPAN(F.TEXT('Reply'));
+    reply.className = 'buttonLink';
+    actions.appendChild(reply);
+    F.clicksE(reply).mapE(function(_) {
+      var compose = <HTMLTextAreaElement> document.createElement('textarea');
+      compose.className = 'fill';
+      var send = F.INPUT({ type: 'button', value: 'Post reply' });
+      var form = F.DIVClass('vbox', compose, send);
+      replies.appendChild(form);
+      F.clicksE(send).mapE(function(_) { return compose.value; })
+       .POST(post + '?parent=' + encodeURIComponent(comment._id))
+       .index('response')
+       .JSONParse()
+       .mapE(function(resp : PostCommentResponse) {
+         var ownCaps = {};
+         ownCaps[resp.id] = resp.caps;
+         replies.replaceChild(dispComment({
+           _id: resp.id,
+           reviewerName: myName,
+           text: resp.text,
+           html: resp.html,
+           visibility: resp.visibility,
+           timestamp: Math.floor((new Date()).valueOf() / 1000)
+         }, post, ownCaps), form);
+       });
+    });
+    var own = caps && caps[comment._id];
+    if (own) {
+      var edit = F.SPAN(F.TEXT(' Edit'));
+      var del = F.SPAN(F.TEXT(' Delete'));
+      edit.className = del.className = 'buttonLink';
+      actions.appendChild(edit);
+      actions.appendChild(del);
+      F.clicksE(edit).mapE(function(_) {
+        return window.prompt('Edit your comment:', source);
+      }).filterE(function(t) { return t !== null; })
+       .mapE(function(t) { source = t; return t; })
+       .POST(own.edit)
+       .index('response')
+       .JSONParse()
+       .mapE(function(resp) { text.innerHTML = resp.html; });
+      F.clicksE(del).filterE(function(_) {
+        return window.confirm('Delete your comment?');
+      }).mapE(function(_) {
+        text.textContent = '[deleted]';
+        cell.removeChild(actions);
+        return '';
+      }).POST(own.delete);
+    }
+    cell.appendChild(actions);
+  }
+  cell.appendChild(replies);
+  return F.DIVClass('row', cell);
+}
+
+/**
+ * Displays an applicant's record from a prior cycle. Chairs see suggested
+ * matches with buttons to confirm or reject them.
+ */
+function priorPane(record : PriorRecord) {
+  var app = record.app;
+  var title = F.DIV(F.TEXT('Applied in ' + record.match.priorCycle + ' as ' +
+    app['firstName'] + ' ' + app['lastName'] +
+    (app['decision'] ? ' (' + app['decision'] + ')' : '')));
+  if (record.match.status !== 'confirmed') {
+    var confirm = F.INPUT({ type: 'button', value: 'Same person' });
+    var reject = F.INPUT({ type: 'button', value: 'Not the same' });
+    F.mergeE(F.clicksE(confirm).constantE({ status: 'confirmed' }),
+             F.clicksE(reject).constantE({ status: 'rejected' }))
+     .JSONStringify()
+     .POST(record.setMatchCap)
+     .mapE(function() { update.sendEvent(true); });
+    return F.DIVClass('vbox', title,
+      F.DIV(F.TEXT('Suggested match on ' + record.match.reason + ' ' +
+                   (app[record.match.reason] || '') + ': '),
+            confirm, reject));
+  }
+  var scores = (record.scores || []).map(function(s) {
+    return F.DIV(F.TEXT(record.reviewers[s.revId] + ': ' + s.score));
+  });
+  return F.DIVClass('vbox', title, F.DIVSty({ className: 'vbox' }, scores),
+    F.DIVSty({ className: 'table' },
+             (record.comments || []).map(function(c) { return dispComment(c); })));
+}
+
+/**
+ * A button that makes a new link at which the applicant chooses their areas,
+ * faculty and program, replacing any earlier link, and shows it.
+ */
+function applicantLinkPane(applicantLinkCap : string) {
+  if (!applicantLinkCap) {
+    return F.DIV();
+  }
+  var btn = F.INPUT({ type: 'button', value: 'New link for the applicant' });
+  var out = F.DIV();
+  F.clicksE(btn).constantE('')
+   .POST(applicantLinkCap)
+   .index('response')
+   .JSONParse()
+   .mapE(function(resp) {
+     var link = window.location.href.replace(/[^\/]*$/, '') +
+       'applicant.html#' + resp.cap;
+     out.innerHTML = '';
+     out.appendChild(F.INPUT({ type: 'text', value: link, readOnly: true }));
+     out.appendChild(F.TEXT(' Expires ' +
+       new Date(resp.expires).toLocaleDateString() +
+       '. Earlier links no longer work.'));
+   });
+  return F.DIV(btn, out);
+}
+
+/**
+ * Lists the reviewers assigned to the application. Chairs may also assign
+ * and unassign reviewers.
+ */
+function assignmentPane(reviewers, assigned : Array<string>,
+                        assignCap : string) {
+  var names = assigned.map(function(revId) {
+    return reviewers[revId] || revId;
+  });
+  var list = F.TEXT('Assigned: ' + (names.join(', ') || 'nobody'));
+  if (!assignCap) {
+    return F.DIV(list);
+  }
+  var elt = F.SELECTSty({}, Object.keys(reviewers).map(function(revId) {
+    return F.OPTION({ value: revId }, reviewers[revId]);
+  }));
+  var assign = F.INPUT({ type: 'button', value: 'Assign' });
+  var unassign = F.INPUT({ type: 'button', value: 'Unassign' });
+  F.mergeE(F.clicksE(assign).constantE(true),
+           F.clicksE(unassign).constantE(false))
+   .mapE(function(b) { return { revId: elt.value, assigned: b }; })
+   .JSONStringify()
+   .POST(assignCap)
+   .mapE(function() { update.sendEvent(true); });
+  return F.DIVClass('vbox', F.DIV(list), F.DIV(elt, assign, unassign));
 }
 
 function highlightPane(reviewers, highlightedBy, highlightCap) {
@@ -241,6 +496,93 @@ function highlightPane(reviewers, highlightedBy, highlightCap) {
   return F.DIV(F.TEXT('Set a star for: '), elt, btn);
 }
 
+interface NotifyPrefs {
+  email: string;
+  mute?: Array<string>
+}
+
+/**
+ * Lets the reviewer choose how often they are emailed about highlights and
+ * mentions.
+ */
+function emailPrefPane(notifyPrefsCap : string) {
+  var choices = { immediate: 'right away', daily: 'daily', never: 'never' };
+  var elt = F.SELECTSty({}, Object.keys(choices).map(function(v) {
+    return F.OPTION({ value: v }, choices[v]);
+  }));
+  var mute : Array<string> = [];
+  F.oneE({}).GET(notifyPrefsCap)
+   .index('response')
+   .JSONParse()
+   .mapE(function(prefs : NotifyPrefs) {
+     elt.value = prefs.email;
+     mute = prefs.mute || [];
+   });
+  F.extractEventE(elt, 'change')
+   .mapE(function(_) { return { email: elt.value, mute: mute }; })
+   .JSONStringify()
+   .POST(notifyPrefsCap);
+  return F.SPAN(F.TEXT('Email me: '), elt);
+}
+
+interface Notification {
+  _id: string;
+  kind: string;
+  appId: string;
+  appName?: string;
+  fromName: string;
+  text?: string;
+  time: string
+}
+
+var notificationVerbs = {
+  highlight: ' set a star for you on ',
+  mention: ' mentioned you on ',
+  reply: ' replied to your comment on ',
+  assigned: ' assigned you to review ',
+  unassigned: ' unassigned you from '
+};
+
+/**
+ * Shows the number of unread notifications. Clicking it lists them, with a
+ * button that marks them read.
+ */
+function inboxPane(loginData : LoginResponse) {
+  var badge = F.SPAN(F.TEXT(''));
+  var list = F.DIVClass('vbox');
+  list.style.display = 'none';
+  var markRead = F.INPUT({ type: 'button', value: 'Mark all read' });
+  var notes = F.mergeE(
+    F.clicksE(badge).filterE(function(_) {
+      list.style.display = list.style.display === 'none' ? '' : 'none';
+      return list.style.display === '';
+    }).constantE({}).GET(loginData.notificationsCap),
+    F.clicksE(markRead).constantE({ ids: [] }).JSONStringify()
+     .POST(loginData.notificationsCap))
+    .index('response')
+    .JSONParse();
+  function showCount(n : number) {
+    badge.className = n > 0 ? 'buttonLink unread' : 'buttonLink';
+    badge.textContent = '✉ ' + n;
+  }
+  showCount(loginData.unreadCount);
+  notes.mapE(function(ns : Array<Notification>) {
+    showCount(ns.length);
+    list.innerHTML = '';
+    ns.forEach(function(n) {
+      var text = n.fromName + (notificationVerbs[n.kind] || ' ' + n.kind + ' ') +
+        (n.appName || n.appId) + (n.text ? ': ' + n.text : '');
+      list.appendChild(F.DIV(F.TEXT(text)));
+    });
+    if (ns.length > 0) {
+      list.appendChild(markRead);
+    } else {
+      list.appendChild(F.DIV(F.TEXT('No unread notifications.')));
+    }
+  });
+  return F.DIVClass('vbox', badge, list);
+}
+
 function selfStarPane(loginData, highlightCap, unhighlightCap, highlightedBy) {
   function mkReq(b) {
       return {
@@ -288,6 +630,97 @@ function ratingPane(label, init, setScoreCap) {
   return elt;
 }
 
+/**
+ * The department's evaluation form, filled in with the reviewer's answers, if
+ * any. Under each question, summary aggregates everyone's answers, and the
+ * answers to text questions are listed.
+ */
+function evaluationPane(form : EvaluationForm, evaluations : Array<Evaluation>,
+                        evaluateCap : string,
+                        summary : { [id : string]: QuestionSummary }) {
+  if (!form) {
+    return F.DIV();
+  }
+  var mine = evaluations.filter(function(e) { return e.revId === myRevId; })[0];
+  var answers = mine ? mine.answers : {};
+  var inputs = {};
+  function describe(q : FormQuestion) : string {
+    var s = (summary || {})[q.id];
+    if (!s || s.answers === 0) {
+      return '';
+    }
+    if (q.type === 'number') {
+      return 'Average ' + s.mean.toFixed(1) + ' of ' + s.answers;
+    }
+    return Object.keys(s.choices || {}).map(function(c) {
+      return c + ': ' + s.choices[c];
+    }).join(', ');
+  }
+  function question(q : FormQuestion) {
+    var init = answers[q.id] === undefined ? '' : String(answers[q.id]);
+    var input;
+    if (q.type === 'choice') {
+      input = F.SELECTSty({}, [F.OPTION({ value: '' }, '')].concat(
+        q.choices.map(function(c) { return F.OPTION({ value: c }, c); })));
+    }
+    else if (q.type === 'number') {
+      input = F.INPUT({ type: 'text', style: { width: '40px' },
+                        placeholder: (q.min === undefined ? '' : q.min) + '--' +
+                          (q.max === undefined ? '' : q.max) });
+    }
+    else {
+      input = document.createElement('textarea');
+      input.className = 'fill';
+    }
+    input.value = init;
+    inputs[q.id] = { question: q, input: input };
+    var others = evaluations.filter(function(e) {
+      return q.type === 'text' && e.revId !== myRevId && e.answers[q.id];
+    }).map(function(e) {
+      return F.DIV(F.TEXT(e.reviewerName + ': ' + e.answers[q.id]));
+    });
+    return F.DIVClass('vbox question',
+      F.DIV(F.TEXT(q.label + (q.required ? ' *' : ''))), input,
+      F.DIVSty({ className: 'summary' }, [F.TEXT(describe(q))]),
+      F.DIVSty({ className: 'vbox' }, others));
+  }
+  var sections = form.sections.map(function(section) {
+    return F.DIVClass('vbox', F.DIVSty({ className: 'sectionTitle' },
+                                       [F.TEXT(section.title)]),
+                      F.DIVSty({ className: 'vbox' },
+                               section.questions.map(question)));
+  });
+  var submit = F.INPUT({ type: 'button', value: 'Save evaluation' });
+  var status = F.SPAN(F.TEXT(mine ? 'Saved ' +
+    util.relativeDate(mine.timestamp) : ''));
+  F.clicksE(submit).mapE(function(_) {
+    var req = {};
+    Object.keys(inputs).forEach(function(id) {
+      var v = inputs[id].input.value;
+      if (v === '') {
+        return;
+      }
+      // The server rejects numbers that do not parse.
+      req[id] = inputs[id].question.type === 'number' && !isNaN(Number(v))
+        ? Number(v) : v;
+    });
+    return { answers: req };
+  }).JSONStringify()
+   .POST(evaluateCap)
+   .index('response')
+   .JSONParse()
+   .mapE(function(resp) {
+     if (resp.msg) {
+       status.textContent = resp.msg;
+       return;
+     }
+     status.textContent = 'Saved';
+     update.sendEvent(true);
+   });
+  return F.DIVClass('vbox evaluation', F.DIVSty({ className: 'vbox' }, sections),
+                    F.DIV(submit, status));
+}
+
 function infoPane(fields, val) {
   function row(field) {
     return F.DIVSty({ className: 'row' },
@@ -300,6 +733,29 @@ function infoPane(fields, val) {
   return F.DIVClass('vbox table', fields.filter(notStar).map(row));
 }
 
+/**
+ * Thumbnails of the first pages of the applicant's materials, linked to the
+ * materials.
+ */
+function thumbnailPane(loginData : LoginResponse, val) {
+  var previews = val['previews'] || {};
+  var thumbnails = [];
+  ['materials', 'recs'].forEach(function(field) {
+    (val[field] || []).forEach(function(m) {
+      var preview = previews[m.url];
+      if (typeof m.url !== 'string' || !preview || !preview.image) {
+        return;
+      }
+      thumbnails.push(F.A({ target: '_blank',
+                            href: loginData.materialsCap + '?' + m.url,
+                            title: m.text },
+        F.IMG({ src: loginData.previewsCap + '?' + encodeURIComponent(m.url),
+                className: 'thumbnail', alt: m.text })));
+    });
+  });
+  return F.DIVSty({ className: 'thumbnails' }, thumbnails);
+}
+
 /**
  * arg is the response from fetchCap, which includes caps to post new comments
  * and highlight this application.
@@ -309,36 +765,63 @@ function dispCommentPane(loginData, reviewers, data, fields, comments) {
   function fn(arg) {
     var post = F.INPUT({ className: 'fill', type: 'button', value: 'Post' });
     var commentDisp = F.DIVSty({ className: 'table' },
-      [arg.comments.map(dispComment)]);
-    var newPosts = F.clicksE(post).mapE(function(){
+      arg.comments.map(function(c : AppComment) {
+        return dispComment(c, arg.post, arg.commentCaps);
+      }));
+    function showPosted(resp : PostCommentResponse) {
+      var caps = {};
+      caps[resp.id] = resp.caps;
+      commentDisp.appendChild(dispComment({
+        _id: resp.id,
+        reviewerName: loginData.friendlyName,
+        text: resp.text,
+        html: resp.html,
+        visibility: resp.visibility,
+        timestamp: Math.floor((new Date()).valueOf() / 1000)
+      }, arg.post, caps));
+    }
+    F.clicksE(post).mapE(function(){
       var compose = <HTMLTextAreaElement>getEltById('composeTextarea');
+      var visibility = <HTMLSelectElement>getEltById('commentVisibility');
       var c = compose.value;
       compose.value = '';
-      commentDisp.appendChild(
-        dispComment({ 
-          reviewerName: loginData.friendlyName,
-          text: c,
-          timestamp: Math.floor((new Date()).valueOf() / 1000)
-        }));
-      return c;
+      F.oneE(c).POST(arg.post + '?visibility=' + visibility.value)
+       .index('response')
+       .JSONParse()
+       .mapE(showPosted);
     });
 
-    newPosts.POST(arg.post);
-
     var initRating = dataById[arg.appId]['score_rating']
       ? dataById[arg.appId]['score_rating'][myRevId]
       : '';
     var highlights =
       highlightPane(reviewers, arg.highlightedBy, arg.highlightCap);
     var ratings = ratingPane('rating', initRating, arg.setScoreCap);
+    var history = F.DIVClass('vbox');
+    F.oneE({}).GET(arg.historyCap)
+     .index('response')
+     .JSONParse()
+     .mapE(function(records : Array<PriorRecord>) {
+       records.forEach(function(r) { history.appendChild(priorPane(r)); });
+     });
+    var evaluation = evaluationPane(arg.evaluationForm, arg.evaluations || [],
+      arg.evaluateCap, dataById[arg.appId]['evaluationSummary']);
     return {
-      info: infoPane(fields, dataById[arg.appId]),
+      info: F.DIVClass('vbox',
+        F.DIV(F.A({ target: '_blank', href: arg.packetCap },
+                  F.TEXT('All materials as one PDF'))),
+        assignmentPane(reviewers, arg.assigned || [], arg.assignCap),
+        applicantLinkPane(arg.applicantLinkCap),
+        thumbnailPane(loginData, dataById[arg.appId]),
+        infoPane(fields, dataById[arg.appId])),
+      evaluation: evaluation,
       highlights: highlights,
       rating: F.DIVSty({ className: 'vbox boxAlignCenter' },
                     [selfStarPane(loginData, arg.highlightCap, 
                     arg.unhighlightCap, arg.highlightedBy), ratings]),
       commentDisp: commentDisp,
-      commentPost: post
+      commentPost: post,
+      history: history
     };
   }
   return comments.mapE(fn);
@@ -386,7 +869,11 @@ function dataMap(data) {
  * @param {F.EventStream} data
  */
 function loadData(urlArgs, loginData, data) { 
-  /** @type {Array.<Cols.TextCol>} */
+  /**
+   * @type {Array.<Cols.TextCol>}
+   * Keep in sync with clientCols in src/export/export.go, which evaluates
+   * serialized filters on the server.
+   */
   var fields = [
     new Cols.TextCol('personId', 'Id', false),
     new Cols.StarCol(loginData.revId, 'highlight', 'Starred', true),
@@ -415,6 +902,10 @@ function loadData(urlArgs, loginData, data) {
     new Cols.ScoreCol('score_rating', 'Ratings', loginData.reviewers, 
                       loginData.revId, false),
     new Cols.NumCol('avgscore_rating', 'Average Rating', false),
+    new Cols.NumCol('lettersReceived', 'Letters Received', false),
+    new Cols.EnumCol('lettersStatus', 'Letters', false),
+    new Cols.SetCol('letterWriters', 'Letter Writers', false),
+    new Cols.NumCol('evaluations', 'Evaluations', false),
   ];
   
   var vises = fields.map(function(f) : Node {
@@ -440,6 +931,19 @@ function loadData(urlArgs, loginData, data) {
     window.location.hash = escape(JSON.stringify({ filter: ser }));
     });
 
+  if (loginData.exportCap) {
+    F.insertDomB(tableFilter.ser.liftB(function(ser) {
+      function link(format) {
+        var query = 'format=' + format + '&filter=' +
+          encodeURIComponent(JSON.stringify(ser));
+        return F.A({ href: loginData.exportCap + '?' + query, target: '_blank' },
+          F.TEXT(format.toUpperCase()));
+      }
+      return F.SPAN(F.TEXT(' Export: '), link('csv'), F.TEXT(' '),
+        link('xlsx'), F.TEXT(' '), link('json'));
+    }), 'exportLinks');
+  }
+
   F.clicksE(getEltById('showHideFilters'))
   .collectE(false, function(_, showHide) {
     var elt = <HTMLElement> getEltById('filterDetail');
@@ -494,6 +998,8 @@ function loadData(urlArgs, loginData, data) {
   F.insertDomE(detail.index('commentPost'), 'postComment');
   F.insertDomE(detail.index('highlights'), 'highlightPane');
   F.insertDomE(detail.index('rating'), 'ratingPane');
+  F.insertDomE(detail.index('evaluation'), 'evaluationPane');
+  F.insertDomE(detail.index('history'), 'historyPane');
 
   if (isFirefox()) {
     firefoxUI();
@@ -507,8 +1013,9 @@ var canLogin = false;
 function mkLogin() {
   var user = <HTMLInputElement> getEltById("username");
   var pass = <HTMLInputElement> getEltById("password");
+  var dept = <HTMLInputElement> getEltById("dept");
   myRevId = user.value;
-  return { username: user.value, password: pass.value };
+  return { username: user.value, password: pass.value, dept: dept.value };
 }
 
 var update = F.receiverE();
@@ -517,7 +1024,10 @@ var update = F.receiverE();
  */
 function loggedIn(urlArgs, loginData : LoginResponse) {
 
+  myName = loginData.friendlyName;
   getEltById('friendly').appendChild(F.TEXT(loginData.friendlyName));
+  getEltById('inbox').appendChild(inboxPane(loginData));
+  getEltById('emailPrefs').appendChild(emailPrefPane(loginData.notifyPrefsCap));
   var refresh = F.mergeE(F.oneE(true), update);
   loadData(urlArgs, loginData, 
     refresh.mapE(function() { return {}; })